@@ -13,6 +13,7 @@ package app
 
 import (
 	"gitee.com/openeuler/ktib/cmd/ktib/app/builders"
+	"github.com/containers/storage/pkg/unshare"
 	"github.com/spf13/cobra"
 )
 
@@ -23,6 +24,10 @@ func newCmdBuilder() *cobra.Command {
 		Short:   "Run this command in order to operate images at local or remote",
 		// TODO 检查container依赖文件，及软件包是否安装
 		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			// without root, continue in a user namespace mapped with the ranges of /etc/subuid and /etc/subgid
+			if unshare.IsRootless() {
+				unshare.MaybeReexecUsingUserNamespace(false)
+			}
 			return nil
 		},
 		Args: cobra.NoArgs,
@@ -32,10 +37,13 @@ func newCmdBuilder() *cobra.Command {
 		builders.BUILDCmd(),
 		builders.COPYCmd(),
 		builders.COMMITCmd(),
+		builders.CONFIGCmd(),
 		builders.FROMCmd(),
+		builders.INSPECTCmd(),
 		builders.LABELCmd(),
 		builders.ListBuildersCmd(),
 		builders.MOUNTCmd(),
+		builders.PRUNECmd(),
 		builders.RUNCmd(),
 		builders.RMCmd(),
 		builders.UMOUNTCmd())
@@ -16,11 +16,13 @@ import (
 	"fmt"
 
 	"gitee.com/openeuler/ktib/pkg/builder"
+	"gitee.com/openeuler/ktib/pkg/options"
 	"gitee.com/openeuler/ktib/pkg/utils"
 	"github.com/spf13/cobra"
 )
 
 func ADDCmd() *cobra.Command {
+	var op options.AddOption
 	cmd := &cobra.Command{
 		Use:   "add",
 		Short: "Example: add builder source destination",
@@ -32,22 +34,32 @@ func ADDCmd() *cobra.Command {
 			args = tail(args)
 			source := args[:len(args)-1]
 			destination := args[len(args)-1]
-			return add(cmd, name, destination, source)
+			return add(cmd, name, destination, source, op)
 		},
 	}
+	addFlags(cmd, &op)
 	return cmd
 }
 
-func add(cmd *cobra.Command, name, destination string, source []string) error {
+// addFlags registers the options shared by the add and copy commands.
+func addFlags(cmd *cobra.Command, op *options.AddOption) {
+	flags := cmd.Flags()
+	flags.StringVar(&op.Chown, "chown", "", "Set the owner of the copied content (user[:group], names are resolved in the builder)")
+	flags.StringVar(&op.Chmod, "chmod", "", "Set the octal permission bits of the copied content")
+	flags.BoolVar(&op.Link, "link", false, "Accepted for compatibility, the content is copied into the layer of the builder")
+}
+
+func add(cmd *cobra.Command, name, destination string, source []string, op options.AddOption) error {
 	store, err := utils.GetStore(cmd)
 	if err != nil {
 		return err
 	}
+	op.Extract = true
 	builderobj, err := builder.FindBuilder(store, name)
 	if err != nil {
 		return errors.New(fmt.Sprintf("Not found the %s builder", name))
 	}
-	err = builderobj.Add(destination, source, true)
+	err = builderobj.Add(destination, source, op)
 	if err != nil {
 		return errors.New(fmt.Sprintf("error adding content to builder: %s", err))
 	}
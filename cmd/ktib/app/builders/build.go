@@ -12,9 +12,17 @@
 package builders
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"os"
+	"os/signal"
 	"path/filepath"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
 
 	"gitee.com/openeuler/ktib/pkg/builder"
 	"gitee.com/openeuler/ktib/pkg/options"
@@ -24,23 +32,145 @@ import (
 
 func BUILDCmd() *cobra.Command {
 	var op options.BuildOptions
+	var buildArgs, secrets []string
+	var timestamp, matrix string
+	var squash, squashNew bool
+	var jobs int
 	cmd := &cobra.Command{
 		Use:   "build",
 		Short: "build an image",
-		Args:  cobra.MaximumNArgs(1),
+		Long: `'build'命令按照Dockerfile构建镜像。
+
+用 -f FILE=TAG 给多个Dockerfile分别指定镜像名称，--jobs N 同时运行最多N个构建。
+--matrix FILE 对同一个Dockerfile的每组构建参数各构建一次，FILE是YAML格式的列表，
+每项的args为构建参数，tag为镜像名称；没有tag的项使用 -t 的值，其中的 ${ARG} 会被替换为该项的构建参数。
+每个构建的输出在其结束后整体打印，最后列出所有构建的结果，任何一个构建失败时命令以非零状态退出。
+
+示例:
+  # 同时构建两个镜像
+  ktib builders build -f app/Dockerfile=app:latest -f web/Dockerfile=web:latest --jobs 2 .
+
+  # 每个JDK版本构建一个镜像，jdk.yaml的内容为:
+  #   - args:
+  #       JDK_VERSION: 11
+  #   - args:
+  #       JDK_VERSION: 17
+  ktib builders build --matrix jdk.yaml -t 'app:jdk${JDK_VERSION}' --jobs 2 .`,
+		Args: cobra.MaximumNArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return build(cmd, args, &op)
+			op.Args = parseBuildArgs(buildArgs)
+			var err error
+			if op.Secrets, err = parseSecrets(secrets); err != nil {
+				return err
+			}
+			if op.Timestamp, err = parseTimestamp(timestamp); err != nil {
+				return err
+			}
+			if op.Squash, err = squashMode(squash, squashNew); err != nil {
+				return err
+			}
+			return build(cmd, args, &op, jobs, matrix)
 		},
 	}
 	flags := cmd.Flags()
-	flags.StringArrayVarP(&op.File, "file", "f", []string{""}, "Name of the Dockerfile (Default is 'PATH/Dockerfile')")
-	flags.StringVarP(&op.Tags, "tag", "t", "none", "tagged name to apply to the build image")
+	flags.StringArrayVarP(&op.File, "file", "f", nil, "Name of the Dockerfile (Default is 'PATH/Dockerfile'), FILE=TAG builds it as its own image tagged TAG")
+	flags.StringVarP(&op.Tags, "tag", "t", "none", "tagged name to apply to the build image, a transport prefix like oci-archive:/out/img.tar writes the image there")
+	flags.StringVar(&op.Target, "target", "", "set the target build stage to build")
+	flags.BoolVar(&op.NoCache, "no-cache", false, "do not use existing cached images for the build steps")
+	flags.StringArrayVar(&buildArgs, "build-arg", nil, "set build-time variables in KEY=VALUE form, KEY alone takes the value from the environment")
+	flags.StringVar(&op.Network, "network", builder.NetworkNone, "network mode of RUN steps: 'none' (loopback only) or 'host'")
+	flags.StringArrayVar(&secrets, "secret", nil, "secret file exposed to RUN --mount=type=secret, in id=ID,src=PATH form")
+	flags.StringVar(&op.OutputFormat, "format", builder.FormatOCI, "manifest format of the built image: 'oci' or 'docker'")
+	flags.StringVar(&timestamp, "timestamp", "", "seconds since the epoch to record as the creation time for reproducible images, defaults to $SOURCE_DATE_EPOCH")
+	flags.BoolVar(&squash, "squash", false, "squash all layers of the image into a single layer")
+	flags.DurationVar(&op.Timeout, "timeout", 0, "stop the build when it takes longer, e.g. 30m, 0 for no limit")
+	flags.DurationVar(&op.StepTimeout, "step-timeout", 0, "stop the build when a step takes longer, e.g. 5m, 0 for no limit")
+	flags.BoolVar(&op.Rm, "rm", true, "remove the builders after a successful build")
+	flags.BoolVar(&op.ForceRm, "force-rm", false, "always remove the builders, also after a failed build")
+	flags.StringVar(&op.Resume, "resume", "", "continue the failed build of the builder after its last successful step, the steps up to it must be unchanged")
+	flags.BoolVar(&op.KeepOnFailure, "keep-on-failure", false, "keep the builder of a failed build mounted with the changes of the failed step, to look into with 'builders mount' or 'builders run'")
+	flags.BoolVar(&squashNew, "squash-new", false, "squash the layers added by the build into a single layer on top of the base image")
+	flags.StringVar(&op.Progress, "progress", builder.ProgressPlain, "progress output: 'plain' or 'json', json prints one event per line and sends the output of RUN steps to stderr")
+	flags.StringVar(&op.IIDFile, "iidfile", "", "write the ID of the built image to the file")
+	flags.IntVar(&jobs, "jobs", 1, "number of builds to run at the same time with several FILE=TAG Dockerfiles or --matrix")
+	flags.StringVar(&matrix, "matrix", "", "YAML file with a list of build-arg sets, the Dockerfile is built once for every set")
+	securityFlags(cmd, &op.SecurityOption)
 	return cmd
 }
 
-func build(cmd *cobra.Command, args []string, op *options.BuildOptions) error {
-	var dockerfiles []string
-	dockerfiles = op.File
+// squashMode turns the --squash and --squash-new flags into the squash mode of the commit.
+func squashMode(squash, squashNew bool) (string, error) {
+	switch {
+	case squash && squashNew:
+		return "", errors.New("--squash and --squash-new can not be used together")
+	case squash:
+		return builder.SquashAll, nil
+	case squashNew:
+		return builder.SquashNew, nil
+	}
+	return "", nil
+}
+
+// parseTimestamp returns the fixed time of a reproducible build, given with --timestamp or
+// in SOURCE_DATE_EPOCH. Without either nil is returned and the current time is used.
+func parseTimestamp(value string) (*time.Time, error) {
+	if value == "" {
+		value = os.Getenv(builder.SourceDateEpoch)
+	}
+	if value == "" {
+		return nil, nil
+	}
+	return builder.ParseTimestamp(value)
+}
+
+// parseSecrets maps the id of every --secret value to its source file.
+func parseSecrets(values []string) (map[string]string, error) {
+	secrets := make(map[string]string)
+	for _, value := range values {
+		var id, src string
+		for _, field := range strings.Split(value, ",") {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) != 2 {
+				return nil, fmt.Errorf("invalid secret %q, expected id=ID,src=PATH", value)
+			}
+			switch kv[0] {
+			case "id":
+				id = kv[1]
+			case "src", "source":
+				src = kv[1]
+			default:
+				return nil, fmt.Errorf("invalid secret %q, unknown option %q", value, kv[0])
+			}
+		}
+		if id == "" || src == "" {
+			return nil, fmt.Errorf("invalid secret %q, both id and src are required", value)
+		}
+		abs, err := filepath.Abs(src)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(abs); err != nil {
+			return nil, fmt.Errorf("invalid secret %q: %w", value, err)
+		}
+		secrets[id] = abs
+	}
+	return secrets, nil
+}
+
+func parseBuildArgs(values []string) map[string]string {
+	args := make(map[string]string)
+	for _, value := range values {
+		kv := strings.SplitN(value, "=", 2)
+		if len(kv) == 2 {
+			args[kv[0]] = kv[1]
+		} else if env, ok := os.LookupEnv(kv[0]); ok {
+			args[kv[0]] = env
+		}
+	}
+	return args
+}
+
+func build(cmd *cobra.Command, args []string, op *options.BuildOptions, jobs int, matrix string) error {
 	contextDir := ""
 	if len(args) > 0 {
 		absDir, err := filepath.Abs(args[0])
@@ -55,17 +185,98 @@ func build(cmd *cobra.Command, args []string, op *options.BuildOptions) error {
 	if contextDir == "" {
 		return errors.New("no context directory specified, and no dockerfile specified")
 	}
+	op.ContextDirectory = contextDir
 
-	if len(dockerfiles) == 0 {
+	dockerfiles, buildJobs, err := parseBuildFiles(op.File, op.Tags)
+	if err != nil {
+		return err
+	}
+	if len(dockerfiles) == 0 && len(buildJobs) == 0 {
 		dockerfiles = append(dockerfiles, filepath.Join(contextDir, "Dockerfile"))
 	}
+	if matrix != "" {
+		if len(buildJobs) > 0 || len(dockerfiles) != 1 {
+			return errors.New("--matrix builds a single Dockerfile given without a tag")
+		}
+		if buildJobs, err = builder.MatrixJobs(matrix, dockerfiles[0], op.Tags); err != nil {
+			return err
+		}
+		dockerfiles = nil
+	} else if len(buildJobs) > 0 && len(dockerfiles) > 0 {
+		return errors.New("either give every Dockerfile a tag with FILE=TAG or none of them")
+	}
 
 	store, err := utils.GetStore(cmd)
 	if err != nil {
 		return err
 	}
-	if err := builder.BuildDockerfiles(store, op, dockerfiles...); err != nil {
-		fmt.Printf("error build dockerfiles %v\n", err)
+	ctx, stop := interruptContext()
+	defer stop()
+	if len(buildJobs) == 0 {
+		if err := builder.BuildDockerfiles(ctx, store, op, dockerfiles...); err != nil {
+			// the build has failed, not the command line
+			cmd.SilenceUsage = true
+			return fmt.Errorf("error build dockerfiles: %w", err)
+		}
+		return nil
+	}
+	results, err := builder.BuildParallel(ctx, store, op, jobs, buildJobs)
+	if op.Progress != builder.ProgressJSON && results != nil {
+		printBuildResults(cmd.OutOrStdout(), results)
+	}
+	if err != nil {
+		cmd.SilenceUsage = true
+		return fmt.Errorf("error build dockerfiles: %w", err)
 	}
 	return nil
 }
+
+// parseBuildFiles splits the --file values into Dockerfiles built with the tag of the build and
+// jobs, the FILE=TAG values that are built as images of their own.
+func parseBuildFiles(files []string, tag string) ([]string, []builder.BuildJob, error) {
+	var dockerfiles []string
+	var jobs []builder.BuildJob
+	for _, file := range files {
+		kv := strings.SplitN(file, "=", 2)
+		if len(kv) == 1 {
+			dockerfiles = append(dockerfiles, file)
+			continue
+		}
+		if kv[0] == "" || kv[1] == "" {
+			return nil, nil, fmt.Errorf("invalid Dockerfile %q, expected FILE=TAG", file)
+		}
+		jobs = append(jobs, builder.BuildJob{Dockerfile: kv[0], Tag: kv[1]})
+	}
+	return dockerfiles, jobs, nil
+}
+
+// printBuildResults lists the outcome of every build of a parallel build.
+func printBuildResults(out io.Writer, results []builder.BuildResult) {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TAG\tDOCKERFILE\tIMAGE ID\tDURATION\tRESULT")
+	for _, result := range results {
+		status := "ok"
+		if result.Err != nil {
+			status = "failed"
+		}
+		imageID := result.ImageID
+		if len(imageID) > 12 {
+			imageID = imageID[:12]
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", result.Job.Tag, result.Job.Dockerfile, imageID,
+			result.Duration.Round(time.Millisecond), status)
+	}
+	w.Flush()
+}
+
+// interruptContext returns a context that is cancelled by SIGINT or SIGTERM, so that the running
+// command is killed and the builders are cleaned up. Only the first signal is caught, another one
+// terminates ktib right away.
+func interruptContext() (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	return ctx, stop
+}
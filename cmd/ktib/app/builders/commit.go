@@ -13,11 +13,23 @@ package builders
 
 import (
 	"gitee.com/openeuler/ktib/pkg/builder"
+	"gitee.com/openeuler/ktib/pkg/options"
 	"gitee.com/openeuler/ktib/pkg/utils"
 	"github.com/spf13/cobra"
 )
 
-func commit(cmd *cobra.Command, args []string) error {
+func commit(cmd *cobra.Command, args []string, format, timestamp string, squash, squashNew bool, compression options.CompressionOption) error {
+	if err := builder.ValidateFormat(format); err != nil {
+		return err
+	}
+	created, err := parseTimestamp(timestamp)
+	if err != nil {
+		return err
+	}
+	mode, err := squashMode(squash, squashNew)
+	if err != nil {
+		return err
+	}
 	exportTo := ""
 	container := ""
 	if len(args) == 2 {
@@ -32,24 +44,52 @@ func commit(cmd *cobra.Command, args []string) error {
 	if err != nil {
 		return err
 	}
-
-	return cmBuilder.Commit(exportTo)
+	cmBuilder.Format = format
+	cmBuilder.Timestamp = created
+	cmBuilder.Squash = mode
+	cmBuilder.Compression = compression
+	_, err = cmBuilder.Commit(exportTo)
+	return err
 }
 
 func COMMITCmd() *cobra.Command {
+	var format, timestamp string
+	var squash, squashNew bool
+	var compression options.CompressionOption
 	cmd := &cobra.Command{
 		Use:   "commit [builderID/builderName] [newImageName]",
 		Short: "从容器的更改创建新映像",
 		Args:  cobra.RangeArgs(1, 2),
 		Long: `'commit'命令从builder的更改创建新镜像。它需要一个builderID或builderName作为第一个参数，
-还可以选择提供一个新的镜像名称作为第二个参数。
+还可以选择提供一个新的镜像名称作为第二个参数，名称可以带有传输方式前缀，
+例如 oci-archive:、docker-archive:、oci: 或 dir:，此时镜像直接写入对应的位置。
 
 示例:
   # 从构建器的更改创建新映像
-  ktib builders commit builderID/builderName newImageName`,
+  ktib builders commit builderID/builderName newImageName
+
+  # 以 Docker schema2 格式创建镜像
+  ktib builders commit --format docker builderID/builderName newImageName
+
+  # 使用固定时间戳创建可复现的镜像
+  SOURCE_DATE_EPOCH=$(git log -1 --format=%ct) ktib builders commit builderID/builderName newImageName
+
+  # 直接将镜像写入 OCI 归档文件，也支持 docker-archive:、oci: 和 dir: 等传输方式
+  ktib builders commit builderID/builderName oci-archive:/out/img.tar
+
+  # 使用 zstd:chunked 压缩镜像层，支持按需部分拉取
+  ktib builders commit --compression-format zstd:chunked builderID/builderName oci:/out/layout:v1
+
+  # 将构建器的更改合并为基础镜像之上的单个层
+  ktib builders commit --squash-new builderID/builderName newImageName`,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return commit(cmd, args)
+			return commit(cmd, args, format, timestamp, squash, squashNew, compression)
 		},
 	}
+	cmd.Flags().StringVar(&format, "format", builder.FormatOCI, "manifest format of the image: 'oci' or 'docker'")
+	cmd.Flags().BoolVar(&squash, "squash", false, "squash all layers of the image into a single layer")
+	cmd.Flags().BoolVar(&squashNew, "squash-new", false, "squash the changes of the builder into a single layer on top of the base image")
+	cmd.Flags().StringVar(&timestamp, "timestamp", "", "seconds since the epoch to record as the creation time for a reproducible image, defaults to $SOURCE_DATE_EPOCH")
+	utils.CompressionFlags(cmd.Flags(), &compression)
 	return cmd
 }
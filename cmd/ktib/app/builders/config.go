@@ -0,0 +1,91 @@
+/*
+   Copyright (c) 2023 KylinSoft Co., Ltd.
+   Kylin trusted image builder(ktib) is licensed under Mulan PSL v2.
+   You can use this software according to the terms and conditions of the Mulan PSL v2.
+   You may obtain a copy of Mulan PSL v2 at:
+            http://license.coscl.org.cn/MulanPSL2
+   THIS SOFTWARE IS PROVIDED ON AN "AS IS" BASIS, WITHOUT WARRANTIES OF ANY KIND, EITHER EXPRESS OR IMPLIED, INCLUDING
+   BUT NOT LIMITED TO NON-INFRINGEMENT, MERCHANTABILITY OR FIT FOR A PARTICULAR PURPOSE.
+   See the Mulan PSL v2 for more details.
+*/
+
+package builders
+
+import (
+	"gitee.com/openeuler/ktib/pkg/builder"
+	"gitee.com/openeuler/ktib/pkg/options"
+	"gitee.com/openeuler/ktib/pkg/utils"
+	"github.com/spf13/cobra"
+)
+
+func config(cmd *cobra.Command, args []string, op options.ConfigOption) error {
+	// only the flags that were given change the configuration, an empty value clears a setting
+	flags := cmd.Flags()
+	for name, value := range map[string]**string{
+		"entrypoint":  &op.Entrypoint,
+		"cmd":         &op.Cmd,
+		"user":        &op.User,
+		"workdir":     &op.Workdir,
+		"author":      &op.Author,
+		"comment":     &op.Comment,
+		"stop-signal": &op.StopSignal,
+		"healthcheck": &op.Healthcheck,
+	} {
+		if !flags.Changed(name) {
+			*value = nil
+		}
+	}
+	store, err := utils.GetStore(cmd)
+	if err != nil {
+		return err
+	}
+	b, err := builder.FindBuilder(store, args[0])
+	if err != nil {
+		return err
+	}
+	return b.Configure(op)
+}
+
+func CONFIGCmd() *cobra.Command {
+	var op options.ConfigOption
+	var entrypoint, command, user, workdir, author, comment, stopSignal, healthcheck string
+	op.Entrypoint, op.Cmd, op.User, op.Workdir = &entrypoint, &command, &user, &workdir
+	op.Author, op.Comment, op.StopSignal, op.Healthcheck = &author, &comment, &stopSignal, &healthcheck
+	cmd := &cobra.Command{
+		Use:   "config [builderID/builderName]",
+		Short: "修改构建器提交时写入镜像的配置",
+		Args:  cobra.ExactArgs(1),
+		Long: `'config'命令修改构建器的镜像配置，效果与 Dockerfile 中对应的指令相同。
+--env、--label 和 --annotation 使用 KEY=VALUE 形式设置，使用 KEY- 形式删除；
+--port 和 --volume 以 - 结尾时删除对应的端口或卷。
+--entrypoint 和 --cmd 接受 JSON 数组或 shell 形式，传入空字符串时清除。
+
+示例:
+  # 设置环境变量、工作目录和启动命令
+  ktib builders config --env APP_ENV=prod --workdir /app --cmd '["./server"]' builderID/builderName
+
+  # 暴露端口并删除继承自基础镜像的标签
+  ktib builders config --port 8080/tcp --label maintainer- builderID/builderName
+
+  # 设置健康检查
+  ktib builders config --healthcheck '--interval=30s CMD curl -f http://localhost/' builderID/builderName`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return config(cmd, args, op)
+		},
+	}
+	flags := cmd.Flags()
+	flags.StringArrayVarP(&op.Env, "env", "e", nil, "set an environment variable in KEY=VALUE form, KEY- removes it")
+	flags.StringVar(&entrypoint, "entrypoint", "", "entrypoint of the image, in JSON array or shell form")
+	flags.StringVar(&command, "cmd", "", "default command of the image, in JSON array or shell form")
+	flags.StringVarP(&user, "user", "u", "", "user the commands of the image run as")
+	flags.StringVar(&workdir, "workdir", "", "working directory of the image")
+	flags.StringArrayVarP(&op.Ports, "port", "p", nil, "expose a port, in PORT[/PROTOCOL] form, a trailing - removes it")
+	flags.StringArrayVarP(&op.Volumes, "volume", "v", nil, "add a volume, a trailing - removes it")
+	flags.StringArrayVarP(&op.Labels, "label", "l", nil, "set a label in KEY=VALUE form, KEY- removes it")
+	flags.StringArrayVarP(&op.Annotations, "annotation", "a", nil, "set a manifest annotation of OCI images in KEY=VALUE form, KEY- removes it")
+	flags.StringVar(&author, "author", "", "author of the image")
+	flags.StringVar(&comment, "comment", "", "comment recorded in the image history")
+	flags.StringVar(&stopSignal, "stop-signal", "", "signal that stops the container")
+	flags.StringVar(&healthcheck, "healthcheck", "", "health check in the form of the HEALTHCHECK instruction, 'NONE' disables the check of the base image")
+	return cmd
+}
@@ -16,11 +16,13 @@ import (
 	"fmt"
 
 	"gitee.com/openeuler/ktib/pkg/builder"
+	"gitee.com/openeuler/ktib/pkg/options"
 	"gitee.com/openeuler/ktib/pkg/utils"
 	"github.com/spf13/cobra"
 )
 
 func COPYCmd() *cobra.Command {
+	var op options.AddOption
 	cmd := &cobra.Command{
 		Use:   "copy [builderID/builderName] [source files...] [destination]",
 		Short: "从本地文件系统复制文件到容器",
@@ -32,7 +34,10 @@ func COPYCmd() *cobra.Command {
   ktib builders copy builderID/builderName ./local/file.txt /container/dir
 
   # 将本地目录递归复制到构建器的某个位置
-  ktib builders copy builderID/builderName ./local/dir /container/dir`,
+  ktib builders copy builderID/builderName ./local/dir /container/dir
+
+  # 复制文件并设置属主和权限
+  ktib builders copy --chown=1001:0 --chmod=0644 builderID/builderName ./app.conf /etc/app/`,
 		Args: cobra.ExactArgs(3),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			if len(args) < 3 {
@@ -42,14 +47,15 @@ func COPYCmd() *cobra.Command {
 			args = tail(args)
 			source := args[:len(args)-1]
 			destination := args[len(args)-1]
-			return Cp(cmd, name, destination, source)
+			return Cp(cmd, name, destination, source, op)
 		},
 	}
+	addFlags(cmd, &op)
 
 	return cmd
 }
 
-func Cp(cmd *cobra.Command, name, destination string, source []string) error {
+func Cp(cmd *cobra.Command, name, destination string, source []string, op options.AddOption) error {
 	store, err := utils.GetStore(cmd)
 	if err != nil {
 		return err
@@ -58,5 +64,5 @@ func Cp(cmd *cobra.Command, name, destination string, source []string) error {
 	if err != nil {
 		return errors.New(fmt.Sprintf("Not found the %s builder", name))
 	}
-	return builderobj.Add(destination, source, false)
+	return builderobj.Add(destination, source, op)
 }
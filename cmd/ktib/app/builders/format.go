@@ -0,0 +1,161 @@
+/*
+   Copyright (c) 2023 KylinSoft Co., Ltd.
+   Kylin trusted image builder(ktib) is licensed under Mulan PSL v2.
+   You can use this software according to the terms and conditions of the Mulan PSL v2.
+   You may obtain a copy of Mulan PSL v2 at:
+            http://license.coscl.org.cn/MulanPSL2
+   THIS SOFTWARE IS PROVIDED ON AN "AS IS" BASIS, WITHOUT WARRANTIES OF ANY KIND, EITHER EXPRESS OR IMPLIED, INCLUDING
+   BUT NOT LIMITED TO NON-INFRINGEMENT, MERCHANTABILITY OR FIT FOR A PARTICULAR PURPOSE.
+   See the Mulan PSL v2 for more details.
+*/
+
+package builders
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"gitee.com/openeuler/ktib/pkg/builder"
+	"gitee.com/openeuler/ktib/pkg/options"
+	ktype "gitee.com/openeuler/ktib/pkg/types"
+	"github.com/containers/common/pkg/report"
+	"github.com/docker/go-units"
+	"github.com/sirupsen/logrus"
+)
+
+// containerReport is a row of the list of builders.
+type containerReport struct {
+	ID      string
+	Names   string
+	LayerID string
+	ImageID string
+	Created string
+	Type    string
+}
+
+func sortContainers(containers []builder.BuilderContainer) ([]containerReport, error) {
+	var containerReports []containerReport
+	for _, bc := range containers {
+		c := bc.Container
+		var containerName string
+		if len(c.Names) > 0 {
+			containerName = c.Names[0]
+		} else {
+			containerName = ""
+		}
+		containerType := "builder"
+		if bc.Builder == nil {
+			containerType = "external"
+		}
+		containerReports = append(containerReports, containerReport{
+			ID:      c.ID[:10],
+			Names:   containerName,
+			LayerID: c.LayerID,
+			ImageID: c.ImageID,
+			Created: units.HumanDuration(time.Since(c.Created)) + " ago",
+			Type:    containerType,
+		})
+	}
+	return containerReports, nil
+}
+
+func formatBuilders(containers []builder.BuilderContainer, ops options.BuildersOption) error {
+	// TODO 参考docker输出
+	defaultBuilderTableFormat := "table {{.ID}}  {{.Names}} {{.LayerID}} {{.ImageID}}   {{.Created}}"
+	if ops.All {
+		// containers of other tools are listed too, the type tells them apart
+		defaultBuilderTableFormat += " {{.Type}}"
+	}
+	containerReports, err := sortContainers(containers)
+	if err != nil {
+		return err
+	}
+	headers := report.Headers(containerReport{}, map[string]string{
+		"Name": "Name",
+	})
+	formater, err := report.New(os.Stdout, "format").Parse(report.OriginPodman, defaultBuilderTableFormat)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = formater.Flush()
+		if err != nil {
+			logrus.Error(err)
+		}
+	}()
+	err = formater.Execute(headers)
+	if err != nil {
+		return err
+	}
+	err = formater.Execute(containerReports)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func jsonFormatBuilders(containers []builder.BuilderContainer, ops options.BuildersOption) error {
+	var jsonBuilders []ktype.JsonBuilder
+	for _, bc := range containers {
+		b := bc.Container
+		jsonBuilders = append(jsonBuilders,
+			ktype.JsonBuilder{
+				ID:       b.ID,
+				Names:    b.Names,
+				ImageID:  b.ImageID,
+				Created:  b.Created,
+				External: bc.Builder == nil,
+			})
+	}
+	data, err := json.MarshalIndent(jsonBuilders, "", "    ")
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s\n", data)
+	return nil
+}
+
+func jsonFormatMountInfo(builders []*builder.Builder) error {
+	var jsonBuilders []ktype.JsonBuilder
+	for _, b := range builders {
+		if b.MountPoint != "" {
+			jsonBuilders = append(jsonBuilders,
+				ktype.JsonBuilder{
+					ID:      b.ID,
+					Mount:   b.MountPoint,
+					ImageID: b.FromImageID,
+				})
+		}
+	}
+	data, err := json.MarshalIndent(jsonBuilders, "", "    ")
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s\n", data)
+	return nil
+}
+
+// formatInspect prints the state of a builder as indented JSON, or with the Go template format.
+func formatInspect(info builder.BuilderInfo, format string) error {
+	if format == "" {
+		data, err := json.MarshalIndent(info, "", "    ")
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s\n", data)
+		return nil
+	}
+	if !strings.HasSuffix(format, "\n") {
+		format += "\n"
+	}
+	formater, err := report.New(os.Stdout, "inspect").Parse(report.OriginUser, format)
+	if err != nil {
+		return err
+	}
+	defer formater.Flush()
+	// the template is run for every element of the data, as for the lists of images
+	return formater.Execute([]builder.BuilderInfo{info})
+}
@@ -38,10 +38,15 @@ func from(cmd *cobra.Command, args []string, op *options.FromOption) error {
 	if store.Exists(op.Names) {
 		return errors.New("builder name is exists, You have to remove that container to be able to reuse the name")
 	}
+	mappings, err := builder.IDMappingOptions(op)
+	if err != nil {
+		return err
+	}
 	option := builder.BuilderOptions{
-		FromImage:  args[0],
-		Container:  op.Names,
-		PullPolicy: op.PullPolicy,
+		FromImage:        args[0],
+		Container:        op.Names,
+		PullPolicy:       op.PullPolicy,
+		IDMappingOptions: mappings,
 	}
 	builders, err := builder.NewBuilder(store, option)
 	if err != nil {
@@ -67,11 +72,11 @@ func FROMCmd() *cobra.Command {
 	flags := cmd.Flags()
 	flags.StringVarP(&op.Names, "-name", "n", "", "Image name")
 	flags.BoolVar(&op.PullPolicy, "pullpolicy", false, "Force images pull policy set ifnotparent")
-	flags.BoolVar(&op.HostUIDMap, "-hostuidmap", false, "Force host UID map")
-	flags.BoolVar(&op.HostGIDMap, "-hostgidmap", false, "Force host GID map")
-	flags.StringVar(&op.UIDMap, "-uidmap", "", "UID map")
-	flags.StringVar(&op.GIDMap, "-gidmap", "", "GID map")
-	flags.StringVar(&op.SubUIDMap, "-subuidmap", "", "subuid UID map for a user")
-	flags.StringVar(&op.SubGIDMap, "-subgidmap", "", "subgid GID map for a group")
+	flags.BoolVar(&op.HostUIDMap, "hostuidmap", false, "Force host UID map")
+	flags.BoolVar(&op.HostGIDMap, "hostgidmap", false, "Force host GID map")
+	flags.StringVar(&op.UIDMap, "uidmap", "", "UID map in containerID:hostID:size form, several maps are separated by commas")
+	flags.StringVar(&op.GIDMap, "gidmap", "", "GID map in containerID:hostID:size form, defaults to the UID map")
+	flags.StringVar(&op.SubUIDMap, "subuidmap", "", "use the ranges of this user in /etc/subuid as UID map")
+	flags.StringVar(&op.SubGIDMap, "subgidmap", "", "use the ranges of this group in /etc/subgid as GID map")
 	return cmd
 }
@@ -0,0 +1,53 @@
+/*
+   Copyright (c) 2023 KylinSoft Co., Ltd.
+   Kylin trusted image builder(ktib) is licensed under Mulan PSL v2.
+   You can use this software according to the terms and conditions of the Mulan PSL v2.
+   You may obtain a copy of Mulan PSL v2 at:
+            http://license.coscl.org.cn/MulanPSL2
+   THIS SOFTWARE IS PROVIDED ON AN "AS IS" BASIS, WITHOUT WARRANTIES OF ANY KIND, EITHER EXPRESS OR IMPLIED, INCLUDING
+   BUT NOT LIMITED TO NON-INFRINGEMENT, MERCHANTABILITY OR FIT FOR A PARTICULAR PURPOSE.
+   See the Mulan PSL v2 for more details.
+*/
+
+package builders
+
+import (
+	"gitee.com/openeuler/ktib/pkg/builder"
+	"gitee.com/openeuler/ktib/pkg/options"
+	"gitee.com/openeuler/ktib/pkg/utils"
+	"github.com/spf13/cobra"
+)
+
+func inspect(cmd *cobra.Command, args []string, op options.InspectOption) error {
+	store, err := utils.GetStore(cmd)
+	if err != nil {
+		return err
+	}
+	b, err := builder.FindBuilder(store, args[0])
+	if err != nil {
+		return err
+	}
+	return formatInspect(b.Inspect(), op.Format)
+}
+
+func INSPECTCmd() *cobra.Command {
+	var op options.InspectOption
+	cmd := &cobra.Command{
+		Use:   "inspect [builderID/builderName]",
+		Short: "显示构建器的状态和将要提交的镜像配置",
+		Args:  cobra.ExactArgs(1),
+		Long: `'inspect'命令以JSON格式输出构建器的状态，以及提交时将写入镜像的OCI配置。
+
+示例:
+  # 查看构建器的完整信息
+  ktib builders inspect builderID/builderName
+
+  # 只输出将要提交的入口点和命令
+  ktib builders inspect --format '{{.OCIConfig.Config.Entrypoint}} {{.OCIConfig.Config.Cmd}}' builderID/builderName`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return inspect(cmd, args, op)
+		},
+	}
+	cmd.Flags().StringVarP(&op.Format, "format", "f", "", "format the output with a Go template instead of JSON")
+	return cmd
+}
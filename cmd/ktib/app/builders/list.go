@@ -12,6 +12,7 @@
 package builders
 
 import (
+	"gitee.com/openeuler/ktib/pkg/builder"
 	"gitee.com/openeuler/ktib/pkg/options"
 	utils2 "gitee.com/openeuler/ktib/pkg/utils"
 	"github.com/spf13/cobra"
@@ -22,14 +23,14 @@ func listBuilders(c *cobra.Command, args []string, ops options.BuildersOption) e
 	if err != nil {
 		return err
 	}
-	containers, err := store.Containers()
+	containers, err := builder.ListBuilders(store, ops.All, ops.Filters)
 	if err != nil {
 		return err
 	}
 	if ops.Json {
-		return utils2.JsonFormatBuilders(containers, ops)
+		return jsonFormatBuilders(containers, ops)
 	}
-	return utils2.FormatBuilders(containers, ops)
+	return formatBuilders(containers, ops)
 }
 
 func ListBuildersCmd() *cobra.Command {
@@ -38,11 +39,29 @@ func ListBuildersCmd() *cobra.Command {
 		Use:     "list",
 		Aliases: []string{"ls"},
 		Short:   "List working builder and their base images",
+		Long: `'list'命令列出ktib创建的构建器，其他工具(例如podman)创建的容器默认不显示，使用 --all 时一并列出并标记为 external。
+
+可用的过滤条件(--filter KEY=VALUE，同一个KEY的多个值满足其一即可，不同KEY须同时满足):
+  name=REGEX        名称匹配正则表达式
+  id=PREFIX         ID以PREFIX开头
+  ancestor=IMAGE    基于指定镜像创建
+  mounted=BOOL      是否已挂载
+  before=TIME       在构建器或时间之前创建，TIME可以是构建器名称或ID、24h这样的时长、RFC3339时间或日期
+  since=TIME        在构建器或时间之后创建
+
+示例:
+  # 列出基于 openeuler:22.03 且已挂载的构建器
+  ktib builders list --filter ancestor=openeuler:22.03 --filter mounted=true
+
+  # 列出最近一小时内创建的构建器
+  ktib builders list --filter since=1h`,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			return listBuilders(cmd, args, op)
 		},
 	}
 	flag := cmd.Flags()
 	flag.BoolVar(&op.Json, "json", false, "output in JSON format")
+	flag.BoolVarP(&op.All, "all", "a", false, "also list the containers that were not created by ktib")
+	flag.StringArrayVarP(&op.Filters, "filter", "f", nil, "filter the builders with KEY=VALUE conditions")
 	return cmd
 }
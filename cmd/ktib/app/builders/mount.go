@@ -43,7 +43,7 @@ func mount(cmd *cobra.Command, args []string, option *options.MountOption) error
 		}
 	}
 
-	return utils2.JsonFormatMountInfo(builders)
+	return jsonFormatMountInfo(builders)
 }
 
 func MOUNTCmd() *cobra.Command {
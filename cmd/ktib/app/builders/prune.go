@@ -0,0 +1,71 @@
+/*
+   Copyright (c) 2023 KylinSoft Co., Ltd.
+   Kylin trusted image builder(ktib) is licensed under Mulan PSL v2.
+   You can use this software according to the terms and conditions of the Mulan PSL v2.
+   You may obtain a copy of Mulan PSL v2 at:
+            http://license.coscl.org.cn/MulanPSL2
+   THIS SOFTWARE IS PROVIDED ON AN "AS IS" BASIS, WITHOUT WARRANTIES OF ANY KIND, EITHER EXPRESS OR IMPLIED, INCLUDING
+   BUT NOT LIMITED TO NON-INFRINGEMENT, MERCHANTABILITY OR FIT FOR A PARTICULAR PURPOSE.
+   See the Mulan PSL v2 for more details.
+*/
+
+package builders
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"gitee.com/openeuler/ktib/pkg/builder"
+	"gitee.com/openeuler/ktib/pkg/options"
+	"gitee.com/openeuler/ktib/pkg/utils"
+	"github.com/spf13/cobra"
+)
+
+func prune(cmd *cobra.Command, op options.PruneOption) error {
+	if !op.Force {
+		fmt.Print("WARNING! This will remove all dangling builders.\nAre you sure you want to continue? [y/N] ")
+		answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if answer = strings.ToLower(strings.TrimSpace(answer)); answer != "y" && answer != "yes" {
+			return nil
+		}
+	}
+	store, err := utils.GetStore(cmd)
+	if err != nil {
+		return err
+	}
+	removed, err := builder.PruneBuilders(store, op.IncludeMounted, op.Filters)
+	for _, id := range removed {
+		fmt.Println(id)
+	}
+	return err
+}
+
+func PRUNECmd() *cobra.Command {
+	var op options.PruneOption
+	cmd := &cobra.Command{
+		Use:   "prune",
+		Short: "删除悬空的构建器",
+		Args:  cobra.NoArgs,
+		Long: `'prune'命令删除悬空的构建器，即构建失败后遗留的没有名称的构建器。
+通过 from 创建的构建器都有名称，不会被删除；其他工具创建的容器也不会被删除。
+构建失败后遗留的构建器虽然可以通过 --resume 继续构建，也会被删除。
+已挂载的构建器可能属于正在进行的构建，只有指定 --include-mounted 时才会被删除。
+
+示例:
+  # 不经确认删除创建超过24小时的悬空构建器
+  ktib builders prune --force --filter until=24h`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return prune(cmd, op)
+		},
+	}
+	flags := cmd.Flags()
+	flags.BoolVarP(&op.Force, "force", "f", false, "do not prompt for confirmation")
+	flags.BoolVar(&op.IncludeMounted, "include-mounted", false, "also remove the dangling builders that are mounted, they may belong to a running build")
+	flags.StringArrayVar(&op.Filters, "filter", nil, "only remove the builders that match the condition, until=TIME removes the builders created before TIME, like 24h")
+	return cmd
+}
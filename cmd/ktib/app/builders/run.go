@@ -12,7 +12,11 @@
 package builders
 
 import (
+	"errors"
 	"fmt"
+	"os"
+	"strings"
+
 	"gitee.com/openeuler/ktib/pkg/builder"
 	"gitee.com/openeuler/ktib/pkg/options"
 	"gitee.com/openeuler/ktib/pkg/utils"
@@ -39,7 +43,32 @@ func RUN(cmd *cobra.Command, args []string, option options.RUNOption) error {
 		return err
 	}
 
-	return runBuilder.Run(runArgs, option)
+	option.Env = hostEnv(option.Env)
+	// the command line is run by the shell, so that pipes and redirections work as expected
+	ctx, stop := interruptContext()
+	defer stop()
+	err = runBuilder.Run(ctx, []string{"/bin/sh", "-c", strings.Join(runArgs, " ")}, option)
+	var exitErr *builder.ExitError
+	if errors.As(err, &exitErr) {
+		// the command reported its failure itself, ktib only exits with its status
+		cmd.SilenceErrors = true
+		cmd.SilenceUsage = true
+	}
+	return err
+}
+
+// hostEnv completes the variables given without a value with their value on the host, variables
+// that are not set on the host are left out.
+func hostEnv(env []string) []string {
+	var result []string
+	for _, e := range env {
+		if strings.Contains(e, "=") {
+			result = append(result, e)
+		} else if value, ok := os.LookupEnv(e); ok {
+			result = append(result, e+"="+value)
+		}
+	}
+	return result
 }
 
 func RUNCmd() *cobra.Command {
@@ -52,7 +81,19 @@ func RUNCmd() *cobra.Command {
 
 选项:
   --runtime string   使用的容器运行时(默认为"runc")
-  --workdir string   容器内的工作目录(默认为"/")  
+  --workdir string   容器内的工作目录(默认为构建器的工作目录, 未设置时为"/")
+  --user string      运行命令的用户, 格式为 user[:group], 通过根文件系统中的 /etc/passwd 解析(默认为构建器的用户)
+  -e, --env          设置环境变量 KEY=VALUE, 只给出 KEY 时使用宿主机上的值, 会覆盖构建器的环境变量
+  -v, --volume       绑定挂载宿主机目录, 格式为 SOURCE:DESTINATION[:ro|rw]
+  --hostname string  容器的主机名(默认为构建器ID的前12位)
+  -t, --tty          分配伪终端, 终端窗口大小的变化会同步到容器中
+  --network string   网络模式, "none" 仅有回环网络(默认), "host" 使用宿主机网络
+  --memory string    内存上限, 例如 512m、2g
+  --cpus float       可使用的 CPU 数量, 例如 1.5
+  --pids-limit int   进程数上限(默认为2048, -1 表示不限制)
+  --cap-add strings  添加 capability, "ALL" 表示全部
+  --cap-drop strings 移除 capability, "ALL" 表示全部
+  --security-opt     安全选项: seccomp=<profile.json>、seccomp=unconfined 或 no-new-privileges
 
 示例:
   # 根据指定的构建器在容器中运行命令
@@ -62,7 +103,21 @@ func RUNCmd() *cobra.Command {
   ktib builders run --runtime crun builderID/builderName echo "Hello, World!"
 
   # 使用特定工作目录运行命令
-  ktib builders run --workdir /app builderID/builderName ./app-entrypoint.sh`,
+  ktib builders run --workdir /app builderID/builderName ./app-entrypoint.sh
+
+  # 使用宿主机网络运行命令
+  ktib builders run --network host builderID/builderName curl -I https://openeuler.org
+
+  # 限制内存和 CPU, 并禁止提升权限
+  ktib builders run --memory 1g --cpus 2 --security-opt no-new-privileges builderID/builderName make -j2
+
+  # 在伪终端中交互式运行 shell
+  ktib builders run -t builderID/builderName bash
+
+  # 以指定用户运行, 挂载源码目录并设置环境变量
+  ktib builders run --user app -v $(pwd):/src:ro -e GOFLAGS=-mod=vendor --workdir /src builderID/builderName make
+
+命令的退出码会作为 ktib 的退出码返回, 便于脚本判断命令是否执行成功。`,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			return RUN(cmd, args, runOption)
 		},
@@ -73,6 +128,26 @@ func RUNCmd() *cobra.Command {
 
 func initFlags(cmd *cobra.Command) {
 	flags := cmd.Flags()
+	// flags after the builder belong to the command, like the -v of grep -v
+	flags.SetInterspersed(false)
 	flags.StringVar(&runOption.Runtime, "runtime", "runc", "Runtime to use for this container")
-	flags.StringVar(&runOption.Workdir, "workdir", "/", "Working directory inside the builder")
+	flags.StringVar(&runOption.Workdir, "workdir", "", "Working directory inside the builder (default the working directory of the builder)")
+	flags.StringVarP(&runOption.User, "user", "u", "", "user[:group] to run the command as (default the user of the builder)")
+	flags.StringArrayVarP(&runOption.Env, "env", "e", nil, "set environment variables, KEY alone takes the value of the host")
+	flags.StringArrayVarP(&runOption.Volumes, "volume", "v", nil, "bind mount a volume: SOURCE:DESTINATION[:OPTIONS]")
+	flags.StringVar(&runOption.Hostname, "hostname", "", "hostname of the container (default the short builder ID)")
+	flags.BoolVarP(&runOption.Terminal, "tty", "t", false, "allocate a pseudo-terminal")
+	flags.StringVar(&runOption.Network, "network", builder.NetworkNone, "Network mode: 'none' (loopback only) or 'host'")
+	securityFlags(cmd, &runOption.SecurityOption)
+}
+
+// securityFlags adds the resource limit and privilege flags shared by run and build.
+func securityFlags(cmd *cobra.Command, op *options.SecurityOption) {
+	flags := cmd.Flags()
+	flags.StringVar(&op.Memory, "memory", "", "memory limit of the command, e.g. 512m or 2g")
+	flags.Float64Var(&op.CPUs, "cpus", 0, "number of CPUs the command may use, e.g. 1.5")
+	flags.Int64Var(&op.PidsLimit, "pids-limit", builder.DefaultPidsLimit, "maximum number of processes, -1 for no limit")
+	flags.StringSliceVar(&op.CapAdd, "cap-add", nil, "add capabilities, 'ALL' adds every capability")
+	flags.StringSliceVar(&op.CapDrop, "cap-drop", nil, "drop capabilities, 'ALL' drops every capability")
+	flags.StringArrayVar(&op.SecurityOpt, "security-opt", nil, "security options: seccomp=<profile.json>, seccomp=unconfined or no-new-privileges")
 }
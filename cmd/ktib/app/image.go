@@ -35,6 +35,7 @@ func newCmdImage() *cobra.Command {
 		imagetool.PushCmd(),
 		imagetool.RemoveImagesCmd(),
 		imagetool.SaveCmd(),
+		imagetool.SquashCmd(),
 		imagetool.TAGCmd())
 	return cmd
 }
@@ -20,7 +20,7 @@ import (
 	"github.com/spf13/cobra"
 )
 
-func push(cmd *cobra.Command, args []string) error {
+func push(cmd *cobra.Command, args []string, op options.PushOption) error {
 	store, err := utils.GetStore(cmd)
 	if err != nil {
 		return err
@@ -29,7 +29,7 @@ func push(cmd *cobra.Command, args []string) error {
 	if err != nil {
 		return err
 	}
-	return imageManager.Push(args)
+	return imageManager.Push(args, op)
 }
 func PushCmd() *cobra.Command {
 	var op options.PushOption
@@ -40,10 +40,11 @@ func PushCmd() *cobra.Command {
 			if len(args) < 1 {
 				return errors.New("requires exactly 1 argument")
 			}
-			return push(cmd, args)
+			return push(cmd, args, op)
 		},
 	}
 	flags := cmd.Flags()
 	flags.StringVar(&op.SignBy, "sign-by", "", "If non-empty, asks for a signature to be added during the copy, and specifies a key ID.")
+	utils.CompressionFlags(flags, &op.CompressionOption)
 	return cmd
 }
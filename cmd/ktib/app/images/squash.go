@@ -0,0 +1,51 @@
+/*
+   Copyright (c) 2023 KylinSoft Co., Ltd.
+   Kylin trusted image builder(ktib) is licensed under Mulan PSL v2.
+   You can use this software according to the terms and conditions of the Mulan PSL v2.
+   You may obtain a copy of Mulan PSL v2 at:
+            http://license.coscl.org.cn/MulanPSL2
+   THIS SOFTWARE IS PROVIDED ON AN "AS IS" BASIS, WITHOUT WARRANTIES OF ANY KIND, EITHER EXPRESS OR IMPLIED, INCLUDING
+   BUT NOT LIMITED TO NON-INFRINGEMENT, MERCHANTABILITY OR FIT FOR A PARTICULAR PURPOSE.
+   See the Mulan PSL v2 for more details.
+*/
+
+package images
+
+import (
+	"gitee.com/openeuler/ktib/pkg/builder"
+	"gitee.com/openeuler/ktib/pkg/utils"
+	"github.com/spf13/cobra"
+)
+
+func squash(cmd *cobra.Command, args []string) error {
+	store, err := utils.GetStore(cmd)
+	if err != nil {
+		return err
+	}
+	name := args[0]
+	if len(args) == 2 {
+		name = args[1]
+	}
+	return builder.SquashImage(store, args[0], name)
+}
+
+func SquashCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "squash IMAGE [NEW_IMAGE]",
+		Short: "将镜像的所有层合并为一个层",
+		Args:  cobra.RangeArgs(1, 2),
+		Long: `'squash'命令将本地存储中的镜像展平为只有一个层的新镜像, 配置和历史记录保持不变。
+不指定新镜像名称时, 原镜像被替换。
+
+示例:
+  # 将镜像展平后保存为新镜像
+  ktib images squash openeuler/base:22.03 openeuler/base:22.03-flat
+
+  # 原地展平镜像
+  ktib images squash openeuler/base:22.03`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return squash(cmd, args)
+		},
+	}
+	return cmd
+}
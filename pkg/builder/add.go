@@ -0,0 +1,145 @@
+/*
+   Copyright (c) 2023 KylinSoft Co., Ltd.
+   Kylin trusted image builder(ktib) is licensed under Mulan PSL v2.
+   You can use this software according to the terms and conditions of the Mulan PSL v2.
+   You may obtain a copy of Mulan PSL v2 at:
+            http://license.coscl.org.cn/MulanPSL2
+   THIS SOFTWARE IS PROVIDED ON AN "AS IS" BASIS, WITHOUT WARRANTIES OF ANY KIND, EITHER EXPRESS OR IMPLIED, INCLUDING
+   BUT NOT LIMITED TO NON-INFRINGEMENT, MERCHANTABILITY OR FIT FOR A PARTICULAR PURPOSE.
+   See the Mulan PSL v2 for more details.
+*/
+
+package builder
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gitee.com/openeuler/ktib/pkg/options"
+	"github.com/containers/storage/pkg/archive"
+	"github.com/containers/storage/pkg/idtools"
+	securejoin "github.com/cyphar/filepath-securejoin"
+)
+
+// parseAddFlags returns the options of an ADD or COPY instruction. --from is handled by the
+// executor since it selects where the sources are read from.
+func parseAddFlags(instruction string, flags map[string][]string) (options.AddOption, error) {
+	ops := options.AddOption{Extract: instruction == "ADD"}
+	for name, values := range flags {
+		value := values[len(values)-1]
+		switch name {
+		case "from":
+		case "chown":
+			ops.Chown = value
+		case "chmod":
+			if _, err := parseChmod(value); err != nil {
+				return ops, err
+			}
+			ops.Chmod = value
+		case "link":
+			link, err := strconv.ParseBool(value)
+			if value != "" && err != nil {
+				return ops, fmt.Errorf("invalid --link value %q", value)
+			}
+			ops.Link = value == "" || link
+		default:
+			return ops, fmt.Errorf("unknown flag for %s: --%s", instruction, name)
+		}
+	}
+	return ops, nil
+}
+
+// resolveChown turns the --chown value into the ids used for the copied files. Names are looked
+// up in the rootfs of the builder, and like docker a user without a group also becomes the group.
+func resolveChown(rootfs, spec string) (*idtools.IDPair, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	uid, gid, err := lookupUser(rootfs, spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --chown %q: %w", spec, err)
+	}
+	if !strings.Contains(spec, ":") {
+		gid = uid
+	}
+	return &idtools.IDPair{UID: int(uid), GID: int(gid)}, nil
+}
+
+// parseChmod parses the octal --chmod value.
+func parseChmod(spec string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(spec, 8, 32)
+	if err != nil || mode > 07777 {
+		return 0, fmt.Errorf("invalid --chmod %q, an octal mode is required", spec)
+	}
+	return os.FileMode(mode), nil
+}
+
+// addArchiver returns the archiver for one Add call, with the ownership and the mode of the
+// options applied to every entry it writes. Entries are owned by ids of the container, which
+// mappings translates to the ids on disk.
+func addArchiver(rootfs string, mappings *idtools.IDMappings, ops options.AddOption) (*archive.Archiver, error) {
+	archiver := archive.NewDefaultArchiver()
+	archiver.UntarIDMappings = mappings
+	chown, err := resolveChown(rootfs, ops.Chown)
+	if err != nil {
+		return nil, err
+	}
+	archiver.ChownOpts = chown
+	if ops.Chmod != "" {
+		mode, err := parseChmod(ops.Chmod)
+		if err != nil {
+			return nil, err
+		}
+		untar := archiver.Untar
+		archiver.Untar = func(tarArchive io.Reader, dest string, options *archive.TarOptions) error {
+			return untar(chmodTar(tarArchive, mode), dest, options)
+		}
+	}
+	return archiver, nil
+}
+
+// chmodTar rewrites the permission bits of every entry of a tar stream except symbolic links.
+func chmodTar(in io.Reader, mode os.FileMode) io.Reader {
+	r, w := io.Pipe()
+	go func() {
+		tr := tar.NewReader(in)
+		tw := tar.NewWriter(w)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				w.CloseWithError(tw.Close())
+				return
+			}
+			if err != nil {
+				w.CloseWithError(err)
+				return
+			}
+			if hdr.Typeflag != tar.TypeSymlink {
+				hdr.Mode = hdr.Mode&^07777 | int64(mode)
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				w.CloseWithError(err)
+				return
+			}
+			if _, err := io.Copy(tw, tr); err != nil {
+				w.CloseWithError(err)
+				return
+			}
+		}
+	}()
+	return r
+}
+
+// resolveDest returns the path of dest inside rootfs, relative paths start at workdir. Symbolic
+// links in the path are resolved within rootfs.
+func resolveDest(rootfs, workdir, dest string) (string, error) {
+	if !filepath.IsAbs(dest) {
+		dest = filepath.Join(workdir, dest)
+	}
+	return securejoin.SecureJoin(rootfs, dest)
+}
@@ -0,0 +1,186 @@
+package builder
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gitee.com/openeuler/ktib/pkg/options"
+	"github.com/containers/storage/pkg/idtools"
+	"github.com/sirupsen/logrus"
+)
+
+func TestParseAddFlags(t *testing.T) {
+	tests := []struct {
+		name        string
+		instruction string
+		flags       map[string][]string
+		expected    options.AddOption
+		wantErr     bool
+	}{
+		{name: "add extracts", instruction: "ADD", expected: options.AddOption{Extract: true}},
+		{name: "copy from", instruction: "COPY", flags: map[string][]string{"from": {"build"}}, expected: options.AddOption{}},
+		{
+			name:        "chown and chmod",
+			instruction: "COPY",
+			flags:       map[string][]string{"chown": {"app:app"}, "chmod": {"0640"}},
+			expected:    options.AddOption{Chown: "app:app", Chmod: "0640"},
+		},
+		{name: "bare link", instruction: "COPY", flags: map[string][]string{"link": {""}}, expected: options.AddOption{Link: true}},
+		{name: "link true", instruction: "ADD", flags: map[string][]string{"link": {"true"}}, expected: options.AddOption{Extract: true, Link: true}},
+		{name: "link false", instruction: "COPY", flags: map[string][]string{"link": {"false"}}, expected: options.AddOption{}},
+		{name: "bad link", instruction: "COPY", flags: map[string][]string{"link": {"maybe"}}, wantErr: true},
+		{name: "bad chmod", instruction: "COPY", flags: map[string][]string{"chmod": {"u+x"}}, wantErr: true},
+		{name: "unknown flag", instruction: "COPY", flags: map[string][]string{"parents": {""}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseAddFlags(tt.instruction, tt.flags)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseAddFlags() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("parseAddFlags() = %+v, want %+v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestResolveChown(t *testing.T) {
+	rootfs := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(rootfs, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(rootfs, "etc/passwd"), []byte("root:x:0:0::/root:/bin/sh\napp:x:1001:0::/opt/app-root:/bin/sh\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(rootfs, "etc/group"), []byte("root:x:0:\nwww:x:33:\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		spec     string
+		expected *idtools.IDPair
+		wantErr  bool
+	}{
+		{spec: "", expected: nil},
+		{spec: "app", expected: &idtools.IDPair{UID: 1001, GID: 1001}},
+		{spec: "app:www", expected: &idtools.IDPair{UID: 1001, GID: 33}},
+		{spec: "55", expected: &idtools.IDPair{UID: 55, GID: 55}},
+		{spec: "1001:0", expected: &idtools.IDPair{UID: 1001, GID: 0}},
+		{spec: "nobody", wantErr: true},
+		{spec: "app:nogroup", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			got, err := resolveChown(rootfs, tt.spec)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("resolveChown() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if (got == nil) != (tt.expected == nil) || (got != nil && *got != *tt.expected) {
+				t.Errorf("resolveChown() = %v, want %v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestChmodTar(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	entries := []*tar.Header{
+		{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "dir/file", Typeflag: tar.TypeReg, Mode: 04644, Size: 4},
+		{Name: "dir/link", Typeflag: tar.TypeSymlink, Linkname: "file", Mode: 0777},
+	}
+	for _, hdr := range entries {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Size > 0 {
+			if _, err := tw.Write([]byte("data")); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tr := tar.NewReader(chmodTar(&buf, 0640))
+	expected := map[string]int64{"dir/": 0640, "dir/file": 0640, "dir/link": 0777}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Mode != expected[hdr.Name] {
+			t.Errorf("mode of %s = %o, want %o", hdr.Name, hdr.Mode, expected[hdr.Name])
+		}
+		if hdr.Name == "dir/file" {
+			data, err := io.ReadAll(tr)
+			if err != nil || string(data) != "data" {
+				t.Errorf("content of %s = %q, %v", hdr.Name, data, err)
+			}
+		}
+	}
+}
+
+func TestResolveDest(t *testing.T) {
+	rootfs := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(rootfs, "opt/app"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/opt/app", filepath.Join(rootfs, "app")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/etc", filepath.Join(rootfs, "opt/escape")); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := resolveDest(rootfs, "/", "/app")
+	if err != nil || got != filepath.Join(rootfs, "opt/app") {
+		t.Errorf("resolveDest() = %q, %v, want the symlink followed inside the rootfs", got, err)
+	}
+	got, err = resolveDest(rootfs, "/opt", "escape/passwd")
+	if err != nil || got != filepath.Join(rootfs, "etc/passwd") {
+		t.Errorf("resolveDest() = %q, %v, want a path inside the rootfs", got, err)
+	}
+}
+
+func TestAddLink(t *testing.T) {
+	store := newTestStore(t)
+	var logged bytes.Buffer
+	logger := logrus.New()
+	logger.SetOutput(&logged)
+	b, err := NewBuilder(store, BuilderOptions{Container: "link-test", log: logrus.NewEntry(logger)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Remove()
+	contextDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(contextDir, "hello.txt"), []byte("hello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ops := options.AddOption{Link: true, ContextDir: contextDir}
+	if err := b.Add("/hello.txt", []string{filepath.Join(contextDir, "hello.txt")}, ops); err != nil {
+		t.Fatal(err)
+	}
+	// --link copies like a plain COPY and only warns that the layer is not independent
+	content, err := os.ReadFile(filepath.Join(b.MountPoint, "hello.txt"))
+	if err != nil || string(content) != "hello\n" {
+		t.Errorf("copied content = %q, %v", content, err)
+	}
+	if !strings.Contains(logged.String(), "--link is not supported") {
+		t.Errorf("no --link warning was logged: %q", logged.String())
+	}
+}
@@ -0,0 +1,187 @@
+/*
+   Copyright (c) 2023 KylinSoft Co., Ltd.
+   Kylin trusted image builder(ktib) is licensed under Mulan PSL v2.
+   You can use this software according to the terms and conditions of the Mulan PSL v2.
+   You may obtain a copy of Mulan PSL v2 at:
+            http://license.coscl.org.cn/MulanPSL2
+   THIS SOFTWARE IS PROVIDED ON AN "AS IS" BASIS, WITHOUT WARRANTIES OF ANY KIND, EITHER EXPRESS OR IMPLIED, INCLUDING
+   BUT NOT LIMITED TO NON-INFRINGEMENT, MERCHANTABILITY OR FIT FOR A PARTICULAR PURPOSE.
+   See the Mulan PSL v2 for more details.
+*/
+
+package builder
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// builtinArgs can be passed with --build-arg without a matching ARG instruction, like docker does
+// for the proxy settings and SOURCE_DATE_EPOCH. They are visible to RUN but never committed.
+var builtinArgs = map[string]bool{
+	SourceDateEpoch: true,
+	"HTTP_PROXY":    true,
+	"http_proxy":    true,
+	"HTTPS_PROXY":   true,
+	"https_proxy":   true,
+	"FTP_PROXY":     true,
+	"ftp_proxy":     true,
+	"NO_PROXY":      true,
+	"no_proxy":      true,
+	"ALL_PROXY":     true,
+	"all_proxy":     true,
+}
+
+// expandArgs substitutes $NAME, ${NAME}, ${NAME:-word} and ${NAME:+word} with values from env.
+// Nothing is expanded inside single quotes. The escape character of the Dockerfile followed by "$"
+// keeps a literal dollar sign and is dropped, before any other character both are kept, so that an
+// escaped escape character does not escape the "$" after it. Quotes and the other escapes are left
+// in place so that the instruction can still be split into words afterwards.
+func expandArgs(s string, env map[string]string, escape rune) (string, error) {
+	return expand(s, env, escape, true)
+}
+
+// expandHeredoc substitutes the values of env in the content of a heredoc. Quotes have no meaning
+// in a heredoc, so unlike in expandArgs they do not stop the substitution.
+func expandHeredoc(content string, env map[string]string, escape rune) (string, error) {
+	return expand(content, env, escape, false)
+}
+
+func expand(s string, env map[string]string, escape rune, quotes bool) (string, error) {
+	var (
+		out     strings.Builder
+		inQuote bool
+	)
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '\'' && quotes:
+			inQuote = !inQuote
+			out.WriteByte(c)
+		case inQuote:
+			out.WriteByte(c)
+		case rune(c) == escape && i+1 < len(s) && s[i+1] == '$':
+			out.WriteByte('$')
+			i++
+		case rune(c) == escape && i+1 < len(s):
+			out.WriteByte(c)
+			out.WriteByte(s[i+1])
+			i++
+		case c == '$' && i+1 < len(s) && s[i+1] == '{':
+			end := strings.IndexByte(s[i:], '}')
+			if end < 0 {
+				return "", fmt.Errorf("missing '}' in %q", s)
+			}
+			value, err := expandBraces(s[i+2:i+end], env)
+			if err != nil {
+				return "", err
+			}
+			out.WriteString(value)
+			i += end
+		case c == '$' && i+1 < len(s) && isNameChar(s[i+1], true):
+			j := i + 1
+			for j < len(s) && isNameChar(s[j], false) {
+				j++
+			}
+			out.WriteString(env[s[i+1:j]])
+			i = j - 1
+		default:
+			out.WriteByte(c)
+		}
+	}
+	return out.String(), nil
+}
+
+// expandBraces handles the body of a ${...} expression.
+func expandBraces(expr string, env map[string]string) (string, error) {
+	name, word, op := expr, "", ""
+	if i := strings.Index(expr, ":"); i >= 0 {
+		name, op = expr[:i], expr[i:]
+		if len(op) < 2 || (op[1] != '-' && op[1] != '+') {
+			return "", fmt.Errorf("unsupported modifier in ${%s}", expr)
+		}
+		word, op = op[2:], op[:2]
+	}
+	if name == "" {
+		return "", fmt.Errorf("bad substitution ${%s}", expr)
+	}
+	for i := 0; i < len(name); i++ {
+		if !isNameChar(name[i], i == 0) {
+			return "", fmt.Errorf("bad substitution ${%s}", expr)
+		}
+	}
+	value := env[name]
+	switch op {
+	case ":-":
+		if value == "" {
+			return word, nil
+		}
+	case ":+":
+		if value != "" {
+			return word, nil
+		}
+		return "", nil
+	}
+	return value, nil
+}
+
+func isNameChar(c byte, first bool) bool {
+	if c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') {
+		return true
+	}
+	return !first && c >= '0' && c <= '9'
+}
+
+// declareArg handles one NAME[=default] of an ARG instruction. Before the first FROM it
+// declares a global argument that is only visible to FROM lines, otherwise a stage argument.
+// A --build-arg value wins over the default, and a stage argument without a default picks up
+// the value of the global argument with the same name.
+func (b *Executor) declareArg(name, defaultValue string, hasDefault bool) {
+	value, ok := b.buildArgs[name]
+	if ok {
+		b.usedArgs[name] = true
+	} else if hasDefault {
+		value, ok = defaultValue, true
+	} else if b.builders != nil {
+		value, ok = b.globalArgs[name]
+	}
+	scope := b.args
+	if b.builders == nil {
+		scope = b.globalArgs
+	}
+	if ok {
+		scope[name] = value
+	}
+}
+
+// expansionEnv returns the values substituted into the instructions of the current stage, ENV
+// values take precedence over ARG values of the same name.
+func (b *Executor) expansionEnv() map[string]string {
+	if b.builders == nil {
+		return b.globalArgs
+	}
+	env := make(map[string]string, len(b.args)+len(b.builders.Env))
+	for k, v := range b.args {
+		env[k] = v
+	}
+	for _, e := range b.builders.Env {
+		kv := strings.SplitN(e, "=", 2)
+		if len(kv) == 2 {
+			env[kv[0]] = kv[1]
+		}
+	}
+	return env
+}
+
+// unusedBuildArgs lists the --build-arg values that no ARG instruction declared.
+func (b *Executor) unusedBuildArgs() []string {
+	var unused []string
+	for name := range b.buildArgs {
+		if !b.usedArgs[name] && !builtinArgs[name] {
+			unused = append(unused, name)
+		}
+	}
+	sort.Strings(unused)
+	return unused
+}
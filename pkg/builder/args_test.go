@@ -0,0 +1,122 @@
+package builder
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExpandArgs(t *testing.T) {
+	env := map[string]string{"VERSION": "1.20", "NAME": "app", "EMPTY": ""}
+	tests := []struct {
+		input    string
+		escape   rune
+		expected string
+		wantErr  bool
+	}{
+		{input: "golang:$VERSION", expected: "golang:1.20"},
+		{input: "golang:${VERSION}-alpine", expected: "golang:1.20-alpine"},
+		{input: "${MISSING:-default}", expected: "default"},
+		{input: "${EMPTY:-default}", expected: "default"},
+		{input: "${NAME:+set}", expected: "set"},
+		{input: "${MISSING:+set}", expected: ""},
+		{input: `A="$NAME v$VERSION"`, expected: `A="app v1.20"`},
+		{input: `'$NAME'`, expected: `'$NAME'`},
+		{input: `\$NAME`, expected: `$NAME`},
+		{input: `\${NAME}`, expected: `${NAME}`},
+		{input: `\\$NAME`, expected: `\\app`},
+		{input: `\'$NAME\'`, expected: `\'app\'`},
+		{input: `"\$NAME $NAME"`, expected: `"$NAME app"`},
+		{input: "`${NAME}", escape: '`', expected: "${NAME}"},
+		{input: "``$NAME", escape: '`', expected: "``app"},
+		{input: "${NAME:-x}", expected: "app"},
+		{input: "$MISSING", expected: ""},
+		{input: "${MISSING}-x", expected: "-x"},
+		{input: "${MISSING:-x}", expected: "x"},
+		{input: "${EMPTY:+set}", expected: ""},
+		{input: "100$ $1x", expected: "100$ $1x"},
+		{input: "`$NAME", escape: '`', expected: "$NAME"},
+		{input: `C:\$NAME`, escape: '`', expected: `C:\app`},
+		{input: "${NAME", wantErr: true},
+		{input: "${1A}", wantErr: true},
+		{input: "${NAME:?x}", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			escape := tt.escape
+			if escape == 0 {
+				escape = '\\'
+			}
+			got, err := expandArgs(tt.input, env, escape)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expandArgs() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.expected {
+				t.Errorf("expandArgs() = %q, want %q", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestExpandHeredoc(t *testing.T) {
+	env := map[string]string{"NAME": "app"}
+	got, err := expandHeredoc("name='$NAME'\nprice=\\$5\n", env, '\\')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "name='app'\nprice=$5\n"; got != want {
+		t.Errorf("expandHeredoc() = %q, want %q", got, want)
+	}
+	// a Dockerfile with another escape character escapes the dollar sign with it
+	got, err = expandHeredoc("price=`$5\npath=C:\\$NAME\n", env, '`')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "price=$5\npath=C:\\app\n"; got != want {
+		t.Errorf("expandHeredoc() with escape ` = %q, want %q", got, want)
+	}
+}
+
+func TestDeclareArgScope(t *testing.T) {
+	e := &Executor{
+		args:       make(map[string]string),
+		globalArgs: make(map[string]string),
+		buildArgs:  map[string]string{"VERSION": "1.21", "UNUSED": "x", "http_proxy": "http://proxy"},
+		usedArgs:   make(map[string]bool),
+		stages:     make(map[string]*Builder),
+	}
+	// before FROM the arguments are global
+	e.declareArg("VERSION", "1.20", true)
+	e.declareArg("BASE", "centos", true)
+	if !reflect.DeepEqual(e.globalArgs, map[string]string{"VERSION": "1.21", "BASE": "centos"}) {
+		t.Fatalf("unexpected global args: %v", e.globalArgs)
+	}
+	if err := e.startStage("", &Builder{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(e.expansionEnv()) != 0 {
+		t.Errorf("global args must not be visible in a stage without ARG: %v", e.expansionEnv())
+	}
+	// a redeclared global argument picks up its value, ENV overrides ARG
+	e.declareArg("BASE", "", false)
+	e.declareArg("UNDEFINED", "", false)
+	e.builders.AddEnv("BASE", "kylin")
+	if !reflect.DeepEqual(e.args, map[string]string{"BASE": "centos"}) {
+		t.Errorf("unexpected stage args: %v", e.args)
+	}
+	if e.expansionEnv()["BASE"] != "kylin" {
+		t.Errorf("ENV should take precedence over ARG: %v", e.expansionEnv())
+	}
+	if !reflect.DeepEqual(e.runEnv(), []string{"BASE=centos", "http_proxy=http://proxy", "BASE=kylin"}) {
+		t.Errorf("unexpected RUN environment: %v", e.runEnv())
+	}
+	if !reflect.DeepEqual(e.unusedBuildArgs(), []string{"UNUSED"}) {
+		t.Errorf("unexpected unused build args: %v", e.unusedBuildArgs())
+	}
+	// a new stage starts without the arguments of the previous one
+	if err := e.startStage("", &Builder{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(e.args) != 0 {
+		t.Errorf("stage args leaked into the next stage: %v", e.args)
+	}
+}
@@ -14,7 +14,6 @@ package builder
 import (
 	"bufio"
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -22,25 +21,31 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
-	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"gitee.com/openeuler/ktib/pkg/options"
-	cpier "github.com/containers/image/v5/copy"
 	v5manifest "github.com/containers/image/v5/manifest"
 	//"github.com/containers/image/v5/docker/reference"
-	"github.com/containers/image/v5/signature"
-	"github.com/containers/image/v5/transports/alltransports"
-	"github.com/containers/image/v5/types"
+	is "github.com/containers/image/v5/storage"
 	"github.com/containers/storage"
 	"github.com/containers/storage/pkg/archive"
-	"github.com/containers/storage/pkg/ioutils"
-	"github.com/opencontainers/go-digest"
+	"github.com/containers/storage/pkg/idtools"
+	securejoin "github.com/cyphar/filepath-securejoin"
+	"github.com/moby/buildkit/frontend/dockerfile/parser"
 	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/opencontainers/runtime-tools/generate"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/term"
 )
 
+// runtimeKillTimeout is the time a runtime has to exit after its container was killed.
+const runtimeKillTimeout = 10 * time.Second
+
 const (
 	stateFile            = "ktib.json"
 	specFile             = "config.json"
@@ -59,29 +64,112 @@ type Builder struct {
 	ContainerID string
 	MountPoint  string
 	Maintainer  string
-	EntryPoint  string
-	Cmd         string
+	EntryPoint  []string
+	Cmd         []string
 	Env         []string
 	Message     string
-	Manifest    v1.Manifest
 	OCIv1       v1.Image
 	DockerV2    v5manifest.Schema2Image
 	Workdir     string
-	out         io.Writer
+	User        string
+	Shell       []string
+	Labels      map[string]string
+	// ExposedPorts and Volumes are sets, the same shape used by the OCI image config
+	ExposedPorts map[string]struct{}
+	Volumes      map[string]struct{}
+	StopSignal   string
+	Healthcheck  *v5manifest.Schema2HealthConfig
+	// Annotations are written to the manifest of OCI images, docker manifests have none
+	Annotations map[string]string
+	// UIDMap and GIDMap are the ID mappings of the container, empty when the host ids are used
+	UIDMap []idtools.IDMap
+	GIDMap []idtools.IDMap
+	// Format is the manifest format of committed images, FormatOCI or FormatDocker
+	Format string
+	// Timestamp makes commits reproducible, it replaces the current time in the image config
+	// and history and is the latest modification time written to layers
+	Timestamp *time.Time
+	// Squash merges layers on commit, SquashAll or SquashNew, empty for one layer per commit
+	Squash string
+	// Compression is the layer compression of images committed to a transport other than the store
+	Compression options.CompressionOption
+	// Generation counts the saves of the state, a save from an older generation is stale
+	Generation uint64
+	// Checkpoint is the progress of the build the builder belongs to, nil outside of builds
+	Checkpoint *BuildCheckpoint `json:",omitempty"`
+	// createdBy describes the step committed next in the image history
+	createdBy string
+	out       io.Writer
+	// log is the entry the builder logs with, the one of the build it belongs to
+	log *logrus.Entry
+	// state is the encoded state as it was last read or saved, it tells unsaved changes apart
+	state []byte
 }
 
 type BuilderOptions struct {
 	FromImage  string
 	Container  string
 	PullPolicy bool
+	// IDMappingOptions selects the user namespace mappings of the container, nil keeps the
+	// defaults of the store
+	IDMappingOptions *storage.IDMappingOptions
+	// log is the entry the builder logs with, nil for the standard logger
+	log *logrus.Entry
 }
 
 type Executor struct {
 	store      storage.Store
 	contextDir string
-	builders   *Builder
-	out        io.Writer
-	err        io.Writer
+	// excludes are the patterns of the .containerignore or .dockerignore file of the context
+	excludes []string
+	filter   *contextFilter
+	builders *Builder
+	// args holds the ARG values declared in the current stage, they are visible to RUN but not
+	// committed. globalArgs are declared before the first FROM and only visible to FROM lines.
+	args       map[string]string
+	globalArgs map[string]string
+	buildArgs  map[string]string
+	usedArgs   map[string]bool
+	// secrets maps the ids given with --secret to their source files
+	secrets map[string]string
+	// network is the network mode of RUN steps that do not set their own with --network
+	network string
+	// security holds the resource limits and privileges every RUN step is started with
+	security options.SecurityOption
+	// format is the manifest format of the committed images
+	format string
+	// timestamp is the fixed time of a reproducible build, nil for the current time
+	timestamp *time.Time
+	// stages holds the builder of every FROM by stage name and by index, stageList keeps them in order
+	stages    map[string]*Builder
+	stageList []*Builder
+	stageName string
+	// cmdSet records whether the current stage has its own CMD, which ENTRYPOINT then keeps
+	cmdSet  bool
+	target  string
+	noCache bool
+	// stepTimeout limits the time of every step, no limit when zero
+	stepTimeout time.Duration
+	// instructions are the digests of the steps done, saved with every checkpoint
+	instructions []string
+	// images mounted for COPY --from and images committed for FROM <stage>, removed with the stages
+	// like the images of the steps of a build without the cache
+	mountedImages []string
+	stageImages   []string
+	stepImages    []string
+	in            io.Reader
+	out           io.Writer
+	err           io.Writer
+	// progress reports the steps, step is the name of the one being executed, log is the entry
+	// whose warnings are reported as events of the build
+	progress *progress
+	log      *logrus.Entry
+	step     string
+	// escape is the escape character of the Dockerfile, heredocs are the ones of the current step
+	escape   rune
+	heredocs []parser.Heredoc
+	// shared is the state of the parallel run the build belongs to, nil for a build of its own
+	shared *parallelRun
 }
 
 func newBuidler(store storage.Store, options BuilderOptions) (*Builder, error) {
@@ -94,6 +182,9 @@ func newBuidler(store storage.Store, options BuilderOptions) (*Builder, error) {
 	image := options.FromImage
 	name := options.Container
 	coptions := storage.ContainerOptions{}
+	if options.IDMappingOptions != nil {
+		coptions.IDMappingOptions = *options.IDMappingOptions
+	}
 	if name != "" {
 		optionNames = []string{name}
 	}
@@ -120,6 +211,14 @@ func newBuidler(store storage.Store, options BuilderOptions) (*Builder, error) {
 		FromImageID: imageID,
 		Container:   name,
 		ContainerID: container.ID,
+		UIDMap:      container.UIDMap,
+		GIDMap:      container.GIDMap,
+		log:         options.log,
+	}
+	if imageID != "" {
+		if err := builder.loadBaseConfig(); err != nil {
+			builder.logger().Warnf("unable to read the configuration of %s: %s", image, err)
+		}
 	}
 	if err := builder.Save(); err != nil {
 		return nil, err
@@ -127,6 +226,14 @@ func newBuidler(store storage.Store, options BuilderOptions) (*Builder, error) {
 	return builder, nil
 }
 
+// logger returns the entry the builder logs with.
+func (b *Builder) logger() *logrus.Entry {
+	if b.log == nil {
+		return logrus.NewEntry(logrus.StandardLogger())
+	}
+	return b.log
+}
+
 func NewBuilder(store storage.Store, options BuilderOptions) (*Builder, error) {
 	// TODO 构造builder对象
 	return newBuidler(store, options)
@@ -137,50 +244,21 @@ func FindBuilder(store storage.Store, name string) (*Builder, error) {
 	if err != nil {
 		return nil, err
 	}
-	cdir, err := store.ContainerDirectory(container.ID)
-	if err != nil {
-		return nil, err
-	}
-	statefile := filepath.Join(cdir, stateFile)
-
-	buildstate, err := ioutil.ReadFile(statefile)
-	if err != nil && os.IsNotExist(err) {
-		return nil, err
-	}
-	b := &Builder{
-		Store: store,
-	}
-	err = json.Unmarshal(buildstate, &b)
-	if err != nil {
-		return nil, err
-	}
-	return b, nil
+	return readBuilder(store, container.ID)
 }
 
+// FindAllBuilders returns the builders of the store, containers that were not created by ktib
+// are skipped.
 func FindAllBuilders(store storage.Store) ([]*Builder, error) {
-	var bl []*Builder
-	containers, err := store.Containers()
+	containers, err := listContainers(store)
 	if err != nil {
 		return nil, err
 	}
-	for _, container := range containers {
-		cdir, err := store.ContainerDirectory(container.ID)
-		if err != nil {
-			return nil, err
-		}
-		buildstate, err := ioutil.ReadFile(filepath.Join(cdir, stateFile))
-		if err != nil && os.IsNotExist(err) {
-			return nil, err
-		}
-		b := &Builder{
-			Store: store,
-		}
-		err = json.Unmarshal(buildstate, &b)
-		if err != nil {
-			return nil, err
+	var bl []*Builder
+	for _, c := range containers {
+		if c.Builder != nil {
+			bl = append(bl, c.Builder)
 		}
-		b.Store = store
-		bl = append(bl, b)
 	}
 	return bl, nil
 }
@@ -198,23 +276,20 @@ func (b *Builder) Mount(label string) error {
 	if err != nil {
 		return err
 	}
-	b.MountPoint = mountpoint
-
-	err = b.Save()
-	if err != nil {
-		return err
-	}
-	return nil
-
+	return b.Update(func() error {
+		b.MountPoint = mountpoint
+		return nil
+	})
 }
 
 func (b *Builder) UMount() error {
-	_, err := b.Store.Unmount(b.ContainerID, false)
-	if err == nil {
-		b.MountPoint = ""
-		err = b.Save()
+	if _, err := b.Store.Unmount(b.ContainerID, false); err != nil {
+		return err
 	}
-	return err
+	return b.Update(func() error {
+		b.MountPoint = ""
+		return nil
+	})
 }
 
 func (b *Builder) Tag(args []string) error {
@@ -225,11 +300,11 @@ func (b *Builder) SetMaintainer(args string) {
 	b.Maintainer = args
 }
 
-func (b *Builder) SetEntryPoint(args string) {
+func (b *Builder) SetEntryPoint(args []string) {
 	b.EntryPoint = args
 }
 
-func (b *Builder) SetCmd(args string) {
+func (b *Builder) SetCmd(args []string) {
 	b.Cmd = args
 }
 
@@ -241,6 +316,72 @@ func (b *Builder) SetMessage(args string) {
 	b.Message = args
 }
 
+func (b *Builder) SetUser(args string) {
+	b.User = args
+}
+
+func (b *Builder) SetShell(args []string) {
+	b.Shell = args
+}
+
+func (b *Builder) SetStopSignal(args string) {
+	b.StopSignal = args
+}
+
+func (b *Builder) SetHealthcheck(health *v5manifest.Schema2HealthConfig) {
+	b.Healthcheck = health
+}
+
+// AddEnv sets the environment variable key, replacing an earlier value of the same key.
+func (b *Builder) AddEnv(key, value string) {
+	for i, env := range b.Env {
+		if strings.SplitN(env, "=", 2)[0] == key {
+			b.Env[i] = key + "=" + value
+			return
+		}
+	}
+	b.Env = append(b.Env, key+"="+value)
+}
+
+// RemoveEnv unsets the environment variable key.
+func (b *Builder) RemoveEnv(key string) {
+	env := b.Env[:0]
+	for _, e := range b.Env {
+		if strings.SplitN(e, "=", 2)[0] != key {
+			env = append(env, e)
+		}
+	}
+	b.Env = env
+}
+
+func (b *Builder) AddLabel(key, value string) {
+	if b.Labels == nil {
+		b.Labels = make(map[string]string)
+	}
+	b.Labels[key] = value
+}
+
+func (b *Builder) AddPort(port string) {
+	if b.ExposedPorts == nil {
+		b.ExposedPorts = make(map[string]struct{})
+	}
+	b.ExposedPorts[port] = struct{}{}
+}
+
+func (b *Builder) AddVolume(volume string) {
+	if b.Volumes == nil {
+		b.Volumes = make(map[string]struct{})
+	}
+	b.Volumes[volume] = struct{}{}
+}
+
+func (b *Builder) AddAnnotation(key, value string) {
+	if b.Annotations == nil {
+		b.Annotations = make(map[string]string)
+	}
+	b.Annotations[key] = value
+}
+
 func (b *Builder) Remove() error {
 	// If the submitted image name exists, the container will be removed early
 	if !b.Store.Exists(b.ContainerID) {
@@ -258,60 +399,73 @@ func (b Builder) name() string {
 	return b.Name
 }
 
-func (b *Builder) Save() error {
-	buildstate, err := json.Marshal(b)
+// Commit writes the builder to the image exportTo and returns the ID of the image. A name without
+// a transport is an image of the local store, see exportReference.
+func (b *Builder) Commit(exportTo string) (string, error) {
+	exportRef, err := exportReference(b.Store, exportTo)
 	if err != nil {
-		return err
+		return "", err
 	}
-	cdir, err := b.Store.ContainerDirectory(b.ContainerID)
-	if err != nil {
-		return err
+	if exportRef.Transport().Name() != is.Transport.Name() {
+		return b.exportImage(exportRef)
+	}
+	if b.Compression.CompressionFormat != "" || b.Compression.CompressionLevel != nil {
+		b.logger().Warnf("layers in the local store are not compressed, ignoring the compression settings")
 	}
-	return ioutils.AtomicWriteFile(filepath.Join(cdir, stateFile), buildstate, 0600)
-}
 
-func (b *Builder) Commit(exportTo string) error {
-	ctx := context.Background()
-	systemContext := types.SystemContext{}
-	policy, err := signature.DefaultPolicy(&systemContext)
+	referceName := defaultNullImageName
+	if exportTo != defaultNullImageName {
+		if exportRef.DockerReference() == nil {
+			return "", fmt.Errorf("%q is not a valid image name", exportTo)
+		}
+		referceName = exportRef.DockerReference().String()
+	}
+
+	nwImage, err := b.commitImage("", nil)
 	if err != nil {
-		return err
+		return "", err
 	}
-	policyContext, err := signature.NewPolicyContext(policy)
-	var imageLayer string
-	var containerLayer string
-	importFrom := b.FromImage
-	if !b.Store.Exists(importFrom) && b.FromImageID != "" {
-		iMage, err := b.Store.Image(b.FromImageID)
-		if err != nil {
-			return err
+	logrus.Infof("export name is %s", referceName)
+	oldImage, err := b.verifyCommitTag(referceName)
+	if err != nil {
+		return "", err
+	}
+	if err := b.Store.AddNames(nwImage.ID, []string{referceName}); err != nil {
+		return "", fmt.Errorf("fail to name image %s: %w", nwImage.ID, err)
+	}
+	if oldImage != "" && oldImage != nwImage.ID {
+		if err := b.removeReplacedImage(oldImage); err != nil {
+			return "", err
 		}
-		importFrom = iMage.Names[0]
-	} else {
-		importFrom = "scratch"
 	}
-	// set transport to containers-storage:
-	transportName := defaultTransport + exportTo
-	exportRef, err := alltransports.ParseImageName(transportName)
+	logrus.Infof("create new image %s successful", nwImage.ID)
+	return nwImage.ID, nil
+}
+
+// commitImage writes the changes and the configuration of the builder to a new image in the
+// store. The image gets the given ID and names, both may be empty for an intermediate image.
+func (b *Builder) commitImage(id string, names []string) (*storage.Image, error) {
+	var imageLayer string
+	var containerLayer string
+	ctr, err := b.Store.Container(b.ContainerID)
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	ops := &cpier.Options{}
-
+	containerLayer = ctr.LayerID
 	// First need to determine whether there are changes in the builder's layers, if there are changes you need to
-	// merge the layers, no changes only need to copy the image.
-	if b.FromImageID != "" {
-		iM, _ := b.Store.Image(b.FromImageID)
+	// create a new layer, no changes only need to reuse the top layer of the image the container was created from.
+	if ctr.ImageID != "" {
+		iM, err := b.Store.Image(ctr.ImageID)
+		if err != nil {
+			return nil, err
+		}
 		imageLayer = iM.TopLayer
 	} else {
 		imageLayer = ""
 	}
-	ctr, _ := b.Store.Container(b.ContainerID)
-	containerLayer = ctr.LayerID
 	changes, err := b.Store.Changes(imageLayer, containerLayer)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	for _, change := range changes {
 		switch change.Kind {
@@ -324,217 +478,255 @@ func (b *Builder) Commit(exportTo string) error {
 		}
 	}
 
-	if len(changes) > 0 || importFrom == "scratch" {
-		var layerOps storage.LayerOptions
-		var diffOps storage.DiffOptions
-		diffrdcloser, err := b.Store.Diff(imageLayer, containerLayer, &diffOps)
-		if err != nil {
-			return fmt.Errorf("failed to get layer diff: %w", err)
-		}
-
-		tar, err := os.CreateTemp("", "layer-diff-tar-")
-		wt := bufio.NewWriter(tar)
-		if err != nil {
-			return err
-		}
-		defer os.Remove(tar.Name())
-		defer tar.Close()
-
-		_, err = io.Copy(wt, diffrdcloser)
-		if err != nil {
-			return fmt.Errorf("storing blob to file %v: %w", tar, err)
-		}
-		if err := wt.Flush(); err != nil {
-			return fmt.Errorf("Can not flush bufio: %w", err)
-		}
-		diffrdcloser.Close()
-
-		f, err := os.Open(tar.Name())
-		if err != nil {
-			return fmt.Errorf("Can not open the file of: %q: %w", tar.Name(), err)
-		}
-		defer f.Close()
-
-		destLayer, num, _ := b.Store.PutLayer("", imageLayer, []string{}, "", true, &layerOps, f)
-		if num != -1 {
-			logrus.Infof("apply diff %s successfully", containerLayer)
-		}
-
-		referceName := defaultNullImageName
-		removeOldImage := false
-		if exportTo != defaultNullImageName {
-			referceName = exportRef.DockerReference().String()
-		}
-		logrus.Infof("export name is %s", referceName)
-		if err, isRemove := b.verifyCommitTag(referceName); err != nil {
-			return err
-		} else {
-			removeOldImage = isRemove
-		}
-
-		nname := []string{referceName}
-		imageOptions := &storage.ImageOptions{
-			Digest: digest.Digest(""),
-		}
-		nwImage, err := b.Store.CreateImage("", nname, destLayer.ID, "", imageOptions)
-		if err != nil {
-			logrus.Errorf("fail to create new image at store: %w", err)
-			return err
+	topLayer := imageLayer
+	switch b.Squash {
+	case SquashAll, SquashNew:
+		if topLayer, err = b.squashLayer(containerLayer); err != nil {
+			return nil, err
 		}
-
-		// generate manifest info and setBigData to new images
-		items, err := b.generateManifests(nwImage.ID)
-
-		// the manifest and instance.json information from builderBigData, write it to the new image
-		for _, item := range items {
-			var data []byte
-			data, err = b.builderBigData(b.ContainerID, item)
+	default:
+		if len(changes) > 0 || imageLayer == "" {
+			var diffOps storage.DiffOptions
+			diff, err := b.Store.Diff(imageLayer, containerLayer, &diffOps)
 			if err != nil {
-				return fmt.Errorf("error copying data item %q: %w", item, err)
+				return nil, fmt.Errorf("failed to get layer diff: %w", err)
 			}
-			logrus.Infof("the id is %s , and the data is %s", item, data)
-			err := b.Store.SetImageBigData(nwImage.ID, item, data, v5manifest.Digest)
+			topLayer, err = b.putLayer(imageLayer, diff)
 			if err != nil {
-				return fmt.Errorf("error copying data item %q", item, err)
-			}
-			logrus.Debugf("copied data item %q to %q", item, nwImage.ID)
-		}
-
-		if removeOldImage {
-			if err := b.Store.DeleteContainer(b.ContainerID); err != nil {
-				logrus.Errorf("fail to remove builder %s of %w", b.ContainerID, err)
-				return err
-			}
-			if _, err := b.Store.DeleteImage(b.FromImageID, true); err != nil {
-				logrus.Errorf("fail to remove rename image of %s", b.FromImageID)
-				return err
+				return nil, fmt.Errorf("failed to apply diff of %s: %w", containerLayer, err)
 			}
 		}
-		logrus.Infof("create new image %s successful", nwImage.ID)
-		return nil
 	}
 
-	// set transport to oci
-	importFrom = defaultTransport + importFrom
-	importRef, err := alltransports.ParseImageName(importFrom)
+	// a step that only changed the configuration is still recorded, as an empty layer
+	created := b.now()
+	emptyLayer := topLayer == imageLayer
+	if b.Squash != "" {
+		b.squashHistory()
+	}
+	if !emptyLayer || b.createdBy != "" {
+		b.appendHistory(created, b.createdBy, emptyLayer)
+	}
+	b.createdBy = ""
+	layers, err := layerChain(b.Store, topLayer)
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	_, err = cpier.Image(ctx, policyContext, exportRef, importRef, ops)
+	manifest, err := b.buildManifest(created, layers)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
-}
-
-// generate the manifest message and write it to BigData of builder
-func (b *Builder) generateManifests(id string) ([]string, error) {
-	// keys include sha256:imageID、 manifest-sha256:imageDigestID、manifest.
-	// digest of manifest-sha256:imageDigestID and manifest is sha256:imageDigestID, and content is consistent with the image-spec
-	// digest of sha256:imageID is self, and content is Schema2Image
-	bigDatas := []storage.ContainerBigDataOption{}
-	bigDataName := []string{}
-	// about opencontainer image-spec manifest from builder
-	imageSpecManifestData, err := json.Marshal(b.Manifest)
+	manifestDigest, err := v5manifest.Digest(manifest.manifest)
 	if err != nil {
-		logrus.Errorf("")
 		return nil, err
 	}
-	// about docker image spec from builder
-	schema2ImageData, err := json.Marshal(b.DockerV2)
+	imageOptions := &storage.ImageOptions{
+		CreationDate: created,
+		Digest:       manifestDigest,
+	}
+	nwImage, err := b.Store.CreateImage(id, names, topLayer, "", imageOptions)
 	if err != nil {
-		logrus.Errorf("")
+		logrus.Errorf("fail to create new image at store: %s", err)
 		return nil, err
 	}
-	manifestDigest := digest.FromBytes(schema2ImageData)
-	// generate bigDataOption
-	bigDatas = append(bigDatas, storage.ContainerBigDataOption{
-		Key:  storage.ImageDigestManifestBigDataNamePrefix,
-		Data: imageSpecManifestData,
-	})
-	bigDatas = append(bigDatas, storage.ContainerBigDataOption{
-		Key:  storage.ImageDigestManifestBigDataNamePrefix + "-" + manifestDigest.String(),
-		Data: imageSpecManifestData,
-	})
-	bigDatas = append(bigDatas, storage.ContainerBigDataOption{
-		Key:  digest.NewDigestFromHex(digest.Canonical.String(), id).String(),
-		Data: schema2ImageData,
-	})
-	for _, data := range bigDatas {
-		b.setBuilderBigData(b.ID, data.Key, data.Data)
-		bigDataName = append(bigDataName, data.Key)
+	if err := writeManifest(b.Store, nwImage.ID, manifest); err != nil {
+		return nil, err
 	}
+	return nwImage, nil
+}
 
-	return bigDataName, nil
+// putLayer stores the layer tar diff on top of parent and returns the ID of the new layer. The
+// tar is spooled to a file first, which a reproducible commit needs to rewrite it. diff is
+// closed before the layer is written.
+func (b *Builder) putLayer(parent string, diff io.ReadCloser) (string, error) {
+	tar, err := os.CreateTemp("", "layer-diff-tar-")
+	if err != nil {
+		diff.Close()
+		return "", err
+	}
+	defer os.Remove(tar.Name())
+	defer tar.Close()
+	wt := bufio.NewWriter(tar)
+	_, err = io.Copy(wt, diff)
+	// a diff of the store keeps the layers locked until it is closed
+	diff.Close()
+	if err != nil {
+		return "", fmt.Errorf("storing blob to file %v: %w", tar.Name(), err)
+	}
+	if err := wt.Flush(); err != nil {
+		return "", fmt.Errorf("Can not flush bufio: %w", err)
+	}
+
+	var layer io.Reader = tar
+	if b.Timestamp != nil {
+		rc, err := reproducibleLayer(tar, *b.Timestamp)
+		if err != nil {
+			return "", err
+		}
+		defer rc.Close()
+		layer = rc
+	} else if _, err := tar.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	var layerOps storage.LayerOptions
+	destLayer, num, err := b.Store.PutLayer("", parent, []string{}, "", true, &layerOps, layer)
+	if err != nil {
+		return "", err
+	}
+	if num != -1 {
+		logrus.Infof("apply diff of layer %s successfully", destLayer.ID)
+	}
+	return destLayer.ID, nil
 }
 
-func (b Builder) setBuilderBigData(id, key string, data []byte) error {
-	err := b.Store.SetContainerBigData(id, key, data)
+// rebase replaces the container of the builder with one created from imageID, so that the next
+// step of a build starts from the layers committed so far.
+func (b *Builder) rebase(imageID string) error {
+	if b.MountPoint != "" {
+		if _, err := b.Store.Unmount(b.ContainerID, true); err != nil {
+			return err
+		}
+		b.MountPoint = ""
+	}
+	if err := b.Store.DeleteContainer(b.ContainerID); err != nil {
+		return err
+	}
+	var names []string
+	if b.Name != "" {
+		names = []string{b.Name}
+	}
+	container, err := b.Store.CreateContainer("", names, imageID, "", "", b.containerOptions())
 	if err != nil {
-		logrus.Errorf("Failed to set BigData to builder: %w", err)
 		return err
 	}
-	return nil
+	b.ID = container.ID
+	b.ContainerID = container.ID
+	return b.Save()
 }
 
-// builderBigData retrieves a (possibly large) chunk of named data
-// associated with an container.
-func (b *Builder) builderBigData(id, key string) ([]byte, error) {
-	data, err := b.Store.ContainerBigData(id, key)
+// verifyCommitTag removes name from the image that has it and returns the ID of that image, empty
+// when no image has the name.
+func (b *Builder) verifyCommitTag(name string) (string, error) {
+	if !b.Store.Exists(name) {
+		return "", nil
+	}
+	epImg, err := b.Store.Image(name)
 	if err != nil {
-		logrus.Errorf("Failed to get BigData from builder: %w", err)
-		return nil, err
+		return "", err
+	}
+	logrus.Infof("begin to delete reuse image tag: %s", epImg.ID)
+	if err := b.Store.RemoveNames(epImg.ID, []string{name}); err != nil {
+		logrus.Errorf("fail to remove reuse image tag: %s", err)
+		return "", err
 	}
-	return data, nil
+	return epImg.ID, nil
 }
 
-func (b *Builder) verifyCommitTag(name string) (error, bool) {
-	isRemove := false
-	if b.Store.Exists(name) {
-		epImg, err := b.Store.Image(name)
-		b.FromImageID = epImg.ID
-		if err != nil {
-			return err, isRemove
+// removeReplacedImage removes the image whose name was moved to the committed image. An image that
+// still has other names or is used by another container is only untagged. When the builder is its
+// last user, the builder is removed with it, it is done once it committed.
+func (b *Builder) removeReplacedImage(id string) error {
+	img, err := b.Store.Image(id)
+	if err != nil {
+		return err
+	}
+	if len(img.Names) > 0 {
+		logrus.Infof("keeping image %s, it is still named %v", id, img.Names)
+		return nil
+	}
+	containers, err := b.Store.Containers()
+	if err != nil {
+		return err
+	}
+	usedByBuilder := false
+	for _, c := range containers {
+		if c.ImageID != id {
+			continue
 		}
-		logrus.Infof("begin to delete reuse image tag: %s", epImg.ID)
-		if err := b.Store.RemoveNames(epImg.ID, []string{name}); err != nil {
-			logrus.Errorf("fail to remove reuse image tag: %w", err)
-			return err, isRemove
+		if c.ID != b.ContainerID {
+			logrus.Infof("keeping image %s, it is used by container %s", id, c.ID)
+			return nil
 		}
-		isRemove = true
+		usedByBuilder = true
 	}
-	return nil, isRemove
+	if usedByBuilder {
+		if err := b.Store.DeleteContainer(b.ContainerID); err != nil {
+			logrus.Errorf("fail to remove builder %s of %s", b.ContainerID, err)
+			return err
+		}
+	}
+	if _, err := b.Store.DeleteImage(id, true); err != nil {
+		logrus.Errorf("fail to remove rename image of %s", id)
+		return err
+	}
+	return nil
 }
 
 func (b *Builder) SetWorkdir(args string) {
 	b.Workdir = args
 }
 
-func (b *Builder) Add(dest string, source []string, extract bool) error {
+func (b *Builder) Add(dest string, source []string, ops options.AddOption) error {
+	filter, err := newContextFilter(ops.ContextDir, ops.Excludes)
+	if err != nil {
+		return err
+	}
+	if ops.Link {
+		// the files end up the same, only the layer cannot be reused on its own
+		b.logger().Warnf("--link is not supported, the content is copied into the layer of builder %s and the layer depends on the ones below it", b.ContainerID)
+	}
 	if err := b.Mount(""); err != nil {
 		return err
 	}
 	mountPoint := b.MountPoint
-	if filepath.IsAbs(dest) {
-		dest = filepath.Join(mountPoint, dest)
-	} else {
-		dest = filepath.Join(mountPoint, b.Workdir, dest)
+	// a trailing slash makes the destination a directory, even when it does not exist yet
+	destIsDir := strings.HasSuffix(dest, "/")
+	dest, err = resolveDest(mountPoint, b.Workdir, dest)
+	if err != nil {
+		return err
+	}
+	archiver, err := addArchiver(mountPoint, b.idMappings(), ops)
+	if err != nil {
+		return err
+	}
+	rootIDs := archiver.UntarIDMappings.RootPair()
+	if archiver.ChownOpts != nil {
+		if rootIDs, err = archiver.UntarIDMappings.ToHost(*archiver.ChownOpts); err != nil {
+			return err
+		}
+	}
+	if destIsDir {
+		if err := idtools.MkdirAllAndChownNew(dest, 0755, rootIDs); err != nil {
+			return fmt.Errorf("error ensuring directory %q exists", dest)
+		}
 	}
 	def, _ := os.Stat(dest)
 
-	archiver := archive.NewDefaultArchiver()
 	for _, src := range source {
 		srf, err := os.Stat(src)
 		if err != nil {
 			return err
 		}
+		excluded, err := filter.excluded(src)
+		if err != nil {
+			return err
+		}
+		if excluded && (!srf.IsDir() || filter.skipDir(src)) {
+			return fmt.Errorf("%q is excluded by the ignore file of the build context", src)
+		}
 		if srf.IsDir() {
 			d := dest
-			if err := os.MkdirAll(d, 0755); err != nil {
+			if err := idtools.MkdirAllAndChownNew(d, 0755, rootIDs); err != nil {
 				return fmt.Errorf("error ensuring directory %q exists", d)
 			}
 			logrus.Debugf("copying %q to %q", src+string(os.PathSeparator)+"*", d+string(os.PathSeparator)+"*")
+			if rel, ok := filter.relative(src); ok {
+				// the context is archived with the exclude patterns applied, so ignored files never reach dest
+				if err := copyContextDir(archiver, filter, rel, d); err != nil {
+					return fmt.Errorf("error copying %q to %q: %w", src, d, err)
+				}
+				continue
+			}
 			// CopyWithTar creates a tar archive of filesystem path `src`, and unpacks it at filesystem path `dst`
 			if err := archiver.CopyWithTar(src, d); err != nil {
 				return fmt.Errorf("error copying %q to %q", src, d)
@@ -542,7 +734,7 @@ func (b *Builder) Add(dest string, source []string, extract bool) error {
 			continue
 		}
 		// IsArchivePath checks if the (possibly compressed) file at the given path starts with a tar file header.
-		if !extract || !archive.IsArchivePath(src) {
+		if !ops.Extract || !archive.IsArchivePath(src) {
 			d := dest
 			if def != nil && def.IsDir() {
 				d = filepath.Join(dest, filepath.Base(src))
@@ -564,30 +756,115 @@ func (b *Builder) Add(dest string, source []string, extract bool) error {
 	return nil
 }
 
-func (b *Builder) Run(args []string, ops options.RUNOption) error {
+// ExitError is returned by Run when the command in the builder exits with a non-zero status, so
+// that callers can tell a failed command from a failure to run it.
+type ExitError struct {
+	Code int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("command exited with status %d", e.Code)
+}
+
+// ExitCode returns the exit status of the command, ktib exits with it.
+func (e *ExitError) ExitCode() int {
+	return e.Code
+}
+
+// Run runs args in the builder with the OCI runtime. The environment, working directory and user
+// of the builder are used unless ops overrides them, the environment of ops is added on top. When
+// ctx is done the command is killed.
+func (b *Builder) Run(ctx context.Context, args []string, ops options.RUNOption) error {
 	g, err := generate.New("linux")
 	if err != nil {
 		return err
 	}
-	// Currently, the cni component is not supported to create container networks, so the host network is still used.
-	if err = g.RemoveLinuxNamespace("network"); err != nil {
-		return fmt.Errorf("error removing network namespace for run", err)
+	if err := setupNetwork(&g, ops.Network); err != nil {
+		return fmt.Errorf("error setting up the network for run: %w", err)
+	}
+	if err := b.setupUserNamespace(&g); err != nil {
+		return fmt.Errorf("error setting up the user namespace for run: %w", err)
+	}
+	setupRootless(&g)
+	if err := setupSecurity(&g, ops.SecurityOption, b.logger()); err != nil {
+		return fmt.Errorf("error setting up the security options for run: %w", err)
+	}
+	if ops.Terminal {
+		if err := setupTerminal(&g); err != nil {
+			return err
+		}
+	}
+	volumes, err := parseVolumes(ops.Volumes)
+	if err != nil {
+		return err
 	}
 	if err := b.Mount(""); err != nil {
 		return err
 	}
 	mountPoint := b.MountPoint
 	g.SetRootPath(mountPoint)
-	if args != nil {
-		g.SetProcessArgs([]string{"/bin/sh", "-c", strings.Join(args, " ")})
+	if len(args) > 0 {
+		g.SetProcessArgs(args)
 	} else {
 		g.SetProcessArgs([]string{"bash"})
 	}
 
 	g.SetProcessCwd("/")
-	if ops.Workdir != "" {
-		g.SetProcessCwd(ops.Workdir)
+	workdir := ops.Workdir
+	if workdir == "" {
+		workdir = b.Workdir
+	}
+	if workdir != "" {
+		g.SetProcessCwd(filepath.Join("/", workdir))
+	}
+	for _, env := range append(append([]string{}, b.Env...), ops.Env...) {
+		kv := strings.SplitN(env, "=", 2)
+		if len(kv) == 2 {
+			g.AddProcessEnv(kv[0], kv[1])
+		}
+	}
+	user := ops.User
+	if user == "" {
+		user = b.User
+	}
+	if user != "" {
+		uid, gid, err := lookupUser(mountPoint, user)
+		if err != nil {
+			return err
+		}
+		g.SetProcessUID(uid)
+		g.SetProcessGID(gid)
+	}
+	runDir, err := b.Store.ContainerRunDirectory(b.ContainerID)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(runDir, 0700); err != nil {
+		return err
+	}
+	netDir, err := os.MkdirTemp(runDir, "network")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(netDir)
+	hostname := ops.Hostname
+	if hostname == "" {
+		hostname = shortID(b.ContainerID)
+	}
+	g.SetHostname(hostname)
+	netMounts, err := networkMounts(mountPoint, netDir, ops.Network, hostname)
+	if err != nil {
+		return err
+	}
+	mounts := append(append(netMounts, ops.Mounts...), volumes...)
+	for _, m := range mounts {
+		g.AddMount(m)
 	}
+	removeTargets, err := createMountTargets(mountPoint, mounts)
+	if err != nil {
+		return err
+	}
+	defer removeTargets()
 	cdir, err := b.Store.ContainerDirectory(b.ContainerID)
 	if err != nil {
 		return err
@@ -602,113 +879,292 @@ func (b *Builder) Run(args []string, ops options.RUNOption) error {
 	var allArgs []string
 	allArgs = append(allArgs, "run", "-b", cdir, ctrid)
 
-	cmd := exec.Command(defaultruntime, allArgs...)
+	runtime := defaultruntime
 	if ops.Runtime != "" {
-		cmd = exec.Command(ops.Runtime, allArgs...)
+		runtime = ops.Runtime
+	}
+	cmd := exec.CommandContext(ctx, runtime, allArgs...)
+	cmd.Cancel = func() error {
+		return killContainer(runtime, ctrid, cmd.Process)
 	}
+	// a runtime that does not exit once the container is killed is killed itself
+	cmd.WaitDelay = runtimeKillTimeout
 	cmd.Dir = mountPoint
+	// with a terminal the runtime relays it to the pseudo-terminal of the container and resizes
+	// that one whenever it receives SIGWINCH
 	cmd.Stdin = os.Stdin
+	if ops.In != nil {
+		cmd.Stdin = ops.In
+	}
 	cmd.Stdout = os.Stdout
+	if ops.Out != nil {
+		cmd.Stdout = ops.Out
+	}
 	cmd.Stderr = os.Stderr
+	if ops.Err != nil {
+		cmd.Stderr = ops.Err
+	}
+	if ops.StoreLock != nil {
+		ops.StoreLock.Unlock()
+	}
 	err = cmd.Run()
+	if ops.StoreLock != nil {
+		ops.StoreLock.Lock()
+	}
+	if ctx.Err() != nil {
+		return fmt.Errorf("command %v was stopped: %w", args, ctx.Err())
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return &ExitError{Code: exitCode(exitErr)}
+	}
 	if err != nil {
 		logrus.Errorf("runtime exec failed: %s", err)
 	}
 	return err
 }
 
-func (b *Builder) SetLabel(containerID string, labels map[string]string) error {
-	// 找到容器的配置文件路径
-	configDir, err := b.Store.ContainerDirectory(containerID)
-	if err != nil {
-		return err
+// killContainer kills the container id of a runtime running it in the foreground, the runtime then
+// exits with it. When the runtime can not kill it, the runtime process p is killed and what is left
+// of the container is deleted.
+func killContainer(runtime, id string, p *os.Process) error {
+	out, err := exec.Command(runtime, "kill", id, "KILL").CombinedOutput()
+	if err == nil {
+		return nil
 	}
-	configPath := filepath.Join(configDir, "ktib.json")
-
-	// 读取配置文件
-	data, err := ioutil.ReadFile(configPath)
-	if err != nil {
-		return err
+	logrus.Debugf("unable to kill container %s: %s: %s", id, err, out)
+	err = p.Kill()
+	if out, err := exec.Command(runtime, "delete", "--force", id).CombinedOutput(); err != nil {
+		logrus.Debugf("unable to delete container %s: %s: %s", id, err, out)
 	}
+	return err
+}
 
-	// 解析当前配置
-	var config map[string]interface{}
-	if err := json.Unmarshal(data, &config); err != nil {
-		return err
+// exitCode returns the exit status of the runtime, which is the one of the command it ran. A
+// runtime killed by a signal exits with 128 plus the signal number, like a shell reports it.
+func exitCode(err *exec.ExitError) int {
+	if status, ok := err.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal())
 	}
+	return err.ExitCode()
+}
 
-	// 更新标签
-	if config["Labels"] == nil {
-		config["Labels"] = make(map[string]string)
+// setupTerminal makes the runtime allocate a pseudo-terminal for the command, with the size of
+// the terminal ktib runs in.
+func setupTerminal(g *generate.Generator) error {
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return errors.New("a terminal was requested, but the input is not a terminal")
 	}
-	labelsMap := config["Labels"].(map[string]string)
-	for key, value := range labels {
-		labelsMap[key] = value
+	g.SetProcessTerminal(true)
+	if width, height, err := term.GetSize(int(os.Stdin.Fd())); err == nil {
+		g.SetProcessConsoleSize(uint(width), uint(height))
 	}
-	config["Labels"] = labelsMap
+	return nil
+}
 
-	// 更新配置文件
-	newData, err := json.Marshal(config)
+func (b *Builder) SetLabel(containerID string, labels map[string]string) error {
+	// 更新标签并保存构建器状态
+	err := b.Update(func() error {
+		for key, value := range labels {
+			b.AddLabel(key, value)
+		}
+		return nil
+	})
 	if err != nil {
 		return err
 	}
-	if err := ioutil.WriteFile(configPath, newData, 0644); err != nil {
-		return err
-	}
 
 	fmt.Printf("成功为容器 %s 设置标签: %v\n", containerID, labels)
 	return nil
 }
 
-func BuildDockerfiles(store storage.Store, op *options.BuildOptions, dockerfile ...string) error {
-	var lineContinuation = regexp.MustCompile(`\\\s*\n`)
+// BuildDockerfiles builds the images of the Dockerfiles. When ctx is cancelled, or the build takes
+// longer than op.Timeout, the running command is killed and the builders of the build are removed.
+func BuildDockerfiles(ctx context.Context, store storage.Store, op *options.BuildOptions, dockerfile ...string) error {
+	_, err := buildDockerfiles(ctx, store, op, nil, dockerfile...)
+	return err
+}
+
+// buildDockerfiles builds the images of the Dockerfiles and returns the ID of the last one.
+func buildDockerfiles(ctx context.Context, store storage.Store, op *options.BuildOptions, shared *parallelRun, dockerfile ...string) (string, error) {
 	if len(dockerfile) == 0 {
-		return errors.New("error building: no dockerfiles specified\n")
+		return "", errors.New("error building: no dockerfiles specified\n")
+	}
+	if op.Resume != "" && len(dockerfile) > 1 {
+		return "", errors.New("only the build of a single Dockerfile can be resumed")
+	}
+	if shared != nil {
+		// held until the build and its cleanup are done, released while commands run
+		shared.store.Lock()
+		defer shared.store.Unlock()
 	}
 	exec, err := NewExecutor(store, op)
 	if err != nil {
-		return fmt.Errorf("error creating build executor: %w", err)
-	}
+		return "", fmt.Errorf("error creating build executor: %w", err)
+	}
+	exec.shared = shared
+	defer exec.progress.hookWarnings()()
+	if op.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, op.Timeout)
+		defer cancel()
+	}
+	defer func() {
+		if exec.builders == nil && len(exec.stageList) == 0 {
+			return
+		}
+		if op.KeepOnFailure {
+			exec.unmountImages()
+			for _, stage := range exec.stageList {
+				if stage == exec.builders {
+					continue
+				}
+				if err := stage.unmountAll(); err != nil {
+					exec.log.Warnf("unable to unmount stage builder %s: %s", stage.ContainerID, err)
+				}
+			}
+			if exec.builders.MountPoint == "" {
+				if err := exec.builders.Mount(""); err != nil {
+					exec.log.Warnf("unable to mount builder %s: %s", exec.builders.ContainerID, err)
+				}
+			}
+			fmt.Fprintf(exec.err, "the failed builder %s is kept mounted at %s, resume the build with --resume %s\n",
+				exec.builders.ContainerID, exec.builders.MountPoint, exec.builders.ContainerID)
+			return
+		}
+		// the builders of a failed build are kept to resume it, unless the build was stopped
+		interrupted := ctx.Err() != nil
+		if !interrupted && !op.ForceRm {
+			fmt.Fprintf(exec.err, "the builders of the failed build are kept, resume the build with --resume %s or remove them with 'ktib builders prune'\n",
+				exec.builders.ContainerID)
+		}
+		exec.cleanupStages(interrupted || op.ForceRm)
+	}()
 
+	var imageID string
 	for _, value := range dockerfile {
 		fileBytes, err := ioutil.ReadFile(value)
 		if err != nil {
-			return err
+			return "", err
 		}
 		if len(fileBytes) == 0 {
-			return errors.New("Dockerfile cannot be empty")
-		}
-		var (
-			dockerfileContent = lineContinuation.ReplaceAllString(stripComments(fileBytes), "")
-			stepN             = 1
-		)
-		//Split into lines based on line breaks
-		for _, line := range strings.Split(dockerfileContent, "\n") {
-			//Remove spaces, tabs, and line breaks at the beginning and end of a line
-			line = strings.Trim(strings.Replace(line, "\t", " ", -1), " \t\r\n")
-			if len(line) == 0 {
-				continue
+			return "", errors.New("Dockerfile cannot be empty")
+		}
+		steps, escape, err := parseDockerfile(fileBytes, exec.log)
+		if err != nil {
+			return "", fmt.Errorf("error parsing %s: %w", value, err)
+		}
+		exec.escape = escape
+		sources := make([]string, len(steps))
+		for i, step := range steps {
+			sources[i] = step.source()
+		}
+		path, err := filepath.Abs(value)
+		if err != nil {
+			return "", err
+		}
+		exec.instructions = nil
+		done := 0
+		if op.Resume != "" {
+			if done, err = exec.resume(op.Resume, path, sources); err != nil {
+				return "", fmt.Errorf("error resuming builder %s: %w", op.Resume, err)
+			}
+			fmt.Fprintf(exec.out, "Resuming builder %s after step %d\n", exec.builders.ContainerID, done)
+		}
+		for i := done; i < len(steps); i++ {
+			if err := ctx.Err(); err != nil {
+				return "", fmt.Errorf("build stopped: %w", err)
 			}
 			//Execute each step of construction
-			if err := exec.BuildStep(fmt.Sprintf("%d", stepN), line); err != nil {
-				return err
+			exec.heredocs = steps[i].Heredocs
+			if err := exec.BuildStep(ctx, strconv.Itoa(i+1), steps[i].Expression); err != nil {
+				if errors.Is(err, errTargetReached) {
+					break
+				}
+				return "", fmt.Errorf("%s:%d: %w", value, steps[i].Line, err)
+			}
+			if err := exec.checkpoint(path, i+1, sources[i]); err != nil {
+				return "", fmt.Errorf("error saving the progress of the build: %w", err)
 			}
-			stepN += 1
+		}
+		if unused := exec.unusedBuildArgs(); len(unused) > 0 {
+			exec.log.Warnf("one or more build args were not consumed: %v", unused)
+		}
+		exec.globalArgs = make(map[string]string)
+		exec.usedArgs = make(map[string]bool)
+		if exec.target != "" && exec.stageName != exec.target {
+			// nothing is left to resume or to keep for a target that does not exist
+			exec.cleanupStages(true)
+			exec.builders = nil
+			return "", fmt.Errorf("target stage %q could not be found in %s", op.Target, value)
 		}
 
-		if err := exec.BuildCommit(op); err != nil {
-			return err
+		if imageID, err = exec.BuildCommit(op); err != nil {
+			return "", err
+		}
+		if op.IIDFile != "" {
+			if err := os.WriteFile(op.IIDFile, []byte(imageID), 0644); err != nil {
+				return "", fmt.Errorf("error writing the image ID to %s: %w", op.IIDFile, err)
+			}
 		}
 	}
-	return nil
+	return imageID, nil
 }
 
 func NewExecutor(store storage.Store, options *options.BuildOptions) (*Executor, error) {
+	if err := ValidateNetwork(options.Network); err != nil {
+		return nil, err
+	}
+	if err := ValidateSecurity(options.SecurityOption); err != nil {
+		return nil, err
+	}
+	if err := ValidateFormat(options.OutputFormat); err != nil {
+		return nil, err
+	}
+	if err := ValidateSquash(options.Squash); err != nil {
+		return nil, err
+	}
+	if err := ValidateProgress(options.Progress); err != nil {
+		return nil, err
+	}
 	exec := Executor{
-		store:      store,
-		contextDir: options.ContextDirectory,
-		out:        options.Out,
-		err:        options.Err,
+		store:       store,
+		contextDir:  options.ContextDirectory,
+		args:        make(map[string]string),
+		globalArgs:  make(map[string]string),
+		buildArgs:   options.Args,
+		secrets:     options.Secrets,
+		network:     options.Network,
+		security:    options.SecurityOption,
+		format:      options.OutputFormat,
+		timestamp:   options.Timestamp,
+		usedArgs:    make(map[string]bool),
+		stages:      make(map[string]*Builder),
+		target:      strings.ToLower(options.Target),
+		noCache:     options.NoCache,
+		stepTimeout: options.StepTimeout,
+		escape:      parser.DefaultEscapeToken,
+		in:          options.In,
+		out:         options.Out,
+		err:         options.Err,
+	}
+	if exec.contextDir != "" {
+		excludes, err := readIgnoreFile(exec.contextDir)
+		if err != nil {
+			return nil, fmt.Errorf("error reading the ignore file of the build context: %w", err)
+		}
+		if exec.filter, err = newContextFilter(exec.contextDir, excludes); err != nil {
+			return nil, err
+		}
+		exec.excludes = excludes
+	}
+	if _, ok := exec.buildArgs[SourceDateEpoch]; exec.timestamp != nil && !ok {
+		// tools run by RUN steps that honor SOURCE_DATE_EPOCH produce the same files every build
+		exec.buildArgs = copyStringMap(exec.buildArgs)
+		if exec.buildArgs == nil {
+			exec.buildArgs = make(map[string]string)
+		}
+		exec.buildArgs[SourceDateEpoch] = strconv.FormatInt(exec.timestamp.Unix(), 10)
 	}
 	if exec.err == nil {
 		exec.err = os.Stderr
@@ -716,85 +1172,412 @@ func NewExecutor(store storage.Store, options *options.BuildOptions) (*Executor,
 	if exec.out == nil {
 		exec.out = os.Stdout
 	}
+	exec.progress = newProgress(options.Progress, exec.out)
+	exec.log = exec.progress.logger()
 	return &exec, nil
 }
 
-// Remove all lines starting with '#' or empty spaces from the []byte
-func stripComments(raw []byte) string {
-	var (
-		out   []string
-		lines = strings.Split(string(raw), "\n")
-	)
-	for _, l := range lines {
-		//Filter out lines that start with "#" or are empty
-		if len(l) == 0 || l[0] == '#' {
-			continue
-		}
-		out = append(out, l)
+// BuildStep executes one instruction of a Dockerfile and reports its progress. A step taking
+// longer than the step timeout is stopped.
+func (b *Executor) BuildStep(ctx context.Context, name, expression string) error {
+	started := time.Now()
+	b.step = name
+	b.progress.stepStart(name, expression)
+	stepCtx := ctx
+	if b.stepTimeout > 0 {
+		var cancel context.CancelFunc
+		stepCtx, cancel = context.WithTimeout(ctx, b.stepTimeout)
+		defer cancel()
+	}
+	err := b.buildStep(stepCtx, expression)
+	if err != nil && ctx.Err() == nil && errors.Is(stepCtx.Err(), context.DeadlineExceeded) {
+		err = fmt.Errorf("step %s exceeded the step timeout of %s: %w", name, b.stepTimeout, err)
+	}
+	if !errors.Is(err, errTargetReached) {
+		b.progress.stepEnd(name, started, err)
 	}
-	return strings.Join(out, "\n")
+	return err
 }
 
-func (b *Executor) BuildStep(name, expression string) error {
-	fmt.Fprintf(b.out, "Step %s : %s\n", name, expression)
+func (b *Executor) buildStep(ctx context.Context, expression string) error {
 	tmp := strings.SplitN(expression, " ", 2)
 	if len(tmp) != 2 {
 		return fmt.Errorf("Invalid Dockerfile format")
 	}
 	instruction := strings.Trim(tmp[0], " ")
 	arguments := strings.Trim(tmp[1], " ")
+	if expandInstructions[instruction] {
+		env := b.expansionEnv()
+		if instruction == "FROM" {
+			env = b.globalArgs
+		}
+		expanded, err := expandArgs(arguments, env, b.escape)
+		if err != nil {
+			return fmt.Errorf("error expanding %s arguments: %w", instruction, err)
+		}
+		arguments = expanded
+		expression = instruction + " " + arguments
+	}
+	if b.builders == nil && instruction != "FROM" && instruction != "ARG" {
+		return fmt.Errorf("%s can not be used before FROM", instruction)
+	}
 	switch instruction {
 	case "FROM":
+		image, stageName, err := parseFrom(arguments, b.log)
+		if err != nil {
+			return err
+		}
+		if b.builders != nil && b.target != "" && b.stageName == b.target {
+			return errTargetReached
+		}
+		// a previous stage is committed to an intermediate image that the new stage starts from
+		parent, isStage := b.stages[strings.ToLower(image)]
+		if isStage {
+			img, err := parent.commitImage("", nil)
+			if err != nil {
+				return fmt.Errorf("error committing stage %s: %w", image, err)
+			}
+			b.stageImages = append(b.stageImages, img.ID)
+			image = img.ID
+		}
 		option := BuilderOptions{
-			FromImage: arguments,
+			FromImage: image,
+			log:       b.log,
 		}
 		builders, err := NewBuilder(b.store, option)
 		if err != nil {
 			return errors.New(fmt.Sprintf("error creating build container: %s\n", err))
 		}
-		fmt.Printf("%s\n", builders.ContainerID)
+		if !b.progress.json() {
+			fmt.Fprintf(b.out, "%s\n", builders.ContainerID)
+		}
+		if isStage {
+			builders.inheritConfig(parent)
+		}
+		builders.Format = b.format
+		builders.Timestamp = b.timestamp
 		if err := builders.Save(); err != nil {
 			return err
 		}
-		b.builders = builders
+		if err := b.startStage(stageName, builders); err != nil {
+			return err
+		}
 	case "ADD", "COPY":
-		tmp := strings.Split(arguments, " ")
-		source := tmp[:len(tmp)-1]
+		flags, rest := extractFlags(arguments)
+		tmp, err := parseList(rest, b.escape)
+		if err != nil {
+			return err
+		}
+		if len(tmp) < 2 {
+			return fmt.Errorf("%s requires at least two arguments", instruction)
+		}
+		root, filter := b.contextDir, b.filter
+		if from, ok := flags["from"]; ok {
+			filter = nil
+			if instruction == "ADD" {
+				return fmt.Errorf("ADD does not support the --from option")
+			}
+			if root, err = b.stageRoot(from[0]); err != nil {
+				return err
+			}
+		}
 		dest := tmp[len(tmp)-1]
-		var isADD bool
-		if instruction == "ADD" {
-			isADD = true
+		if _, ok := b.heredoc(dest); ok {
+			return fmt.Errorf("%s can not use a heredoc as the destination", instruction)
 		}
-		err := b.builders.Add(dest, source, isADD)
+		var heredocDir string
+		if len(b.heredocs) > 0 {
+			if heredocDir, err = os.MkdirTemp("", "ktib-heredoc"); err != nil {
+				return err
+			}
+			defer os.RemoveAll(heredocDir)
+		}
+		var source []string
+		for _, src := range tmp[:len(tmp)-1] {
+			if heredoc, ok := b.heredoc(src); ok {
+				path, err := b.writeHeredoc(heredoc, heredocDir)
+				if err != nil {
+					return err
+				}
+				source = append(source, path)
+				continue
+			}
+			path, err := securejoin.SecureJoin(root, src)
+			if err != nil {
+				return err
+			}
+			source = append(source, path)
+		}
+		addOption, err := parseAddFlags(instruction, flags)
+		if err != nil {
+			return err
+		}
+		if filter != nil {
+			addOption.ContextDir = b.contextDir
+			addOption.Excludes = b.excludes
+		}
+		contentHash, err := hashSources(source, filter)
+		if err != nil {
+			return err
+		}
+		key, err := b.cacheKey(expression, contentHash)
+		if err != nil {
+			return err
+		}
+		defer b.lockStep(key)()
+		if hit, err := b.fromCache(key); err != nil || hit {
+			return err
+		}
+		err = b.builders.Add(dest, source, addOption)
 		if err != nil {
 			return errors.New(fmt.Sprintf("error adding or copying content to builder: %s", err))
 		}
+		b.builders.createdBy = nopPrefix + expression
+		return b.commitStep(key)
 	case "RUN":
-		args := strings.Split(arguments, " ")
-		var ops options.RUNOption
-		if err := b.builders.Run(args, ops); err != nil {
+		flags, rest := extractFlags(arguments)
+		network := b.network
+		for name, values := range flags {
+			switch name {
+			case "mount":
+			case "network":
+				if values[len(values)-1] != "default" {
+					network = values[len(values)-1]
+				}
+				if err := ValidateNetwork(network); err != nil {
+					return err
+				}
+			default:
+				return fmt.Errorf("unknown flag for RUN: --%s", name)
+			}
+		}
+		// the heredocs are part of the command, their content has to match for a cache hit
+		heredocHash := ""
+		if len(b.heredocs) > 0 {
+			heredocHash = instructionDigest(dockerfileStep{Expression: expression, Heredocs: b.heredocs}.source())
+		}
+		mountHash, err := b.hashMounts(flags["mount"])
+		if err != nil {
+			return err
+		}
+		key, err := b.cacheKey(expression, heredocHash, mountHash)
+		if err != nil {
+			return err
+		}
+		defer b.lockStep(key)()
+		if hit, err := b.fromCache(key); err != nil || hit {
+			return err
+		}
+		args := shellCommand(rest, b.builders.Shell)
+		var scriptMounts []specs.Mount
+		if len(b.heredocs) > 0 {
+			var cleanup func()
+			if args, scriptMounts, cleanup, err = b.heredocCommand(rest); err != nil {
+				return err
+			}
+			defer cleanup()
+		}
+		if len(args) == 0 {
+			return fmt.Errorf("RUN requires at least one argument")
+		}
+		mounts, cleanup, err := b.runMounts(flags["mount"])
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+		mounts = append(mounts, scriptMounts...)
+		ops := options.RUNOption{
+			Workdir:        b.builders.Workdir,
+			User:           b.builders.User,
+			Env:            b.runEnv(),
+			Network:        network,
+			Mounts:         mounts,
+			SecurityOption: b.security,
+			In:             b.in,
+			Out:            b.runOut(),
+			Err:            b.err,
+		}
+		if b.shared != nil {
+			ops.StoreLock = &b.shared.store
+		}
+		if err := b.builders.Run(ctx, args, ops); err != nil {
 			return err
 		}
+		b.builders.createdBy = strings.Join(args, " ")
+		return b.commitStep(key)
 	case "CMD":
-		b.builders.SetCmd(arguments)
-	default:
-		if b.builders != nil {
-			err := b.builders.Remove()
-			b.builders = nil
-			return fmt.Errorf("Unsupported Dockerfile directive: %s, %v\n", instruction, err)
+		b.builders.SetCmd(shellCommand(arguments, b.builders.Shell))
+		b.cmdSet = true
+	case "ENTRYPOINT":
+		b.builders.SetEntryPoint(shellCommand(arguments, b.builders.Shell))
+		// a new entrypoint drops the command inherited from the base image or parent stage
+		if !b.cmdSet {
+			b.builders.SetCmd(nil)
+		}
+	case "ENV":
+		pairs, err := parseKeyValues(instruction, arguments, b.escape)
+		if err != nil {
+			return err
+		}
+		for _, kv := range pairs {
+			b.builders.AddEnv(kv[0], kv[1])
+		}
+	case "LABEL":
+		pairs, err := parseKeyValues(instruction, arguments, b.escape)
+		if err != nil {
+			return err
+		}
+		for _, kv := range pairs {
+			b.builders.AddLabel(kv[0], kv[1])
+		}
+	case "WORKDIR":
+		workdir := arguments
+		if !filepath.IsAbs(workdir) {
+			workdir = filepath.Join("/", b.builders.Workdir, workdir)
+		}
+		if err := b.builders.Mount(""); err != nil {
+			return err
+		}
+		dir, err := securejoin.SecureJoin(b.builders.MountPoint, workdir)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("error creating working directory %q: %w", workdir, err)
 		}
+		b.builders.SetWorkdir(filepath.Clean(workdir))
+	case "USER":
+		b.builders.SetUser(arguments)
+	case "EXPOSE":
+		for _, p := range strings.Fields(arguments) {
+			port, err := normalizePort(p)
+			if err != nil {
+				return err
+			}
+			b.builders.AddPort(port)
+		}
+	case "VOLUME":
+		volumes, err := parseList(arguments, b.escape)
+		if err != nil {
+			return err
+		}
+		for _, volume := range volumes {
+			b.builders.AddVolume(volume)
+		}
+	case "ARG":
+		words, err := splitWords(arguments, b.escape)
+		if err != nil {
+			return err
+		}
+		for _, arg := range words {
+			kv := strings.SplitN(arg, "=", 2)
+			if len(kv) == 2 {
+				b.declareArg(kv[0], kv[1], true)
+			} else {
+				b.declareArg(kv[0], "", false)
+			}
+		}
+	case "STOPSIGNAL":
+		b.builders.SetStopSignal(arguments)
+	case "HEALTHCHECK":
+		health, err := parseHealthcheck(arguments)
+		if err != nil {
+			return err
+		}
+		b.builders.SetHealthcheck(health)
+	case "SHELL":
+		shell, ok := parseJSONArray(arguments)
+		if !ok || len(shell) == 0 {
+			return fmt.Errorf("SHELL requires the arguments to be in JSON form")
+		}
+		b.builders.SetShell(shell)
+	case "MAINTAINER":
+		b.builders.SetMaintainer(arguments)
+	default:
+		return fmt.Errorf("Unsupported Dockerfile directive: %s", instruction)
+	}
+	if emptyLayerInstructions[instruction] {
+		b.builders.appendHistory(b.builders.now(), nopPrefix+expression, true)
 	}
 	return nil
 }
 
-func (b *Executor) BuildCommit(op *options.BuildOptions) error {
-	err := b.builders.Commit(op.Tags)
+// nopPrefix marks the history entries of instructions that do not run a command.
+const nopPrefix = "/bin/sh -c #(nop) "
+
+// emptyLayerInstructions only change the configuration, they are recorded in the history
+// without a layer of their own.
+var emptyLayerInstructions = map[string]bool{
+	"CMD":         true,
+	"ENTRYPOINT":  true,
+	"ENV":         true,
+	"LABEL":       true,
+	"WORKDIR":     true,
+	"USER":        true,
+	"EXPOSE":      true,
+	"VOLUME":      true,
+	"STOPSIGNAL":  true,
+	"HEALTHCHECK": true,
+	"SHELL":       true,
+	"MAINTAINER":  true,
+}
+
+// expandInstructions are the instructions whose arguments get ARG and ENV values substituted.
+// RUN receives the values through its environment instead, so that the shell expands them.
+var expandInstructions = map[string]bool{
+	"FROM":       true,
+	"ADD":        true,
+	"COPY":       true,
+	"ENV":        true,
+	"LABEL":      true,
+	"WORKDIR":    true,
+	"USER":       true,
+	"EXPOSE":     true,
+	"VOLUME":     true,
+	"STOPSIGNAL": true,
+	"ARG":        true,
+}
+
+// runOut returns where the output of RUN steps goes. With json progress the output of the build
+// only holds the events, so the commands write to the error output.
+func (b *Executor) runOut() io.Writer {
+	if b.progress.json() {
+		return b.err
+	}
+	return b.out
+}
+
+// runEnv returns the environment of a RUN step, the builder's ENV values override ARG values.
+// The proxy build args are passed through without being declared.
+func (b *Executor) runEnv() []string {
+	var env []string
+	for k, v := range b.buildArgs {
+		if _, declared := b.args[k]; builtinArgs[k] && !declared {
+			env = append(env, k+"="+v)
+		}
+	}
+	for k, v := range b.args {
+		env = append(env, k+"="+v)
+	}
+	sort.Strings(env)
+	return append(env, b.builders.Env...)
+}
+
+// BuildCommit commits the final stage to the image tagged op.Tags and returns the ID of the image.
+func (b *Executor) BuildCommit(op *options.BuildOptions) (string, error) {
+	// only the final image is squashed, the intermediate images keep a layer per step for the cache
+	b.builders.Squash = op.Squash
+	imageID, err := b.builders.Commit(op.Tags)
 	if err != nil {
-		return errors.New(fmt.Sprintf("error commit container to images: %s", err))
+		return "", errors.New(fmt.Sprintf("error commit container to images: %s", err))
 	}
-	if b.builders != nil {
-		err = b.builders.Remove()
-		b.builders = nil
+	var names []string
+	if op.Tags != defaultNullImageName {
+		names = []string{op.Tags}
 	}
-	return nil
+	b.progress.image(imageID, names)
+	// the final builder is one of the stages, remove it together with the intermediate ones
+	b.cleanupStages(op.Rm || op.ForceRm)
+	b.builders = nil
+	return imageID, nil
 }
@@ -1,89 +1,202 @@
 package builder
 
 import (
-	"regexp"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+
+	"gitee.com/openeuler/ktib/pkg/options"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
 )
 
-func TestStripComments(t *testing.T) {
-	tests := []struct {
-		name     string
-		input    []byte
-		expected string
-	}{
-		{
-			name:     "empty input",
-			input:    []byte(""),
-			expected: "",
-		},
-		{
-			name:     "no comment line",
-			input:    []byte("line1\nline2"),
-			expected: "line1\nline2",
-		},
-		{
-			name:     "with comment line",
-			input:    []byte("#hashbutnotacomment\n#alsonotacomment\nline3"),
-			expected: "line3",
-		},
-		{
-			name:     "comments and empty lines",
-			input:    []byte("line1\n#comment\n\nline3\n#another comment"),
-			expected: "line1\nline3",
-		},
+func TestRunConfig(t *testing.T) {
+	store := newTestStore(t)
+	b, err := NewBuilder(store, BuilderOptions{Container: "run-test"})
+	if err != nil {
+		t.Fatal(err)
 	}
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			if got := stripComments(tt.input); got != tt.expected {
-				t.Errorf("stripComments() = %v, want %v", got, tt.expected)
-			}
-		})
+	if err := b.Mount(""); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if _, err := store.Unmount(b.ContainerID, true); err != nil {
+			t.Error(err)
+		}
+	}()
+	if err := os.MkdirAll(filepath.Join(b.MountPoint, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(b.MountPoint, "etc/passwd"), []byte("app:x:1001:1002::/home/app:/bin/sh\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	b.Workdir = "/srv"
+	b.User = "app"
+	b.Env = []string{"FROM_BUILDER=1", "OVERRIDE=builder"}
+
+	// the runtime keeps the spec it was given and fails like the command did
+	dir := t.TempDir()
+	runtime := filepath.Join(dir, "runtime")
+	script := "#!/bin/sh\ncp \"$3/config.json\" " + filepath.Join(dir, "spec.json") + "\nexit 3\n"
+	if err := os.WriteFile(runtime, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	volume := t.TempDir()
+	err = b.Run(context.Background(), []string{"true"}, options.RUNOption{
+		Runtime:  runtime,
+		Env:      []string{"OVERRIDE=run"},
+		Hostname: "ktib-test",
+		Volumes:  []string{volume + ":/data:ro"},
+	})
+	var exitErr *ExitError
+	if !errors.As(err, &exitErr) || exitErr.Code != 3 {
+		t.Fatalf("Run error = %v, want exit status 3", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "spec.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var spec specs.Spec
+	if err := json.Unmarshal(data, &spec); err != nil {
+		t.Fatal(err)
+	}
+	if spec.Process.Cwd != "/srv" {
+		t.Errorf("cwd = %q, want /srv", spec.Process.Cwd)
+	}
+	if spec.Process.User.UID != 1001 || spec.Process.User.GID != 1002 {
+		t.Errorf("user = %d:%d, want 1001:1002", spec.Process.User.UID, spec.Process.User.GID)
+	}
+	env := map[string]bool{}
+	for _, e := range spec.Process.Env {
+		env[e] = true
+	}
+	if !env["FROM_BUILDER=1"] || !env["OVERRIDE=run"] || env["OVERRIDE=builder"] {
+		t.Errorf("env = %v", spec.Process.Env)
+	}
+	if spec.Hostname != "ktib-test" {
+		t.Errorf("hostname = %q, want ktib-test", spec.Hostname)
+	}
+	found := false
+	for _, m := range spec.Mounts {
+		if m.Destination == "/data" && m.Source == volume {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("volume is not mounted: %+v", spec.Mounts)
 	}
 }
 
-func TestLineContinuationRegex(t *testing.T) {
+func TestRunCancel(t *testing.T) {
+	store := newTestStore(t)
+	b, err := NewBuilder(store, BuilderOptions{Container: "cancel-test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if _, err := store.Unmount(b.ContainerID, true); err != nil {
+			t.Error(err)
+		}
+	}()
+	// the runtime hangs and can not kill the container, so the runtime itself is killed
+	dir := t.TempDir()
+	runtime := filepath.Join(dir, "runtime")
+	calls := filepath.Join(dir, "calls")
+	script := "#!/bin/sh\necho $1 >> " + calls + "\ncase $1 in\nrun) exec sleep 60 ;;\nkill) exit 1 ;;\nesac\n"
+	if err := os.WriteFile(runtime, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	started := time.Now()
+	err = b.Run(ctx, []string{"true"}, options.RUNOption{Runtime: runtime})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Run error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(started); elapsed > 10*time.Second {
+		t.Errorf("Run returned after %s", elapsed)
+	}
+	data, err := os.ReadFile(calls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(data), "run\nkill\ndelete\n"; got != want {
+		t.Errorf("runtime calls = %q, want %q", got, want)
+	}
+}
+
+// cancelWriter cancels a build once the output contains after.
+type cancelWriter struct {
+	after  string
+	cancel context.CancelFunc
+	out    strings.Builder
+}
+
+func (w *cancelWriter) Write(p []byte) (int, error) {
+	w.out.Write(p)
+	if strings.Contains(w.out.String(), w.after) {
+		w.cancel()
+	}
+	return len(p), nil
+}
+
+func TestBuildCleanup(t *testing.T) {
+	contextDir := t.TempDir()
 	tests := []struct {
-		name     string
-		input    string
-		expected string
+		name       string
+		dockerfile string
+		forceRm    bool
+		cancel     string
+		wantErr    error
+		want       int
 	}{
-		{
-			name:     "no comments",
-			input:    "FROM golang:1.20\nRUN echo Hello, World!",
-			expected: "FROM golang:1.20\nRUN echo Hello, World!",
-		},
-		{
-			name:     "with comments",
-			input:    "# This is a comment\nFROM golang:1.20\n# Another comment\nRUN echo Hello, World!",
-			expected: "FROM golang:1.20\nRUN echo Hello, World!",
-		},
-		{
-			name:     "with_line_continuation_in_FROM",
-			input:    "FROM \\\ngolang:1.20\nRUN echo Hello, World!",
-			expected: "FROM golang:1.20\nRUN echo Hello, World!",
-		},
-		{
-			name:     "with_line_continuation_in_RUN",
-			input:    "FROM golang:1.20\nRUN echo Hello, \\\nWorld!",
-			expected: "FROM golang:1.20\nRUN echo Hello, World!",
-		},
-		{
-			name:     "with_line_continuation_and_comments",
-			input:    "# Preamble comment\nFROM \\\n# This is a comment\ngolang:1.20\nRUN echo Hello, World!",
-			expected: "FROM golang:1.20\nRUN echo Hello, World!",
-		},
-		{
-			name:     "with_line_continuation_and_whitespace",
-			input:    "FROM \\\t\n\t\t\ngolang:1.20\nRUN echo Hello, World!",
-			expected: "FROM golang:1.20\nRUN echo Hello, World!",
-		},
-	}
-	lineContinuation := regexp.MustCompile(`\\\s*\n`)
+		{name: "failed", dockerfile: "FROM scratch\nCOPY missing /missing\n", want: 1},
+		{name: "failed force-rm", dockerfile: "FROM scratch\nCOPY missing /missing\n", forceRm: true},
+		{name: "interrupted", dockerfile: "FROM scratch\nENV A=1\nENV B=2\n", cancel: "Step 2", wantErr: context.Canceled},
+	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			actual := lineContinuation.ReplaceAllString(stripComments([]byte(tt.input)), "")
-			if actual != tt.expected {
-				t.Errorf("stripComments() = %v, want %v", actual, tt.expected)
+			store := newTestStore(t)
+			dockerfile := filepath.Join(t.TempDir(), "Dockerfile")
+			if err := os.WriteFile(dockerfile, []byte(tt.dockerfile), 0644); err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			out := &cancelWriter{after: "\x00", cancel: cancel}
+			if tt.cancel != "" {
+				out.after = tt.cancel
+			}
+			op := &options.BuildOptions{
+				Tags:             "cleanup-test",
+				ContextDirectory: contextDir,
+				Rm:               true,
+				ForceRm:          tt.forceRm,
+				Out:              out,
+			}
+			err := BuildDockerfiles(ctx, store, op, dockerfile)
+			if err == nil {
+				t.Fatal("build succeeded")
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("build error = %v, want %v", err, tt.wantErr)
+			}
+			builders, err := ListBuilders(store, false, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(builders) != tt.want {
+				t.Fatalf("%d builders are left, want %d", len(builders), tt.want)
+			}
+			for _, c := range builders {
+				if c.Mounted {
+					t.Errorf("builder %s is still mounted", c.Container.ID)
+				}
 			}
 		})
 	}
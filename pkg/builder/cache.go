@@ -0,0 +1,217 @@
+/*
+   Copyright (c) 2023 KylinSoft Co., Ltd.
+   Kylin trusted image builder(ktib) is licensed under Mulan PSL v2.
+   You can use this software according to the terms and conditions of the Mulan PSL v2.
+   You may obtain a copy of Mulan PSL v2 at:
+            http://license.coscl.org.cn/MulanPSL2
+   THIS SOFTWARE IS PROVIDED ON AN "AS IS" BASIS, WITHOUT WARRANTIES OF ANY KIND, EITHER EXPRESS OR IMPLIED, INCLUDING
+   BUT NOT LIMITED TO NON-INFRINGEMENT, MERCHANTABILITY OR FIT FOR A PARTICULAR PURPOSE.
+   See the Mulan PSL v2 for more details.
+*/
+
+package builder
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/containers/storage"
+	"github.com/sirupsen/logrus"
+)
+
+// Every filesystem changing step (RUN, ADD and COPY) is committed to an intermediate image whose
+// ID is the cache key of the step. The key covers the image the step starts from, the text of
+// the instruction, the settings the step runs with and, for ADD and COPY, the content of the
+// sources. A later build computing the same key continues from that image instead of running
+// the step again.
+
+// cacheState is the part of the builder state that changes the result of a step. Timestamp and
+// Format change the bytes of the committed layer and configuration, so that a reproducible build
+// never continues from a layer that was not normalized. Squashing only applies to the final image
+// and is not part of it.
+type cacheState struct {
+	Env       []string
+	Workdir   string
+	User      string
+	Shell     []string
+	Args      map[string]string
+	Timestamp *int64 `json:",omitempty"`
+	Format    string `json:",omitempty"`
+}
+
+// lockStep locks the step with the cache key among the builds of a parallel run and returns the
+// function that unlocks it, so that the step runs once and the other builds find its image in the
+// cache. The store is not held while waiting, the build running the step needs it to commit.
+func (b *Executor) lockStep(key string) func() {
+	run := b.shared
+	if run == nil {
+		return func() {}
+	}
+	run.mu.Lock()
+	step, ok := run.steps[key]
+	if !ok {
+		step = &stepLock{}
+		run.steps[key] = step
+	}
+	step.users++
+	run.mu.Unlock()
+
+	run.store.Unlock()
+	step.Lock()
+	run.store.Lock()
+	return func() {
+		step.Unlock()
+		run.mu.Lock()
+		defer run.mu.Unlock()
+		if step.users--; step.users == 0 {
+			delete(run.steps, key)
+		}
+	}
+}
+
+// cacheKey returns the key of a step executed on the current builder. The content hashes cover
+// what the step reads besides the builder, like the sources of ADD and COPY.
+func (b *Executor) cacheKey(expression string, contentHashes ...string) (string, error) {
+	ctr, err := b.store.Container(b.builders.ContainerID)
+	if err != nil {
+		return "", err
+	}
+	state := cacheState{
+		Env:     b.builders.Env,
+		Workdir: b.builders.Workdir,
+		User:    b.builders.User,
+		Shell:   b.builders.Shell,
+		Args:    b.args,
+		Format:  b.format,
+	}
+	if b.timestamp != nil {
+		epoch := b.timestamp.Unix()
+		state.Timestamp = &epoch
+	}
+	encoded, err := json.Marshal(state)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	parts := append([]string{ctr.ImageID, expression, string(encoded)}, contentHashes...)
+	for _, part := range parts {
+		fmt.Fprintf(h, "%d:%s\n", len(part), part)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// fromCache continues the build from the image of a previous step with the same key. It reports
+// whether such an image was found.
+func (b *Executor) fromCache(key string) (bool, error) {
+	if b.noCache {
+		b.progress.cache(b.step, "", false)
+		return false, nil
+	}
+	img, err := b.store.Image(key)
+	if err != nil {
+		if !errors.Is(err, storage.ErrImageUnknown) {
+			logrus.Debugf("cache lookup of %s failed: %s", key, err)
+		}
+		b.progress.cache(b.step, "", false)
+		return false, nil
+	}
+	if err := b.builders.rebase(img.ID); err != nil {
+		return false, err
+	}
+	if err := b.builders.loadHistory(img.ID); err != nil {
+		b.log.Warnf("unable to read the history of %s: %s", shortID(img.ID), err)
+	}
+	b.progress.cache(b.step, img.ID, true)
+	return true, nil
+}
+
+// commitStep commits the changes of a step to an intermediate image and moves the builder on
+// top of it. With --no-cache the image gets a random ID so it is never found by a lookup, it is
+// removed with the stages.
+func (b *Executor) commitStep(key string) error {
+	if b.noCache {
+		key = ""
+	}
+	img, err := b.builders.commitImage(key, nil)
+	if err != nil {
+		return fmt.Errorf("error committing step: %w", err)
+	}
+	if b.noCache {
+		b.stepImages = append(b.stepImages, img.ID)
+	}
+	if err := b.builders.rebase(img.ID); err != nil {
+		return err
+	}
+	layer, err := b.store.Layer(img.TopLayer)
+	if err != nil {
+		return err
+	}
+	b.progress.layer(b.step, img.ID, layer.UncompressedDigest.String(), layer.UncompressedSize)
+	return nil
+}
+
+// hashSources returns a digest over the names, modes and contents of the ADD and COPY sources.
+// Paths excluded by the filter do not contribute to the digest.
+func hashSources(sources []string, filter *contextFilter) (string, error) {
+	h := sha256.New()
+	for _, src := range sources {
+		base := filepath.Dir(src)
+		err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if path != src {
+				excluded, err := filter.excluded(path)
+				if err != nil {
+					return err
+				}
+				if excluded {
+					if info.IsDir() && filter.skipDir(path) {
+						return filepath.SkipDir
+					}
+					return nil
+				}
+			}
+			rel, err := filepath.Rel(base, path)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(h, "%s %o %d\n", rel, info.Mode(), info.Size())
+			switch {
+			case info.Mode()&os.ModeSymlink != 0:
+				target, err := os.Readlink(path)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(h, "-> %s\n", target)
+			case info.Mode().IsRegular():
+				f, err := os.Open(path)
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				if _, err := io.Copy(h, f); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func shortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
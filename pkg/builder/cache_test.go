@@ -0,0 +1,201 @@
+package builder
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gitee.com/openeuler/ktib/pkg/options"
+)
+
+func TestHashSources(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hash := func(sources ...string) string {
+		var paths []string
+		for _, src := range sources {
+			paths = append(paths, filepath.Join(dir, src))
+		}
+		h, err := hashSources(paths, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+
+	write("app/main.go", "package main")
+	write("app/conf/app.yaml", "debug: false")
+	first := hash("app")
+	if first != hash("app") {
+		t.Errorf("hashSources() is not stable")
+	}
+
+	write("app/conf/app.yaml", "debug: true")
+	changed := hash("app")
+	if changed == first {
+		t.Errorf("hashSources() did not change with the file content")
+	}
+
+	if err := os.Chmod(filepath.Join(dir, "app/main.go"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if hash("app") == changed {
+		t.Errorf("hashSources() did not change with the file mode")
+	}
+
+	write("app/main_test.go", "package main")
+	if hash("app/main.go") == hash("app/main_test.go") {
+		t.Errorf("hashSources() should include the name of a single file source")
+	}
+
+	if _, err := hashSources([]string{filepath.Join(dir, "missing")}, nil); err == nil {
+		t.Errorf("hashSources() expected an error for a missing source")
+	}
+}
+
+func TestCacheKeyTimestamp(t *testing.T) {
+	store := newTestStore(t)
+	contextDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(contextDir, "hello.txt"), []byte("hello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dockerfile := filepath.Join(contextDir, "Dockerfile")
+	if err := os.WriteFile(dockerfile, []byte("FROM scratch\nCOPY hello.txt /hello.txt\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	build := func(timestamp *time.Time) string {
+		var out bytes.Buffer
+		op := &options.BuildOptions{
+			Tags:             "timestamp-test",
+			ContextDirectory: contextDir,
+			Timestamp:        timestamp,
+			Rm:               true,
+			Out:              &out,
+			Err:              &out,
+		}
+		imageID, err := buildDockerfiles(context.Background(), store, op, nil, dockerfile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if timestamp != nil && strings.Contains(out.String(), "Using cache") {
+			t.Errorf("reproducible build used the cache of a normal build: %q", out.String())
+		}
+		img, err := store.Image(imageID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		layer, err := store.Layer(img.TopLayer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return layer.UncompressedDigest.String()
+	}
+	normal := build(nil)
+	epoch := time.Unix(1700000000, 0)
+	if reproducible := build(&epoch); reproducible == normal {
+		t.Errorf("the layer of the reproducible build is the one of the normal build: %s", normal)
+	}
+}
+
+func TestHashMounts(t *testing.T) {
+	store := newTestStore(t)
+	contextDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(contextDir, "go.sum"), []byte("a\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	stage, err := NewBuilder(store, BuilderOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, err := NewBuilder(store, BuilderOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &Executor{store: store, contextDir: contextDir, stages: map[string]*Builder{"deps": stage}, builders: current}
+	hash := func(values ...string) string {
+		t.Helper()
+		h, err := e.hashMounts(values)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+
+	fromContext := hash("type=bind,source=go.sum,target=/src/go.sum")
+	if err := os.WriteFile(filepath.Join(contextDir, "go.sum"), []byte("b\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if hash("type=bind,source=go.sum,target=/src/go.sum") == fromContext {
+		t.Error("hashMounts() did not change with the content of a context source")
+	}
+
+	fromStage := hash("type=bind,from=deps,target=/deps")
+	img, err := stage.commitImage("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stage.rebase(img.ID); err != nil {
+		t.Fatal(err)
+	}
+	if hash("type=bind,from=deps,target=/deps") == fromStage {
+		t.Error("hashMounts() did not change with the image of the stage")
+	}
+	if hash("type=bind,from="+img.ID+",target=/deps") != hash("type=bind,from="+img.ID+",target=/deps") {
+		t.Error("hashMounts() of an image is not stable")
+	}
+
+	if hash("type=cache,target=/root/.cache") != hash() {
+		t.Error("hashMounts() changed with a cache mount")
+	}
+	if _, err := e.hashMounts([]string{"type=bind,from=missing,target=/x"}); err == nil {
+		t.Error("hashMounts() with an unknown stage succeeded")
+	}
+}
+
+func TestBuildNoCache(t *testing.T) {
+	store := newTestStore(t)
+	contextDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(contextDir, "hello.txt"), []byte("hello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dockerfile := filepath.Join(contextDir, "Dockerfile")
+	if err := os.WriteFile(dockerfile, []byte("FROM scratch\nCOPY hello.txt /hello.txt\nCOPY hello.txt /again.txt\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	op := &options.BuildOptions{
+		Tags:             "no-cache-test",
+		ContextDirectory: contextDir,
+		NoCache:          true,
+		Rm:               true,
+		Out:              &out,
+		Err:              &out,
+	}
+	imageID, err := buildDockerfiles(context.Background(), store, op, nil, dockerfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	images, err := store.Images()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 1 || images[0].ID != imageID {
+		t.Errorf("images after a build without the cache = %d, want only the image %s", len(images), imageID)
+	}
+	layers, err := layerChain(store, images[0].TopLayer)
+	if err != nil || len(layers) != 2 {
+		t.Errorf("layers of the image = %v, %v, want one per step", layers, err)
+	}
+}
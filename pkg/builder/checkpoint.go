@@ -0,0 +1,146 @@
+/*
+   Copyright (c) 2023 KylinSoft Co., Ltd.
+   Kylin trusted image builder(ktib) is licensed under Mulan PSL v2.
+   You can use this software according to the terms and conditions of the Mulan PSL v2.
+   You may obtain a copy of Mulan PSL v2 at:
+            http://license.coscl.org.cn/MulanPSL2
+   THIS SOFTWARE IS PROVIDED ON AN "AS IS" BASIS, WITHOUT WARRANTIES OF ANY KIND, EITHER EXPRESS OR IMPLIED, INCLUDING
+   BUT NOT LIMITED TO NON-INFRINGEMENT, MERCHANTABILITY OR FIT FOR A PARTICULAR PURPOSE.
+   See the Mulan PSL v2 for more details.
+*/
+
+package builder
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"strconv"
+)
+
+// BuildCheckpoint is the progress of the build that created a builder. It is saved with the
+// builder of the current stage after every successful step, so that a failed build can be resumed
+// from the step that failed once the Dockerfile is fixed.
+type BuildCheckpoint struct {
+	// Dockerfile is the file that was built, Step the number of its last successful step and
+	// Instructions the digests of the steps up to it, a resumed build may only change later steps
+	Dockerfile   string
+	Step         int
+	Instructions []string
+	BuildArgs    map[string]string
+	// the state of the build between the steps
+	Args        map[string]string
+	GlobalArgs  map[string]string
+	UsedArgs    map[string]bool
+	StageName   string
+	CmdSet      bool
+	Stages      []checkpointStage
+	StageImages []string
+}
+
+// checkpointStage is the builder of a stage, the last one is the builder of the checkpoint.
+type checkpointStage struct {
+	Name        string
+	ContainerID string
+}
+
+// instructionDigest identifies a step of a Dockerfile by its text.
+func instructionDigest(line string) string {
+	sum := sha256.Sum256([]byte(line))
+	return hex.EncodeToString(sum[:])
+}
+
+// checkpoint records that step, the instruction line of dockerfile, succeeded and saves the
+// progress of the build with the current builder.
+func (b *Executor) checkpoint(dockerfile string, step int, line string) error {
+	b.instructions = append(b.instructions[:step-1], instructionDigest(line))
+	if b.builders == nil {
+		// an ARG before the first FROM, it is saved with the builder of the first stage
+		return nil
+	}
+	var stages []checkpointStage
+	for i, stage := range b.stageList {
+		name := ""
+		for key, s := range b.stages {
+			if s == stage && key != strconv.Itoa(i) {
+				name = key
+			}
+		}
+		stages = append(stages, checkpointStage{Name: name, ContainerID: stage.ContainerID})
+	}
+	b.builders.Checkpoint = &BuildCheckpoint{
+		Dockerfile:   dockerfile,
+		Step:         step,
+		Instructions: append([]string{}, b.instructions...),
+		BuildArgs:    b.buildArgs,
+		Args:         b.args,
+		GlobalArgs:   b.globalArgs,
+		UsedArgs:     b.usedArgs,
+		StageName:    b.stageName,
+		CmdSet:       b.cmdSet,
+		Stages:       stages,
+		StageImages:  b.stageImages,
+	}
+	return b.builders.Save()
+}
+
+// resume continues the build of dockerfile, whose steps are lines, from the checkpoint of the
+// builder name. The changes the failed step left in the builder are dropped. It returns the
+// number of steps that were done already.
+func (b *Executor) resume(name, dockerfile string, lines []string) (int, error) {
+	builder, err := FindBuilder(b.store, name)
+	if err != nil {
+		return 0, err
+	}
+	cp := builder.Checkpoint
+	if cp == nil {
+		return 0, fmt.Errorf("builder %s has no build to resume", name)
+	}
+	if cp.Dockerfile != dockerfile {
+		return 0, fmt.Errorf("builder %s was built from %s, not from %s", name, cp.Dockerfile, dockerfile)
+	}
+	if len(lines) < cp.Step {
+		return 0, fmt.Errorf("%s has %d steps, builder %s has done %d of them", dockerfile, len(lines), name, cp.Step)
+	}
+	for i := 0; i < cp.Step; i++ {
+		if instructionDigest(lines[i]) != cp.Instructions[i] {
+			return 0, fmt.Errorf("step %d %q has changed, only the steps after step %d can change when resuming", i+1, lines[i], cp.Step)
+		}
+	}
+	if (len(cp.BuildArgs) > 0 || len(b.buildArgs) > 0) && !reflect.DeepEqual(cp.BuildArgs, b.buildArgs) {
+		return 0, fmt.Errorf("the build args differ from the ones of the build of builder %s", name)
+	}
+	if len(cp.Stages) == 0 || cp.Stages[len(cp.Stages)-1].ContainerID != builder.ContainerID {
+		return 0, fmt.Errorf("the checkpoint of builder %s is not the one of its last stage", name)
+	}
+	ctr, err := b.store.Container(builder.ContainerID)
+	if err != nil {
+		return 0, err
+	}
+	if err := builder.rebase(ctr.ImageID); err != nil {
+		return 0, fmt.Errorf("error dropping the changes of the failed step: %w", err)
+	}
+	for i, s := range cp.Stages {
+		stage := builder
+		if i < len(cp.Stages)-1 {
+			if stage, err = FindBuilder(b.store, s.ContainerID); err != nil {
+				return 0, fmt.Errorf("error finding the builder of stage %d: %w", i, err)
+			}
+		}
+		if err := b.startStage(s.Name, stage); err != nil {
+			return 0, err
+		}
+	}
+	b.args = copyStringMap(cp.Args)
+	b.globalArgs = copyStringMap(cp.GlobalArgs)
+	b.usedArgs = make(map[string]bool)
+	for arg, used := range cp.UsedArgs {
+		b.usedArgs[arg] = used
+	}
+	b.stageName = cp.StageName
+	b.cmdSet = cp.CmdSet
+	b.stageImages = cp.StageImages
+	b.instructions = cp.Instructions
+	return cp.Step, nil
+}
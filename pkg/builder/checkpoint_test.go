@@ -0,0 +1,170 @@
+package builder
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gitee.com/openeuler/ktib/pkg/options"
+)
+
+func TestResumeBuild(t *testing.T) {
+	store := newTestStore(t)
+	contextDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(contextDir, "hello.txt"), []byte("hello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dockerfile := filepath.Join(contextDir, "Dockerfile")
+	steps := []string{
+		"ARG BASE=scratch",
+		"FROM $BASE AS base",
+		"COPY hello.txt /hello.txt",
+		"FROM scratch",
+		"ENV A=1",
+		"COPY --from=base /hello.txt /from-base.txt",
+	}
+	build := func(last, resume string, keep bool) (string, error) {
+		content := strings.Join(append(append([]string{}, steps...), last), "\n") + "\n"
+		if err := os.WriteFile(dockerfile, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		var out bytes.Buffer
+		op := &options.BuildOptions{
+			Tags:             "resume-test",
+			ContextDirectory: contextDir,
+			Rm:               true,
+			Resume:           resume,
+			KeepOnFailure:    keep,
+			Out:              &out,
+			Err:              &out,
+		}
+		err := BuildDockerfiles(context.Background(), store, op, dockerfile)
+		return out.String(), err
+	}
+
+	if _, err := build("COPY missing /missing", "", false); err == nil {
+		t.Fatal("build with a missing source succeeded")
+	}
+	builders, err := ListBuilders(store, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(builders) != 2 {
+		t.Fatalf("%d builders are left after the failed build, want 2", len(builders))
+	}
+	var failed *Builder
+	for _, c := range builders {
+		if c.Builder.Checkpoint != nil && c.Builder.Checkpoint.Step == len(steps) {
+			failed = c.Builder
+		}
+	}
+	if failed == nil {
+		t.Fatalf("no builder has a checkpoint after step %d", len(steps))
+	}
+
+	// the steps up to the checkpoint must not change
+	steps[4] = "ENV A=2"
+	if _, err := build("COPY hello.txt /fixed.txt", failed.ContainerID, false); err == nil || !strings.Contains(err.Error(), "has changed") {
+		t.Fatalf("resume with a changed step error = %v", err)
+	}
+	steps[4] = "ENV A=1"
+
+	out, err := build("COPY hello.txt /fixed.txt", failed.ContainerID, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "after step 6") || strings.Contains(out, "Step 6 :") || !strings.Contains(out, "Step 7 : COPY hello.txt /fixed.txt") {
+		t.Errorf("resumed build output = %q", out)
+	}
+	if _, err := store.Image("docker.io/library/resume-test:latest"); err != nil {
+		t.Errorf("resumed build has no image: %v", err)
+	}
+	if builders, err := ListBuilders(store, false, nil); err != nil || len(builders) != 0 {
+		t.Errorf("builders after the resumed build = %v, %v", builders, err)
+	}
+
+	if _, err := build("COPY missing /missing", "", true); err == nil {
+		t.Fatal("build with a missing source succeeded")
+	}
+	builders, err = ListBuilders(store, false, []string{"mounted=true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(builders) != 1 {
+		t.Fatalf("%d builders are mounted with --keep-on-failure, want 1", len(builders))
+	}
+	if _, err := store.Unmount(builders[0].Container.ID, true); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUnsupportedDirective(t *testing.T) {
+	store := newTestStore(t)
+	contextDir := t.TempDir()
+	dockerfile := filepath.Join(contextDir, "Dockerfile")
+	if err := os.WriteFile(dockerfile, []byte("FROM scratch\nENV A=1\nUNKNOWN a\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	op := &options.BuildOptions{
+		Tags:             "unsupported-test",
+		ContextDirectory: contextDir,
+		Rm:               true,
+		Out:              &out,
+		Err:              &out,
+	}
+	err := BuildDockerfiles(context.Background(), store, op, dockerfile)
+	if err == nil || !strings.Contains(err.Error(), "Unsupported Dockerfile directive: UNKNOWN") {
+		t.Fatalf("build error = %v", err)
+	}
+	// the builder of the failed build is kept like on any other failure, it can be resumed
+	builders, err := ListBuilders(store, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(builders) != 1 || builders[0].Builder.Checkpoint == nil {
+		t.Fatalf("builders after the failed build = %v, want 1 resumable builder", builders)
+	}
+}
+
+func TestTargetNotFound(t *testing.T) {
+	for _, keep := range []bool{false, true} {
+		t.Run(fmt.Sprintf("keep-on-failure=%v", keep), func(t *testing.T) {
+			store := newTestStore(t)
+			contextDir := t.TempDir()
+			dockerfile := filepath.Join(contextDir, "Dockerfile")
+			if err := os.WriteFile(dockerfile, []byte("FROM scratch AS base\nENV A=1\nFROM base\nENV B=2\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			var out bytes.Buffer
+			op := &options.BuildOptions{
+				Tags:             "target-test",
+				ContextDirectory: contextDir,
+				Target:           "missing",
+				Rm:               true,
+				KeepOnFailure:    keep,
+				Out:              &out,
+				Err:              &out,
+			}
+			err := BuildDockerfiles(context.Background(), store, op, dockerfile)
+			if err == nil || !strings.Contains(err.Error(), `target stage "missing" could not be found`) {
+				t.Fatalf("build error = %v", err)
+			}
+			// the builders are removed, there is nothing to resume or to keep mounted
+			if strings.Contains(out.String(), "--resume") {
+				t.Errorf("build output offers to resume a removed builder: %q", out.String())
+			}
+			containers, err := store.Containers()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(containers) != 0 {
+				t.Errorf("%d containers are left after the build", len(containers))
+			}
+		})
+	}
+}
@@ -0,0 +1,262 @@
+/*
+   Copyright (c) 2023 KylinSoft Co., Ltd.
+   Kylin trusted image builder(ktib) is licensed under Mulan PSL v2.
+   You can use this software according to the terms and conditions of the Mulan PSL v2.
+   You may obtain a copy of Mulan PSL v2 at:
+            http://license.coscl.org.cn/MulanPSL2
+   THIS SOFTWARE IS PROVIDED ON AN "AS IS" BASIS, WITHOUT WARRANTIES OF ANY KIND, EITHER EXPRESS OR IMPLIED, INCLUDING
+   BUT NOT LIMITED TO NON-INFRINGEMENT, MERCHANTABILITY OR FIT FOR A PARTICULAR PURPOSE.
+   See the Mulan PSL v2 for more details.
+*/
+
+package builder
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"gitee.com/openeuler/ktib/pkg/imagemanager"
+	"github.com/containers/image/v5/copy"
+	v5manifest "github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/signature"
+	is "github.com/containers/image/v5/storage"
+	"github.com/containers/image/v5/transports"
+	"github.com/containers/image/v5/transports/alltransports"
+	"github.com/containers/image/v5/types"
+	"github.com/containers/storage"
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// FormatOCI writes an OCI image manifest, the default.
+	FormatOCI = "oci"
+	// FormatDocker writes a Docker schema2 manifest.
+	FormatDocker = "docker"
+)
+
+// ValidateFormat checks a --format value, an empty value selects FormatOCI.
+func ValidateFormat(format string) error {
+	switch format {
+	case "", FormatOCI, FormatDocker:
+		return nil
+	}
+	return fmt.Errorf("unsupported image format %q, use %q or %q", format, FormatOCI, FormatDocker)
+}
+
+// imageLayer describes one layer of the rootfs of a committed image.
+type imageLayer struct {
+	DiffID digest.Digest
+	Size   int64
+}
+
+// layerChain returns the layers from the bottom of the store up to and including top.
+func layerChain(store storage.Store, top string) ([]imageLayer, error) {
+	var layers []imageLayer
+	for id := top; id != ""; {
+		layer, err := store.Layer(id)
+		if err != nil {
+			return nil, err
+		}
+		if layer.UncompressedDigest == "" {
+			return nil, fmt.Errorf("layer %s has no known digest", id)
+		}
+		layers = append([]imageLayer{{DiffID: layer.UncompressedDigest, Size: layer.UncompressedSize}}, layers...)
+		id = layer.Parent
+	}
+	return layers, nil
+}
+
+// appendHistory records a step of the builder in the image history. emptyLayer marks a step
+// that only changed the configuration.
+func (b *Builder) appendHistory(created time.Time, createdBy string, emptyLayer bool) {
+	b.OCIv1.History = append(b.OCIv1.History, v1.History{
+		Created:    &created,
+		CreatedBy:  createdBy,
+		Author:     b.OCIv1.Author,
+		Comment:    b.Message,
+		EmptyLayer: emptyLayer,
+	})
+}
+
+// imageManifest is the content written to the store for a committed image.
+type imageManifest struct {
+	manifest     []byte
+	ociConfig    []byte
+	dockerConfig []byte
+}
+
+// buildManifest completes the OCI and docker configurations of the builder for an image with
+// the given layers and returns them with the manifest in the format of the builder. The
+// manifest refers to the configuration of its own format, the other one is written too so
+// that the image can be exported in either format.
+func (b *Builder) buildManifest(created time.Time, layers []imageLayer) (*imageManifest, error) {
+	b.updateConfig()
+	diffIDs := make([]digest.Digest, 0, len(layers))
+	for _, layer := range layers {
+		diffIDs = append(diffIDs, layer.DiffID)
+	}
+	b.OCIv1.Created = &created
+	b.OCIv1.RootFS = v1.RootFS{Type: "layers", DiffIDs: diffIDs}
+	b.DockerV2.Created = created
+	// the base image identifies itself in these fields, they do not describe the new image, and
+	// the random ID of the container would make every build differ
+	b.DockerV2.ID, b.DockerV2.Parent, b.DockerV2.Schema2V1Image.Parent = "", "", ""
+	b.DockerV2.Container = ""
+	b.DockerV2.ContainerConfig = v5manifest.Schema2Config{}
+	b.DockerV2.RootFS = &v5manifest.Schema2RootFS{Type: "layers", DiffIDs: diffIDs}
+	b.DockerV2.History = nil
+	for _, h := range b.OCIv1.History {
+		entry := v5manifest.Schema2History{
+			CreatedBy:  h.CreatedBy,
+			Author:     h.Author,
+			Comment:    h.Comment,
+			EmptyLayer: h.EmptyLayer,
+		}
+		if h.Created != nil {
+			entry.Created = *h.Created
+		}
+		b.DockerV2.History = append(b.DockerV2.History, entry)
+	}
+
+	var m imageManifest
+	var err error
+	if m.ociConfig, err = json.Marshal(b.OCIv1); err != nil {
+		return nil, err
+	}
+	if m.dockerConfig, err = json.Marshal(b.DockerV2); err != nil {
+		return nil, err
+	}
+	if b.Format == FormatDocker {
+		var descriptors []v5manifest.Schema2Descriptor
+		for _, layer := range layers {
+			descriptors = append(descriptors, v5manifest.Schema2Descriptor{
+				MediaType: v5manifest.DockerV2SchemaLayerMediaTypeUncompressed,
+				Digest:    layer.DiffID,
+				Size:      layer.Size,
+			})
+		}
+		config := v5manifest.Schema2Descriptor{
+			MediaType: v5manifest.DockerV2Schema2ConfigMediaType,
+			Digest:    digest.FromBytes(m.dockerConfig),
+			Size:      int64(len(m.dockerConfig)),
+		}
+		m.manifest, err = v5manifest.Schema2FromComponents(config, descriptors).Serialize()
+		return &m, err
+	}
+	descriptors := []v1.Descriptor{}
+	for _, layer := range layers {
+		descriptors = append(descriptors, v1.Descriptor{
+			MediaType: v1.MediaTypeImageLayer,
+			Digest:    layer.DiffID,
+			Size:      layer.Size,
+		})
+	}
+	m.manifest, err = json.Marshal(v1.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: v1.MediaTypeImageManifest,
+		Config: v1.Descriptor{
+			MediaType: v1.MediaTypeImageConfig,
+			Digest:    digest.FromBytes(m.ociConfig),
+			Size:      int64(len(m.ociConfig)),
+		},
+		Layers:      descriptors,
+		Annotations: copyStringMap(b.Annotations),
+	})
+	return &m, err
+}
+
+// writeManifest stores the manifest and the configurations as big data of the image, under
+// the keys the containers-storage transport of containers/image reads them from.
+func writeManifest(store storage.Store, imageID string, m *imageManifest) error {
+	manifestDigest, err := v5manifest.Digest(m.manifest)
+	if err != nil {
+		return err
+	}
+	for _, item := range []struct {
+		key  string
+		data []byte
+	}{
+		{digest.FromBytes(m.ociConfig).String(), m.ociConfig},
+		{digest.FromBytes(m.dockerConfig).String(), m.dockerConfig},
+		{storage.ImageDigestManifestBigDataNamePrefix + "-" + manifestDigest.String(), m.manifest},
+		{storage.ImageDigestBigDataKey, m.manifest},
+	} {
+		if err := store.SetImageBigData(imageID, item.key, item.data, v5manifest.Digest); err != nil {
+			return fmt.Errorf("error saving %s of image %s: %w", item.key, imageID, err)
+		}
+	}
+	return nil
+}
+
+// exportReference parses the destination of a commit. A name without a transport names an image
+// of the local store, any other transport known to alltransports, like oci-archive:, docker-archive:,
+// oci: or dir:, writes the image there instead. Images of the local store are looked up in store,
+// the transport would otherwise open the default store of the process.
+func exportReference(store storage.Store, exportTo string) (types.ImageReference, error) {
+	if i := strings.Index(exportTo, ":"); i > 0 && transports.Get(exportTo[:i]) != nil && exportTo[:i+1] != defaultTransport {
+		return alltransports.ParseImageName(exportTo)
+	}
+	ref, err := is.Transport.ParseStoreReference(store, strings.TrimPrefix(exportTo, defaultTransport))
+	if err != nil {
+		return nil, err
+	}
+	return ref, nil
+}
+
+// exportImage commits the builder and copies the image to dest, which is not the local store.
+// The layers are written to the store for the copy, the image is removed again afterwards. The
+// returned ID is the digest of the configuration of the written image, as it has no ID in the store.
+func (b *Builder) exportImage(dest types.ImageReference) (string, error) {
+	compression, err := imagemanager.CompressionCopyOptions(b.Compression)
+	if err != nil {
+		return "", err
+	}
+	if compression.CompressionFormat != nil && dest.Transport().Name() == "docker-archive" {
+		return "", fmt.Errorf("docker-archive does not support compressed layers, use oci-archive, oci or dir")
+	}
+	img, err := b.commitImage("", nil)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if _, err := b.Store.DeleteImage(img.ID, true); err != nil {
+			b.logger().Warnf("unable to remove temporary image %s: %s", img.ID, err)
+		}
+	}()
+	src, err := is.Transport.NewStoreReference(b.Store, nil, img.ID)
+	if err != nil {
+		return "", err
+	}
+	// the source is the image just committed, no signature of it has to be checked
+	policy, err := signature.NewPolicyContext(&signature.Policy{
+		Default: []signature.PolicyRequirement{signature.NewPRInsecureAcceptAnything()},
+	})
+	if err != nil {
+		return "", err
+	}
+	defer policy.Destroy()
+	copyOptions := &copy.Options{
+		DestinationCtx: &types.SystemContext{
+			CompressionFormat: compression.CompressionFormat,
+			CompressionLevel:  compression.CompressionLevel,
+			DirForceCompress:  compression.DirForceCompress,
+		},
+		ForceCompressionFormat: compression.ForceCompressionFormat,
+	}
+	written, err := copy.Image(context.Background(), policy, dest, src, copyOptions)
+	if err != nil {
+		return "", fmt.Errorf("error writing image to %s: %w", transports.ImageName(dest), err)
+	}
+	logrus.Infof("write image %s to %s successful", img.ID, transports.ImageName(dest))
+	m, err := v5manifest.FromBlob(written, v5manifest.GuessMIMEType(written))
+	if err != nil {
+		return "", err
+	}
+	return m.ConfigInfo().Digest.Encoded(), nil
+}
@@ -0,0 +1,120 @@
+package builder
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	v5manifest "github.com/containers/image/v5/manifest"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestBuildManifest(t *testing.T) {
+	created := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	layers := []imageLayer{
+		{DiffID: digest.FromString("base"), Size: 10},
+		{DiffID: digest.FromString("step"), Size: 20},
+	}
+	for _, format := range []string{FormatOCI, FormatDocker} {
+		t.Run(format, func(t *testing.T) {
+			b := &Builder{
+				Format:     format,
+				Maintainer: "ktib",
+				Env:        []string{"PATH=/usr/bin"},
+				Cmd:        []string{"/bin/sh"},
+				Workdir:    "/app",
+				User:       "1001",
+				Labels:     map[string]string{"a": "b"},
+			}
+			b.appendHistory(created, "/bin/sh -c make", false)
+			b.appendHistory(created, nopPrefix+"CMD /bin/sh", true)
+			m, err := b.buildManifest(created, layers)
+			if err != nil {
+				t.Fatal(err)
+			}
+			mediaType := v5manifest.GuessMIMEType(m.manifest)
+			configBlob := m.ociConfig
+			want := v1.MediaTypeImageManifest
+			if format == FormatDocker {
+				configBlob = m.dockerConfig
+				want = v5manifest.DockerV2Schema2MediaType
+			}
+			if mediaType != want {
+				t.Fatalf("manifest type = %s, want %s", mediaType, want)
+			}
+			parsed, err := v5manifest.FromBlob(m.manifest, mediaType)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if parsed.ConfigInfo().Digest != digest.FromBytes(configBlob) {
+				t.Errorf("config digest = %s, want %s", parsed.ConfigInfo().Digest, digest.FromBytes(configBlob))
+			}
+			if got := len(parsed.LayerInfos()); got != len(layers) {
+				t.Errorf("manifest has %d layers, want %d", got, len(layers))
+			}
+
+			var config v1.Image
+			if err := json.Unmarshal(m.ociConfig, &config); err != nil {
+				t.Fatal(err)
+			}
+			if len(config.RootFS.DiffIDs) != 2 || config.RootFS.DiffIDs[1] != layers[1].DiffID {
+				t.Errorf("diff_ids = %v", config.RootFS.DiffIDs)
+			}
+			if config.Created == nil || !config.Created.Equal(created) {
+				t.Errorf("created = %v, want %v", config.Created, created)
+			}
+			if config.Author != "ktib" || config.Config.WorkingDir != "/app" || config.Config.User != "1001" {
+				t.Errorf("config = %+v", config)
+			}
+			if len(config.History) != 2 || !config.History[1].EmptyLayer || config.History[0].EmptyLayer {
+				t.Errorf("history = %+v", config.History)
+			}
+
+			var docker v5manifest.Schema2Image
+			if err := json.Unmarshal(m.dockerConfig, &docker); err != nil {
+				t.Fatal(err)
+			}
+			if len(docker.History) != 2 || docker.History[0].CreatedBy != "/bin/sh -c make" || !docker.History[1].EmptyLayer {
+				t.Errorf("docker history = %+v", docker.History)
+			}
+			if docker.RootFS == nil || len(docker.RootFS.DiffIDs) != 2 {
+				t.Errorf("docker rootfs = %+v", docker.RootFS)
+			}
+		})
+	}
+}
+
+func TestValidateFormat(t *testing.T) {
+	for format, ok := range map[string]bool{"": true, FormatOCI: true, FormatDocker: true, "v2s1": false} {
+		if err := ValidateFormat(format); (err == nil) != ok {
+			t.Errorf("ValidateFormat(%q) = %v", format, err)
+		}
+	}
+}
+
+func TestExportReference(t *testing.T) {
+	store := newTestStore(t)
+	dir := t.TempDir()
+	tests := []struct {
+		exportTo  string
+		transport string
+	}{
+		{exportTo: "oci-archive:" + dir + "/img.tar", transport: "oci-archive"},
+		{exportTo: "docker-archive:" + dir + "/img.tar:myimage:v1", transport: "docker-archive"},
+		{exportTo: "oci:" + dir + "/layout:v1", transport: "oci"},
+		{exportTo: "dir:" + dir + "/img", transport: "dir"},
+		{exportTo: "myimage:v1", transport: "containers-storage"},
+		{exportTo: "containers-storage:myimage:v1", transport: "containers-storage"},
+	}
+	for _, tt := range tests {
+		ref, err := exportReference(store, tt.exportTo)
+		if err != nil {
+			t.Errorf("exportReference(%q) error = %v", tt.exportTo, err)
+			continue
+		}
+		if ref.Transport().Name() != tt.transport {
+			t.Errorf("exportReference(%q) transport = %s, want %s", tt.exportTo, ref.Transport().Name(), tt.transport)
+		}
+	}
+}
@@ -0,0 +1,291 @@
+/*
+   Copyright (c) 2023 KylinSoft Co., Ltd.
+   Kylin trusted image builder(ktib) is licensed under Mulan PSL v2.
+   You can use this software according to the terms and conditions of the Mulan PSL v2.
+   You may obtain a copy of Mulan PSL v2 at:
+            http://license.coscl.org.cn/MulanPSL2
+   THIS SOFTWARE IS PROVIDED ON AN "AS IS" BASIS, WITHOUT WARRANTIES OF ANY KIND, EITHER EXPRESS OR IMPLIED, INCLUDING
+   BUT NOT LIMITED TO NON-INFRINGEMENT, MERCHANTABILITY OR FIT FOR A PARTICULAR PURPOSE.
+   See the Mulan PSL v2 for more details.
+*/
+
+package builder
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"gitee.com/openeuler/ktib/pkg/options"
+	v5manifest "github.com/containers/image/v5/manifest"
+	is "github.com/containers/image/v5/storage"
+	"github.com/containers/image/v5/types"
+	"github.com/containers/storage"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// readImageConfig returns the OCI configuration of an image in the store together with the
+// raw configuration blob, which is the docker format for images that were written that way.
+func readImageConfig(store storage.Store, imageID string) (*v1.Image, []byte, error) {
+	ctx := context.Background()
+	ref, err := is.Transport.NewStoreReference(store, nil, imageID)
+	if err != nil {
+		return nil, nil, err
+	}
+	img, err := ref.NewImage(ctx, &types.SystemContext{})
+	if err != nil {
+		return nil, nil, err
+	}
+	defer img.Close()
+	config, err := img.OCIConfig(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	blob, err := img.ConfigBlob(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	return config, blob, nil
+}
+
+// loadBaseConfig reads the configuration of the image the builder was created from, so that the
+// values set by the base image are inherited the same way a Dockerfile FROM does.
+func (b *Builder) loadBaseConfig() error {
+	config, blob, err := readImageConfig(b.Store, b.FromImageID)
+	if err != nil {
+		return err
+	}
+	b.OCIv1 = *config
+	// HEALTHCHECK and SHELL only exist in the docker format, so keep whatever the base provides.
+	_ = json.Unmarshal(blob, &b.DockerV2)
+
+	b.Env = append([]string{}, config.Config.Env...)
+	b.Workdir = config.Config.WorkingDir
+	b.User = config.Config.User
+	b.StopSignal = config.Config.StopSignal
+	b.EntryPoint = config.Config.Entrypoint
+	b.Cmd = config.Config.Cmd
+	for k, v := range config.Config.Labels {
+		b.AddLabel(k, v)
+	}
+	for port := range config.Config.ExposedPorts {
+		b.AddPort(port)
+	}
+	for volume := range config.Config.Volumes {
+		b.AddVolume(volume)
+	}
+	if b.DockerV2.Config != nil {
+		b.Healthcheck = b.DockerV2.Config.Healthcheck
+		b.Shell = b.DockerV2.Config.Shell
+	}
+	return nil
+}
+
+// updateConfig copies the builder settings into the OCI and docker image configurations that
+// are written when the builder is committed.
+func (b *Builder) updateConfig() {
+	oc := &b.OCIv1.Config
+	oc.Env = append([]string{}, b.Env...)
+	oc.WorkingDir = b.Workdir
+	oc.User = b.User
+	oc.StopSignal = b.StopSignal
+	oc.Labels = copyStringMap(b.Labels)
+	oc.ExposedPorts = copySet(b.ExposedPorts)
+	oc.Volumes = copySet(b.Volumes)
+	oc.Entrypoint = copyStrings(b.EntryPoint)
+	oc.Cmd = copyStrings(b.Cmd)
+	if b.Maintainer != "" {
+		b.OCIv1.Author = b.Maintainer
+	}
+	b.OCIv1.Architecture, b.OCIv1.OS = defaultPlatform(b.OCIv1.Architecture, b.OCIv1.OS)
+
+	dc := b.DockerV2.Config
+	if dc == nil {
+		dc = &v5manifest.Schema2Config{}
+		b.DockerV2.Config = dc
+	}
+	dc.Env = oc.Env
+	dc.WorkingDir = oc.WorkingDir
+	dc.User = oc.User
+	dc.StopSignal = oc.StopSignal
+	dc.Labels = oc.Labels
+	dc.Entrypoint = oc.Entrypoint
+	dc.Cmd = oc.Cmd
+	dc.Volumes = oc.Volumes
+	dc.ExposedPorts = v5manifest.Schema2PortSet{}
+	for port := range oc.ExposedPorts {
+		dc.ExposedPorts[v5manifest.Schema2Port(port)] = struct{}{}
+	}
+	dc.Healthcheck = b.Healthcheck
+	dc.Shell = b.Shell
+	b.DockerV2.Author = b.OCIv1.Author
+	b.DockerV2.Architecture = b.OCIv1.Architecture
+	b.DockerV2.OS = b.OCIv1.OS
+}
+
+// loadHistory takes the history of an image committed by an earlier build, for a step whose
+// result is reused from the cache instead of being committed again.
+func (b *Builder) loadHistory(imageID string) error {
+	config, _, err := readImageConfig(b.Store, imageID)
+	if err != nil {
+		return err
+	}
+	b.OCIv1.History = config.History
+	return nil
+}
+
+// BuilderInfo is the state of a builder together with the OCI configuration it would be
+// committed with.
+type BuilderInfo struct {
+	Builder   *Builder
+	OCIConfig v1.Image
+}
+
+// Inspect returns the state of the builder and the configuration of the image it commits to.
+func (b *Builder) Inspect() BuilderInfo {
+	b.updateConfig()
+	return BuilderInfo{Builder: b, OCIConfig: b.OCIv1}
+}
+
+// Configure applies op to the image configuration of the builder, the way the matching
+// Dockerfile instructions do, and saves the builder.
+func (b *Builder) Configure(op options.ConfigOption) error {
+	return b.Update(func() error {
+		return b.configure(op)
+	})
+}
+
+func (b *Builder) configure(op options.ConfigOption) error {
+	if err := configureList("env", op.Env, b.AddEnv, b.RemoveEnv); err != nil {
+		return err
+	}
+	if err := configureList("label", op.Labels, b.AddLabel, func(key string) { delete(b.Labels, key) }); err != nil {
+		return err
+	}
+	if err := configureList("annotation", op.Annotations, b.AddAnnotation, func(key string) { delete(b.Annotations, key) }); err != nil {
+		return err
+	}
+	for _, p := range op.Ports {
+		remove := strings.HasSuffix(p, "-")
+		port, err := normalizePort(strings.TrimSuffix(p, "-"))
+		if err != nil {
+			return err
+		}
+		if remove {
+			delete(b.ExposedPorts, port)
+		} else {
+			b.AddPort(port)
+		}
+	}
+	for _, volume := range op.Volumes {
+		if strings.HasSuffix(volume, "-") {
+			delete(b.Volumes, strings.TrimSuffix(volume, "-"))
+		} else {
+			b.AddVolume(volume)
+		}
+	}
+	if op.Entrypoint != nil {
+		b.SetEntryPoint(configCommand(*op.Entrypoint, b.Shell))
+	}
+	if op.Cmd != nil {
+		b.SetCmd(configCommand(*op.Cmd, b.Shell))
+	}
+	if op.User != nil {
+		b.SetUser(*op.User)
+	}
+	if op.Workdir != nil {
+		workdir := *op.Workdir
+		if workdir != "" && !filepath.IsAbs(workdir) {
+			workdir = filepath.Join("/", b.Workdir, workdir)
+		}
+		b.SetWorkdir(workdir)
+	}
+	if op.Author != nil {
+		b.SetMaintainer(*op.Author)
+	}
+	if op.Comment != nil {
+		b.SetMessage(*op.Comment)
+	}
+	if op.StopSignal != nil {
+		b.SetStopSignal(*op.StopSignal)
+	}
+	if op.Healthcheck != nil {
+		var health *v5manifest.Schema2HealthConfig
+		if *op.Healthcheck != "" {
+			var err error
+			if health, err = parseHealthcheck(*op.Healthcheck); err != nil {
+				return err
+			}
+		}
+		b.SetHealthcheck(health)
+	}
+	return nil
+}
+
+// configureList applies KEY=VALUE entries with add and removes the KEY of KEY- entries.
+func configureList(name string, entries []string, add func(key, value string), remove func(key string)) error {
+	for _, entry := range entries {
+		if key := strings.TrimSuffix(entry, "-"); key != entry && !strings.Contains(key, "=") {
+			remove(key)
+			continue
+		}
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return fmt.Errorf("invalid %s %q, use KEY=VALUE to set it or KEY- to remove it", name, entry)
+		}
+		add(kv[0], kv[1])
+	}
+	return nil
+}
+
+// configCommand returns the entrypoint or command given to config in the exec or shell form,
+// an empty value clears it.
+func configCommand(value string, shell []string) []string {
+	if strings.TrimSpace(value) == "" {
+		return nil
+	}
+	return shellCommand(value, shell)
+}
+
+func defaultPlatform(arch, os string) (string, string) {
+	if arch == "" {
+		arch = runtime.GOARCH
+	}
+	if os == "" {
+		os = runtime.GOOS
+	}
+	return arch, os
+}
+
+// copyStrings copies a slice, keeping the difference between nil (unset) and empty.
+func copyStrings(s []string) []string {
+	if s == nil {
+		return nil
+	}
+	return append([]string{}, s...)
+}
+
+func copyStringMap(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	n := make(map[string]string, len(m))
+	for k, v := range m {
+		n[k] = v
+	}
+	return n
+}
+
+func copySet(m map[string]struct{}) map[string]struct{} {
+	if m == nil {
+		return nil
+	}
+	n := make(map[string]struct{}, len(m))
+	for k := range m {
+		n[k] = struct{}{}
+	}
+	return n
+}
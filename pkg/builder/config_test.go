@@ -0,0 +1,50 @@
+package builder
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestConfigureList(t *testing.T) {
+	b := &Builder{Env: []string{"PATH=/usr/bin", "OLD=1"}}
+	tests := []struct {
+		entries []string
+		want    []string
+		wantErr bool
+	}{
+		{entries: []string{"A=1", "B=x=y"}, want: []string{"PATH=/usr/bin", "OLD=1", "A=1", "B=x=y"}},
+		{entries: []string{"OLD-", "A=2"}, want: []string{"PATH=/usr/bin", "A=2", "B=x=y"}},
+		{entries: []string{"C=a-"}, want: []string{"PATH=/usr/bin", "A=2", "B=x=y", "C=a-"}},
+		{entries: []string{"noequals"}, wantErr: true},
+		{entries: []string{"=value"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		err := configureList("env", tt.entries, b.AddEnv, b.RemoveEnv)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("configureList(%v) error = %v, wantErr %v", tt.entries, err, tt.wantErr)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(b.Env, tt.want) {
+			t.Errorf("configureList(%v) env = %v, want %v", tt.entries, b.Env, tt.want)
+		}
+	}
+}
+
+func TestConfigCommand(t *testing.T) {
+	tests := []struct {
+		value string
+		shell []string
+		want  []string
+	}{
+		{value: `["/app/server", "--port", "80"]`, want: []string{"/app/server", "--port", "80"}},
+		{value: "echo hi", want: []string{"/bin/sh", "-c", "echo hi"}},
+		{value: "echo hi", shell: []string{"/bin/bash", "-c"}, want: []string{"/bin/bash", "-c", "echo hi"}},
+		{value: "[]", want: []string{}},
+		{value: "", want: nil},
+	}
+	for _, tt := range tests {
+		if got := configCommand(tt.value, tt.shell); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("configCommand(%q) = %#v, want %#v", tt.value, got, tt.want)
+		}
+	}
+}
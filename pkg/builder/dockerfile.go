@@ -0,0 +1,166 @@
+/*
+   Copyright (c) 2023 KylinSoft Co., Ltd.
+   Kylin trusted image builder(ktib) is licensed under Mulan PSL v2.
+   You can use this software according to the terms and conditions of the Mulan PSL v2.
+   You may obtain a copy of Mulan PSL v2 at:
+            http://license.coscl.org.cn/MulanPSL2
+   THIS SOFTWARE IS PROVIDED ON AN "AS IS" BASIS, WITHOUT WARRANTIES OF ANY KIND, EITHER EXPRESS OR IMPLIED, INCLUDING
+   BUT NOT LIMITED TO NON-INFRINGEMENT, MERCHANTABILITY OR FIT FOR A PARTICULAR PURPOSE.
+   See the Mulan PSL v2 for more details.
+*/
+
+package builder
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	"gitee.com/openeuler/ktib/pkg/scanner/parsingutils"
+	"github.com/moby/buildkit/frontend/dockerfile/parser"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/sirupsen/logrus"
+)
+
+// heredocScriptDir is where the script of a RUN heredoc with a shebang is mounted, like buildkit
+// does.
+const heredocScriptDir = "/dev/pipes"
+
+// dockerfileStep is one step of a Dockerfile: the instruction with its continuation lines joined,
+// the heredocs that follow it and the line it starts on.
+type dockerfileStep struct {
+	Expression string
+	Heredocs   []parser.Heredoc
+	Line       int
+}
+
+// source returns the instruction with the content of its heredocs, the text that identifies the
+// step in the cache and in the checkpoints of the build.
+func (d dockerfileStep) source() string {
+	s := d.Expression
+	for _, heredoc := range d.Heredocs {
+		s += "\n" + heredoc.Content + heredoc.Name
+	}
+	return s
+}
+
+// parseDockerfile splits a Dockerfile into its steps with the parser the scanner uses. It
+// also returns the escape character, which the escape parser directive may change. The warnings
+// of the parser are logged with log, the entry of the build, so that they are reported to it.
+func parseDockerfile(content []byte, log *logrus.Entry) ([]dockerfileStep, rune, error) {
+	if syntax, _, _, ok := parser.DetectSyntax(content); ok {
+		log.Debugf("ignoring the syntax directive %s, ktib builds with its own Dockerfile frontend", syntax)
+	}
+	result, err := parsingutils.ParseDockerfile(content)
+	if err != nil {
+		var location *parser.ErrorLocation
+		if errors.As(err, &location) && len(location.Locations) > 0 && len(location.Locations[0]) > 0 {
+			return nil, 0, fmt.Errorf("line %d: %w", location.Locations[0][0].Start.Line, err)
+		}
+		return nil, 0, err
+	}
+	for _, warning := range result.Warnings {
+		log.Warnf("line %d: %s", warning.Location.Start.Line, warning.Short)
+	}
+	var steps []dockerfileStep
+	for _, node := range result.AST.Children {
+		// the keyword is case insensitive and may be followed by any whitespace
+		original := strings.TrimSpace(node.Original)
+		expression := strings.ToUpper(node.Value)
+		if i := strings.IndexFunc(original, unicode.IsSpace); i >= 0 {
+			expression += " " + strings.TrimSpace(original[i:])
+		}
+		steps = append(steps, dockerfileStep{
+			Expression: expression,
+			Heredocs:   node.Heredocs,
+			Line:       node.StartLine,
+		})
+	}
+	return steps, result.EscapeToken, nil
+}
+
+// heredoc returns the heredoc of the current step that word refers to, word being an argument
+// like <<EOF or <<-"EOF".
+func (b *Executor) heredoc(word string) (*parser.Heredoc, bool) {
+	ref := parser.MustParseHeredoc(word)
+	if ref == nil {
+		return nil, false
+	}
+	for i := range b.heredocs {
+		if b.heredocs[i].Name == ref.Name {
+			return &b.heredocs[i], true
+		}
+	}
+	return nil, false
+}
+
+// heredocContent returns the content of heredoc, with the leading tabs removed for <<- and the
+// values of the build substituted unless the delimiter was quoted.
+func (b *Executor) heredocContent(heredoc *parser.Heredoc) (string, error) {
+	content := heredoc.Content
+	if heredoc.Chomp {
+		content = parser.ChompHeredocContent(content)
+	}
+	if !heredoc.Expand {
+		return content, nil
+	}
+	return expandHeredoc(content, b.expansionEnv(), b.escape)
+}
+
+// writeHeredoc writes the content of heredoc to a file named after its delimiter in dir, the
+// source that ADD or COPY copies for it.
+func (b *Executor) writeHeredoc(heredoc *parser.Heredoc, dir string) (string, error) {
+	content, err := b.heredocContent(heredoc)
+	if err != nil {
+		return "", fmt.Errorf("error expanding heredoc %s: %w", heredoc.Name, err)
+	}
+	file := filepath.Join(dir, filepath.Base(heredoc.Name))
+	return file, os.WriteFile(file, []byte(content), 0644)
+}
+
+// heredocCommand returns the command of a shell form RUN with heredocs, the same way buildkit
+// runs it. A RUN that is a single heredoc runs its content with the shell, or as a script when it
+// starts with a shebang, which is then mounted read-only. Any other command gets its heredocs
+// appended for the shell to read them.
+func (b *Executor) heredocCommand(command string) ([]string, []specs.Mount, func(), error) {
+	cleanup := func() {}
+	heredoc, ok := b.heredoc(strings.TrimSpace(command))
+	if !ok || len(b.heredocs) != 1 {
+		full := command
+		for _, heredoc := range b.heredocs {
+			full += "\n" + heredoc.Content + heredoc.Name
+		}
+		return shellCommand(full, b.builders.Shell), nil, cleanup, nil
+	}
+	content := heredoc.Content
+	if heredoc.Chomp {
+		content = parser.ChompHeredocContent(content)
+	}
+	if !strings.HasPrefix(content, "#!") {
+		shell := b.builders.Shell
+		if len(shell) == 0 {
+			shell = defaultShell
+		}
+		return append(append([]string{}, shell...), content), nil, cleanup, nil
+	}
+	dir, err := os.MkdirTemp("", "ktib-heredoc")
+	if err != nil {
+		return nil, nil, cleanup, err
+	}
+	cleanup = func() { os.RemoveAll(dir) }
+	name := filepath.Base(heredoc.Name)
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0755); err != nil {
+		cleanup()
+		return nil, nil, func() {}, err
+	}
+	mount := specs.Mount{
+		Destination: heredocScriptDir,
+		Type:        "bind",
+		Source:      dir,
+		Options:     []string{"rbind", "ro"},
+	}
+	return []string{filepath.Join(heredocScriptDir, name)}, []specs.Mount{mount}, cleanup, nil
+}
@@ -0,0 +1,310 @@
+package builder
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gitee.com/openeuler/ktib/pkg/options"
+	"github.com/sirupsen/logrus"
+)
+
+func TestParseDockerfile(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected []string
+		lines    []int
+		escape   rune
+		wantErr  bool
+	}{
+		{
+			name:     "no comments",
+			input:    "FROM golang:1.20\nRUN echo Hello, World!",
+			expected: []string{"FROM golang:1.20", "RUN echo Hello, World!"},
+			lines:    []int{1, 2},
+		},
+		{
+			name:     "with comments",
+			input:    "# This is a comment\nFROM golang:1.20\n# Another comment\nRUN echo Hello, World!",
+			expected: []string{"FROM golang:1.20", "RUN echo Hello, World!"},
+			lines:    []int{2, 4},
+		},
+		{
+			name:     "comments and empty lines",
+			input:    "FROM scratch\n#comment\n\n  ENV A=1\n#another comment",
+			expected: []string{"FROM scratch", "ENV A=1"},
+			lines:    []int{1, 4},
+		},
+		{
+			name:     "with_line_continuation_in_FROM",
+			input:    "FROM \\\ngolang:1.20\nRUN echo Hello, World!",
+			expected: []string{"FROM golang:1.20", "RUN echo Hello, World!"},
+			lines:    []int{1, 3},
+		},
+		{
+			name:     "with_line_continuation_in_RUN",
+			input:    "FROM golang:1.20\nRUN echo Hello, \\\nWorld!",
+			expected: []string{"FROM golang:1.20", "RUN echo Hello, World!"},
+			lines:    []int{1, 2},
+		},
+		{
+			name:     "with_line_continuation_and_comments",
+			input:    "# Preamble comment\nFROM \\\n# This is a comment\ngolang:1.20\nRUN echo Hello, World!",
+			expected: []string{"FROM golang:1.20", "RUN echo Hello, World!"},
+			lines:    []int{2, 5},
+		},
+		{
+			name:     "with_line_continuation_and_whitespace",
+			input:    "FROM \\\t\n\t\t\ngolang:1.20\nRUN echo Hello, World!",
+			expected: []string{"FROM golang:1.20", "RUN echo Hello, World!"},
+			lines:    []int{1, 4},
+		},
+		{
+			name:     "lower case keyword",
+			input:    "from scratch\ncopy\ta b",
+			expected: []string{"FROM scratch", "COPY a b"},
+			lines:    []int{1, 2},
+		},
+		{
+			name:     "syntax and escape directives",
+			input:    "# syntax=docker/dockerfile:1\n# escape=`\nFROM scratch\nCOPY C:\\a `\n  /b\n",
+			expected: []string{"FROM scratch", `COPY C:\a   /b`},
+			lines:    []int{3, 4},
+			escape:   '`',
+		},
+		{
+			name:     "directive after an instruction is a comment",
+			input:    "FROM scratch\n# escape=`\nRUN a \\\nb",
+			expected: []string{"FROM scratch", "RUN a b"},
+			lines:    []int{1, 3},
+		},
+		{
+			name:     "heredoc",
+			input:    "FROM scratch\nRUN <<EOF\necho a\n# not a comment\nEOF\nENV A=1",
+			expected: []string{"FROM scratch", "RUN <<EOF", "ENV A=1"},
+			lines:    []int{1, 2, 6},
+		},
+		{name: "unterminated heredoc", input: "FROM scratch\nRUN <<EOF\necho a\n", wantErr: true},
+		{name: "only comments", input: "# nothing\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			steps, escape, err := parseDockerfile([]byte(tt.input), logrus.NewEntry(logrus.StandardLogger()))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseDockerfile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			var expressions []string
+			var lines []int
+			for _, step := range steps {
+				expressions = append(expressions, step.Expression)
+				lines = append(lines, step.Line)
+			}
+			if !reflect.DeepEqual(expressions, tt.expected) {
+				t.Errorf("parseDockerfile() = %q, want %q", expressions, tt.expected)
+			}
+			if !reflect.DeepEqual(lines, tt.lines) {
+				t.Errorf("parseDockerfile() lines = %v, want %v", lines, tt.lines)
+			}
+			want := tt.escape
+			if want == 0 {
+				want = '\\'
+			}
+			if escape != want {
+				t.Errorf("parseDockerfile() escape = %q, want %q", escape, want)
+			}
+		})
+	}
+}
+
+func TestHeredocSource(t *testing.T) {
+	steps, _, err := parseDockerfile([]byte("FROM scratch\nRUN <<-EOF cat\n\techo a\n\tEOF\n"), logrus.NewEntry(logrus.StandardLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := steps[1].source(), "RUN <<-EOF cat\n\techo a\nEOF"; got != want {
+		t.Errorf("source() = %q, want %q", got, want)
+	}
+	if len(steps[1].Heredocs) != 1 || !steps[1].Heredocs[0].Chomp {
+		t.Errorf("heredocs = %+v", steps[1].Heredocs)
+	}
+}
+
+func TestBuildHeredoc(t *testing.T) {
+	store := newTestStore(t)
+	contextDir := t.TempDir()
+	dockerfile := filepath.Join(contextDir, "Dockerfile")
+	content := strings.Join([]string{
+		"# escape=`",
+		"FROM scratch",
+		"ARG NAME=heredoc",
+		"COPY <<EOF /etc/app.conf",
+		"name=${NAME}",
+		"EOF",
+		"COPY <<-'RAW' <<EOT /etc/app/",
+		"\tname=${NAME}",
+		"\tRAW",
+		"second",
+		"EOT",
+		"ENV GREETING=a` b",
+	}, "\n") + "\n"
+	if err := os.WriteFile(dockerfile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	op := &options.BuildOptions{
+		Tags:             "heredoc-test",
+		ContextDirectory: contextDir,
+		Rm:               true,
+		ForceRm:          true,
+		Out:              &out,
+		Err:              &out,
+	}
+	if err := BuildDockerfiles(context.Background(), store, op, dockerfile); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "Step 3 : COPY <<EOF /etc/app.conf") {
+		t.Errorf("build output = %q", out.String())
+	}
+	img, err := store.Image("docker.io/library/heredoc-test:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewBuilder(store, BuilderOptions{FromImage: img.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Mount(""); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"etc/app.conf": "name=heredoc\n",
+		"etc/app/RAW":  "name=${NAME}\n",
+		"etc/app/EOT":  "second\n",
+	}
+	for name, want := range files {
+		got, err := os.ReadFile(filepath.Join(b.MountPoint, name))
+		if err != nil || string(got) != want {
+			t.Errorf("%s = %q, %v, want %q", name, got, err, want)
+		}
+	}
+	if !reflect.DeepEqual(b.Env, []string{"GREETING=a b"}) {
+		t.Errorf("env = %q", b.Env)
+	}
+	if err := b.Remove(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the content of a heredoc is part of the step, another content is no cache hit
+	changed := strings.Replace(content, "second", "third", 1)
+	if err := os.WriteFile(dockerfile, []byte(changed), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	if err := BuildDockerfiles(context.Background(), store, op, dockerfile); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(out.String(), "Using cache") != 1 {
+		t.Errorf("rebuild with a changed heredoc output = %q", out.String())
+	}
+}
+
+func TestBuildParseError(t *testing.T) {
+	dockerfile := filepath.Join(t.TempDir(), "Dockerfile")
+	if err := os.WriteFile(dockerfile, []byte("FROM scratch\nRUN <<EOF\necho a\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	op := &options.BuildOptions{Tags: "parse-error", Out: &out, Err: &out}
+	err := BuildDockerfiles(context.Background(), newTestStore(t), op, dockerfile)
+	if err == nil || !strings.Contains(err.Error(), "line 2") || !strings.Contains(err.Error(), "unterminated heredoc") {
+		t.Errorf("BuildDockerfiles() error = %v", err)
+	}
+}
+
+func TestHeredocCommand(t *testing.T) {
+	tests := []struct {
+		name       string
+		dockerfile string
+		expected   []string
+		script     string
+	}{
+		{
+			name:       "single heredoc",
+			dockerfile: "FROM scratch\nRUN <<-EOF\n\techo a\n\techo b\n\tEOF\n",
+			expected:   []string{"/bin/sh", "-c", "echo a\necho b\n"},
+		},
+		{
+			name:       "script with a shebang",
+			dockerfile: "FROM scratch\nRUN <<EOF\n#!/usr/bin/env python3\nprint('a')\nEOF\n",
+			expected:   []string{"/dev/pipes/EOF"},
+			script:     "#!/usr/bin/env python3\nprint('a')\n",
+		},
+		{
+			name:       "command reading heredocs",
+			dockerfile: "FROM scratch\nRUN cat <<A > /a && cat <<B > /b\na\nA\nb\nB\n",
+			expected:   []string{"/bin/sh", "-c", "cat <<A > /a && cat <<B > /b\na\nA\nb\nB"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			steps, _, err := parseDockerfile([]byte(tt.dockerfile), logrus.NewEntry(logrus.StandardLogger()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			e := &Executor{builders: &Builder{}, heredocs: steps[1].Heredocs}
+			args, mounts, cleanup, err := e.heredocCommand(strings.TrimPrefix(steps[1].Expression, "RUN "))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer cleanup()
+			if !reflect.DeepEqual(args, tt.expected) {
+				t.Errorf("heredocCommand() = %q, want %q", args, tt.expected)
+			}
+			if tt.script == "" {
+				if len(mounts) != 0 {
+					t.Errorf("heredocCommand() mounts = %v", mounts)
+				}
+				return
+			}
+			if len(mounts) != 1 || mounts[0].Destination != heredocScriptDir {
+				t.Fatalf("heredocCommand() mounts = %v", mounts)
+			}
+			script := filepath.Join(mounts[0].Source, "EOF")
+			got, err := os.ReadFile(script)
+			if err != nil || string(got) != tt.script {
+				t.Errorf("script = %q, %v, want %q", got, err, tt.script)
+			}
+			if info, err := os.Stat(script); err != nil || info.Mode().Perm()&0100 == 0 {
+				t.Errorf("script is not executable: %v, %v", info, err)
+			}
+		})
+	}
+}
+
+func TestParseDockerfileWarnings(t *testing.T) {
+	var logged, global bytes.Buffer
+	logger := logrus.New()
+	logger.SetOutput(&logged)
+	out := logrus.StandardLogger().Out
+	logrus.SetOutput(&global)
+	defer logrus.SetOutput(out)
+
+	if _, _, err := parseDockerfile([]byte("FROM scratch\nENV A=1 \\\n\n    B=2\n"), logrus.NewEntry(logger)); err != nil {
+		t.Fatal(err)
+	}
+	// the warnings belong to the build, a parallel build must not see them
+	if !strings.Contains(logged.String(), "Empty continuation line") {
+		t.Errorf("the empty continuation line was not reported to the build: %q", logged.String())
+	}
+	if global.Len() != 0 {
+		t.Errorf("parser warnings were logged with the standard logger: %q", global.String())
+	}
+}
@@ -0,0 +1,140 @@
+/*
+   Copyright (c) 2023 KylinSoft Co., Ltd.
+   Kylin trusted image builder(ktib) is licensed under Mulan PSL v2.
+   You can use this software according to the terms and conditions of the Mulan PSL v2.
+   You may obtain a copy of Mulan PSL v2 at:
+            http://license.coscl.org.cn/MulanPSL2
+   THIS SOFTWARE IS PROVIDED ON AN "AS IS" BASIS, WITHOUT WARRANTIES OF ANY KIND, EITHER EXPRESS OR IMPLIED, INCLUDING
+   BUT NOT LIMITED TO NON-INFRINGEMENT, MERCHANTABILITY OR FIT FOR A PARTICULAR PURPOSE.
+   See the Mulan PSL v2 for more details.
+*/
+
+package builder
+
+import (
+	"errors"
+	"strings"
+
+	"gitee.com/openeuler/ktib/pkg/options"
+	"github.com/containers/storage"
+	"github.com/containers/storage/pkg/idtools"
+	"github.com/containers/storage/pkg/unshare"
+	"github.com/containers/storage/types"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/opencontainers/runtime-tools/generate"
+)
+
+// IDMappingOptions returns the ID mappings requested with the options of "builders from". Maps
+// are given as containerID:hostID:size triples separated by commas, SubUIDMap and SubGIDMap name
+// a user or group whose ranges in /etc/subuid and /etc/subgid are used. It returns nil when no
+// mapping was requested, so the defaults of the store apply.
+func IDMappingOptions(op *options.FromOption) (*storage.IDMappingOptions, error) {
+	if !op.HostUIDMap && !op.HostGIDMap && op.UIDMap == "" && op.GIDMap == "" && op.SubUIDMap == "" && op.SubGIDMap == "" {
+		return nil, nil
+	}
+	if op.HostUIDMap && (op.UIDMap != "" || op.SubUIDMap != "") {
+		return nil, errors.New("--hostuidmap can not be combined with --uidmap or --subuidmap")
+	}
+	if op.HostGIDMap && (op.GIDMap != "" || op.SubGIDMap != "") {
+		return nil, errors.New("--hostgidmap can not be combined with --gidmap or --subgidmap")
+	}
+	if (op.UIDMap != "" || op.GIDMap != "") && (op.SubUIDMap != "" || op.SubGIDMap != "") {
+		return nil, errors.New("explicit ID maps can not be combined with --subuidmap or --subgidmap")
+	}
+	mappings, err := types.ParseIDMapping(splitIDMap(op.UIDMap), splitIDMap(op.GIDMap), op.SubUIDMap, op.SubGIDMap)
+	if err != nil {
+		return nil, err
+	}
+	if op.HostUIDMap {
+		mappings.HostUIDMapping, mappings.UIDMap = true, nil
+	}
+	if op.HostGIDMap {
+		mappings.HostGIDMapping, mappings.GIDMap = true, nil
+	}
+	return mappings, nil
+}
+
+func splitIDMap(value string) []string {
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
+
+// idMappings returns the ID mappings of the builder container.
+func (b *Builder) idMappings() *idtools.IDMappings {
+	// a nil map, unlike an empty one, maps every id to itself
+	var uids, gids []idtools.IDMap
+	if len(b.UIDMap) > 0 {
+		uids = b.UIDMap
+	}
+	if len(b.GIDMap) > 0 {
+		gids = b.GIDMap
+	}
+	return idtools.NewIDMappingsFromMaps(uids, gids)
+}
+
+// containerOptions returns the options to create the container of the builder with, so that a
+// container recreated on top of a committed step keeps the mappings of the original one.
+func (b *Builder) containerOptions() *storage.ContainerOptions {
+	return &storage.ContainerOptions{
+		IDMappingOptions: storage.IDMappingOptions{
+			HostUIDMapping: len(b.UIDMap) == 0,
+			HostGIDMapping: len(b.GIDMap) == 0,
+			UIDMap:         b.UIDMap,
+			GIDMap:         b.GIDMap,
+		},
+	}
+}
+
+// setupUserNamespace runs the process in a user namespace with the mappings of the container,
+// the files of its rootfs are owned by the mapped ids.
+func (b *Builder) setupUserNamespace(g *generate.Generator) error {
+	if len(b.UIDMap) == 0 && len(b.GIDMap) == 0 {
+		return nil
+	}
+	if err := g.AddOrReplaceLinuxNamespace(string(specs.UserNamespace), ""); err != nil {
+		return err
+	}
+	g.ClearLinuxUIDMappings()
+	for _, m := range b.UIDMap {
+		g.AddLinuxUIDMapping(uint32(m.HostID), uint32(m.ContainerID), uint32(m.Size))
+	}
+	g.ClearLinuxGIDMappings()
+	for _, m := range b.GIDMap {
+		g.AddLinuxGIDMapping(uint32(m.HostID), uint32(m.ContainerID), uint32(m.Size))
+	}
+	return nil
+}
+
+// setupRootless adjusts the spec for a runtime started without real root privileges: the
+// mounts that need privileges on the host are replaced and no cgroup limits are requested.
+func setupRootless(g *generate.Generator) {
+	if !unshare.IsRootless() {
+		return
+	}
+	for i, m := range g.Config.Mounts {
+		switch m.Destination {
+		case "/dev/pts":
+			// gid 5 (tty) is usually not mapped
+			var opts []string
+			for _, o := range m.Options {
+				if !strings.HasPrefix(o, "gid=") {
+					opts = append(opts, o)
+				}
+			}
+			g.Config.Mounts[i].Options = opts
+		case "/sys":
+			g.Config.Mounts[i] = specs.Mount{
+				Destination: "/sys",
+				Type:        "bind",
+				Source:      "/sys",
+				Options:     []string{"rbind", "nosuid", "noexec", "nodev", "ro"},
+			}
+		}
+	}
+	g.RemoveMount("/sys/fs/cgroup")
+	if g.Config.Linux != nil {
+		g.Config.Linux.Resources = nil
+	}
+}
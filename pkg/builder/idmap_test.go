@@ -0,0 +1,89 @@
+package builder
+
+import (
+	"reflect"
+	"testing"
+
+	"gitee.com/openeuler/ktib/pkg/options"
+	"github.com/containers/storage/pkg/idtools"
+	"github.com/opencontainers/runtime-tools/generate"
+)
+
+func TestIDMappingOptions(t *testing.T) {
+	mappings, err := IDMappingOptions(&options.FromOption{})
+	if err != nil || mappings != nil {
+		t.Fatalf("IDMappingOptions() without flags = %v, %v, want the store defaults", mappings, err)
+	}
+
+	mappings, err = IDMappingOptions(&options.FromOption{UIDMap: "0:100000:1000,1000:1000:1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []idtools.IDMap{{ContainerID: 0, HostID: 100000, Size: 1000}, {ContainerID: 1000, HostID: 1000, Size: 1}}
+	if mappings.HostUIDMapping || !reflect.DeepEqual(mappings.UIDMap, expected) {
+		t.Errorf("unexpected UID mappings %+v", mappings)
+	}
+	if mappings.HostGIDMapping || !reflect.DeepEqual(mappings.GIDMap, expected) {
+		t.Errorf("the GID map should default to the UID map, got %+v", mappings.GIDMap)
+	}
+
+	mappings, err = IDMappingOptions(&options.FromOption{UIDMap: "0:100000:65536", HostGIDMap: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !mappings.HostGIDMapping || mappings.GIDMap != nil {
+		t.Errorf("--hostgidmap should keep the host GIDs, got %+v", mappings)
+	}
+
+	for _, op := range []options.FromOption{
+		{UIDMap: "0:100000"},
+		{HostUIDMap: true, UIDMap: "0:100000:65536"},
+		{UIDMap: "0:100000:65536", SubUIDMap: "ktib"},
+	} {
+		if _, err := IDMappingOptions(&op); err == nil {
+			t.Errorf("IDMappingOptions(%+v) expected an error", op)
+		}
+	}
+}
+
+func TestSetupUserNamespace(t *testing.T) {
+	g, err := generate.New("linux")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &Builder{}
+	if err := b.setupUserNamespace(&g); err != nil {
+		t.Fatal(err)
+	}
+	for _, ns := range g.Config.Linux.Namespaces {
+		if ns.Type == "user" {
+			t.Fatalf("no user namespace expected without mappings")
+		}
+	}
+
+	b.UIDMap = []idtools.IDMap{{ContainerID: 0, HostID: 100000, Size: 65536}}
+	b.GIDMap = []idtools.IDMap{{ContainerID: 0, HostID: 200000, Size: 65536}}
+	if err := b.setupUserNamespace(&g); err != nil {
+		t.Fatal(err)
+	}
+	var userNS bool
+	for _, ns := range g.Config.Linux.Namespaces {
+		userNS = userNS || ns.Type == "user"
+	}
+	if !userNS {
+		t.Errorf("expected a user namespace")
+	}
+	if m := g.Config.Linux.UIDMappings; len(m) != 1 || m[0].HostID != 100000 || m[0].Size != 65536 {
+		t.Errorf("unexpected UID mappings %+v", m)
+	}
+	if m := g.Config.Linux.GIDMappings; len(m) != 1 || m[0].HostID != 200000 {
+		t.Errorf("unexpected GID mappings %+v", m)
+	}
+	pair, err := b.idMappings().ToHost(idtools.IDPair{UID: 1001, GID: 0})
+	if err != nil || pair.UID != 101001 || pair.GID != 200000 {
+		t.Errorf("ToHost() = %+v, %v", pair, err)
+	}
+	if pair, err := (&Builder{}).idMappings().ToHost(idtools.IDPair{UID: 1001, GID: 5}); err != nil || pair.UID != 1001 || pair.GID != 5 {
+		t.Errorf("without mappings ids should be kept, got %+v, %v", pair, err)
+	}
+}
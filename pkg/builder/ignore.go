@@ -0,0 +1,145 @@
+/*
+   Copyright (c) 2023 KylinSoft Co., Ltd.
+   Kylin trusted image builder(ktib) is licensed under Mulan PSL v2.
+   You can use this software according to the terms and conditions of the Mulan PSL v2.
+   You may obtain a copy of Mulan PSL v2 at:
+            http://license.coscl.org.cn/MulanPSL2
+   THIS SOFTWARE IS PROVIDED ON AN "AS IS" BASIS, WITHOUT WARRANTIES OF ANY KIND, EITHER EXPRESS OR IMPLIED, INCLUDING
+   BUT NOT LIMITED TO NON-INFRINGEMENT, MERCHANTABILITY OR FIT FOR A PARTICULAR PURPOSE.
+   See the Mulan PSL v2 for more details.
+*/
+
+package builder
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containers/storage/pkg/archive"
+	"github.com/containers/storage/pkg/fileutils"
+)
+
+// ignoreFiles are looked up in the context directory in this order, the first one found is used.
+var ignoreFiles = []string{".containerignore", ".dockerignore"}
+
+// readIgnoreFile returns the exclude patterns of the build context. Blank lines and lines
+// starting with '#' are skipped, patterns are relative to the context directory and a leading
+// '!' re-includes paths excluded by an earlier pattern.
+func readIgnoreFile(contextDir string) ([]string, error) {
+	for _, name := range ignoreFiles {
+		f, err := os.Open(filepath.Join(contextDir, name))
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return nil, err
+		}
+		defer f.Close()
+		var patterns []string
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			negate := strings.HasPrefix(line, "!")
+			line = strings.TrimSpace(strings.TrimPrefix(line, "!"))
+			if line == "" {
+				return nil, fmt.Errorf("illegal exclusion pattern %q in %s", "!", name)
+			}
+			line = strings.TrimPrefix(filepath.Clean(filepath.FromSlash(line)), string(filepath.Separator))
+			if line == "" {
+				continue
+			}
+			if negate {
+				line = "!" + line
+			}
+			patterns = append(patterns, line)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("error reading %s: %w", name, err)
+		}
+		return patterns, nil
+	}
+	return nil, nil
+}
+
+// contextFilter tells which paths of the build context are excluded by the ignore file.
+type contextFilter struct {
+	contextDir string
+	excludes   []string
+	matcher    *fileutils.PatternMatcher
+}
+
+// newContextFilter compiles the exclude patterns. A filter without patterns excludes nothing.
+func newContextFilter(contextDir string, excludes []string) (*contextFilter, error) {
+	if contextDir == "" || len(excludes) == 0 {
+		return nil, nil
+	}
+	matcher, err := fileutils.NewPatternMatcher(excludes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ignore pattern: %w", err)
+	}
+	return &contextFilter{contextDir: contextDir, excludes: excludes, matcher: matcher}, nil
+}
+
+// relative returns the path of p inside the context directory, or false when p lies outside of it.
+func (f *contextFilter) relative(p string) (string, bool) {
+	if f == nil {
+		return "", false
+	}
+	rel, err := filepath.Rel(f.contextDir, p)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return rel, true
+}
+
+// excluded reports whether p is hidden by the ignore file. The context directory itself is
+// never excluded.
+func (f *contextFilter) excluded(p string) (bool, error) {
+	rel, ok := f.relative(p)
+	if !ok || rel == "." {
+		return false, nil
+	}
+	return f.matcher.IsMatch(rel)
+}
+
+// skipDir reports whether a walk can skip the excluded directory p entirely, which is only the
+// case when no exclusion pattern re-includes something below it.
+func (f *contextFilter) skipDir(p string) bool {
+	if !f.matcher.Exclusions() {
+		return true
+	}
+	rel, _ := f.relative(p)
+	prefix := rel + string(filepath.Separator)
+	for _, pattern := range f.matcher.Patterns() {
+		if pattern.Exclusion() && strings.HasPrefix(pattern.String()+string(filepath.Separator), prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// copyContextDir copies the directory rel of the build context to dest, leaving out the paths
+// excluded by the filter.
+func copyContextDir(archiver *archive.Archiver, f *contextFilter, rel, dest string) error {
+	tarball, err := archive.TarWithOptions(f.contextDir, &archive.TarOptions{
+		IncludeFiles:    []string{rel},
+		ExcludePatterns: f.excludes,
+		RebaseNames:     map[string]string{rel: "."},
+	})
+	if err != nil {
+		return err
+	}
+	defer tarball.Close()
+	return archiver.Untar(tarball, dest, &archive.TarOptions{
+		UIDMaps:   archiver.UntarIDMappings.UIDs(),
+		GIDMaps:   archiver.UntarIDMappings.GIDs(),
+		ChownOpts: archiver.ChownOpts,
+	})
+}
@@ -0,0 +1,163 @@
+package builder
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/containers/storage/pkg/archive"
+)
+
+func writeContext(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestReadIgnoreFile(t *testing.T) {
+	dir := t.TempDir()
+	patterns, err := readIgnoreFile(dir)
+	if err != nil || patterns != nil {
+		t.Fatalf("readIgnoreFile() without ignore file = %q, %v", patterns, err)
+	}
+
+	writeContext(t, dir, map[string]string{
+		".dockerignore": "# comment\n\n/.git\nbuild/\n*.key\n!public.key\n",
+	})
+	patterns, err = readIgnoreFile(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{".git", "build", "*.key", "!public.key"}
+	if !reflect.DeepEqual(patterns, expected) {
+		t.Errorf("readIgnoreFile() = %q, want %q", patterns, expected)
+	}
+
+	writeContext(t, dir, map[string]string{".containerignore": "secrets\n"})
+	patterns, err = readIgnoreFile(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(patterns, []string{"secrets"}) {
+		t.Errorf("readIgnoreFile() should prefer .containerignore, got %q", patterns)
+	}
+
+	writeContext(t, dir, map[string]string{".containerignore": "!\n"})
+	if _, err := readIgnoreFile(dir); err == nil {
+		t.Errorf("readIgnoreFile() expected an error for a bare '!'")
+	}
+}
+
+func TestContextFilter(t *testing.T) {
+	dir := t.TempDir()
+	filter, err := newContextFilter(dir, []string{".git", "*.key", "!public.key", "docs/**/*.md"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path     string
+		expected bool
+	}{
+		{path: dir, expected: false},
+		{path: filepath.Join(dir, ".git"), expected: true},
+		{path: filepath.Join(dir, ".git/config"), expected: true},
+		{path: filepath.Join(dir, "private.key"), expected: true},
+		{path: filepath.Join(dir, "public.key"), expected: false},
+		{path: filepath.Join(dir, "docs/a/b/readme.md"), expected: true},
+		{path: filepath.Join(dir, "docs/a/b/readme.txt"), expected: false},
+		{path: filepath.Join(filepath.Dir(dir), "other.key"), expected: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			got, err := filter.excluded(tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.expected {
+				t.Errorf("excluded(%q) = %v, want %v", tt.path, got, tt.expected)
+			}
+		})
+	}
+
+	var nilFilter *contextFilter
+	if excluded, err := nilFilter.excluded(filepath.Join(dir, ".git")); err != nil || excluded {
+		t.Errorf("a nil filter should exclude nothing")
+	}
+}
+
+func TestHashSourcesIgnore(t *testing.T) {
+	dir := t.TempDir()
+	writeContext(t, dir, map[string]string{
+		"app/main.go":    "package main",
+		"app/.env":       "TOKEN=1",
+		"app/keep/.env":  "TOKEN=2",
+		"app/tmp/output": "1",
+	})
+	filter, err := newContextFilter(dir, []string{"**/.env", "!app/keep/.env", "app/tmp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := func() string {
+		h, err := hashSources([]string{filepath.Join(dir, "app")}, filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+	first := hash()
+	writeContext(t, dir, map[string]string{"app/.env": "TOKEN=3", "app/tmp/output": "2"})
+	if hash() != first {
+		t.Errorf("hashSources() changed with the content of excluded files")
+	}
+	writeContext(t, dir, map[string]string{"app/keep/.env": "TOKEN=4"})
+	if hash() == first {
+		t.Errorf("hashSources() did not change with a re-included file")
+	}
+}
+
+func TestCopyContextDir(t *testing.T) {
+	dir := t.TempDir()
+	writeContext(t, dir, map[string]string{
+		"app/main.go":        "package main",
+		"app/secret.key":     "key",
+		"app/public.key":     "key",
+		"app/.git/HEAD":      "ref",
+		"app/vendor/lib.go":  "package lib",
+		"other/unrelated.go": "package other",
+	})
+	filter, err := newContextFilter(dir, []string{"**/*.key", "!app/public.key", "app/.git"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest := t.TempDir()
+	if err := copyContextDir(archive.NewDefaultArchiver(), filter, "app", dest); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	err = filepath.Walk(dest, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			rel, _ := filepath.Rel(dest, path)
+			got = append(got, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(got)
+	expected := []string{"main.go", "public.key", "vendor/lib.go"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("copyContextDir() copied %q, want %q", got, expected)
+	}
+}
@@ -0,0 +1,213 @@
+/*
+   Copyright (c) 2023 KylinSoft Co., Ltd.
+   Kylin trusted image builder(ktib) is licensed under Mulan PSL v2.
+   You can use this software according to the terms and conditions of the Mulan PSL v2.
+   You may obtain a copy of Mulan PSL v2 at:
+            http://license.coscl.org.cn/MulanPSL2
+   THIS SOFTWARE IS PROVIDED ON AN "AS IS" BASIS, WITHOUT WARRANTIES OF ANY KIND, EITHER EXPRESS OR IMPLIED, INCLUDING
+   BUT NOT LIMITED TO NON-INFRINGEMENT, MERCHANTABILITY OR FIT FOR A PARTICULAR PURPOSE.
+   See the Mulan PSL v2 for more details.
+*/
+
+package builder
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	v5manifest "github.com/containers/image/v5/manifest"
+)
+
+// splitWords splits the arguments of an instruction on unquoted whitespace. Quotes are removed
+// and the escape character, a backslash unless the escape directive sets another one, escapes the
+// character that follows it, the same way the Dockerfile reference describes for ENV and LABEL.
+func splitWords(arguments string, escape rune) ([]string, error) {
+	var (
+		words   []string
+		word    strings.Builder
+		inWord  bool
+		quote   rune
+		escaped bool
+	)
+	for _, c := range arguments {
+		switch {
+		case escaped:
+			word.WriteRune(c)
+			escaped = false
+		case c == escape && quote != '\'':
+			escaped = true
+			inWord = true
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else {
+				word.WriteRune(c)
+			}
+		case c == '"' || c == '\'':
+			quote = c
+			inWord = true
+		case c == ' ' || c == '\t':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(c)
+			inWord = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote in %q", arguments)
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// parseKeyValues parses the arguments of ENV and LABEL. Both the "key=value key2=value2" form and
+// the legacy "key value" form are accepted, the result keeps the order of the instruction.
+func parseKeyValues(instruction, arguments string, escape rune) ([][2]string, error) {
+	var pairs [][2]string
+	first := strings.Fields(arguments)
+	if len(first) == 0 {
+		return nil, fmt.Errorf("%s requires at least one argument", instruction)
+	}
+	if !strings.Contains(first[0], "=") {
+		// legacy form, everything after the key is the value
+		key := first[0]
+		value := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(arguments), key))
+		if value == "" {
+			return nil, fmt.Errorf("%s %s must have a value", instruction, key)
+		}
+		words, err := splitWords(value, escape)
+		if err != nil {
+			return nil, err
+		}
+		return append(pairs, [2]string{key, strings.Join(words, " ")}), nil
+	}
+	words, err := splitWords(arguments, escape)
+	if err != nil {
+		return nil, err
+	}
+	for _, word := range words {
+		kv := strings.SplitN(word, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("%s names can not be blank and must be in key=value form: %q", instruction, word)
+		}
+		pairs = append(pairs, [2]string{kv[0], kv[1]})
+	}
+	return pairs, nil
+}
+
+// defaultShell runs the shell form of RUN, CMD and ENTRYPOINT unless SHELL sets another one.
+var defaultShell = []string{"/bin/sh", "-c"}
+
+// shellCommand returns the argv of a RUN, CMD or ENTRYPOINT instruction. The exec form, a JSON
+// array, is used as is, the shell form is passed as a single argument to the shell.
+func shellCommand(arguments string, shell []string) []string {
+	if argv, ok := parseJSONArray(arguments); ok {
+		return argv
+	}
+	if len(shell) == 0 {
+		shell = defaultShell
+	}
+	return append(append([]string{}, shell...), arguments)
+}
+
+// parseJSONArray returns the elements of an exec-form argument such as ["a", "b"]. The second
+// return value reports whether the arguments were in JSON form at all.
+func parseJSONArray(arguments string) ([]string, bool) {
+	arguments = strings.TrimSpace(arguments)
+	if !strings.HasPrefix(arguments, "[") {
+		return nil, false
+	}
+	var list []string
+	if err := json.Unmarshal([]byte(arguments), &list); err != nil {
+		return nil, false
+	}
+	return list, true
+}
+
+// parseList accepts either a JSON array or whitespace separated words, as used by VOLUME.
+func parseList(arguments string, escape rune) ([]string, error) {
+	if list, ok := parseJSONArray(arguments); ok {
+		return list, nil
+	}
+	return splitWords(arguments, escape)
+}
+
+// normalizePort adds the default tcp protocol to an EXPOSE argument without one.
+func normalizePort(port string) (string, error) {
+	number, proto := port, "tcp"
+	if i := strings.Index(port, "/"); i >= 0 {
+		number, proto = port[:i], strings.ToLower(port[i+1:])
+	}
+	if proto != "tcp" && proto != "udp" && proto != "sctp" {
+		return "", fmt.Errorf("invalid protocol %q in port %q", proto, port)
+	}
+	for _, p := range strings.SplitN(number, "-", 2) {
+		if _, err := strconv.ParseUint(p, 10, 16); err != nil {
+			return "", fmt.Errorf("invalid port %q", port)
+		}
+	}
+	return number + "/" + proto, nil
+}
+
+// parseHealthcheck converts the arguments of HEALTHCHECK into a docker health config.
+func parseHealthcheck(arguments string) (*v5manifest.Schema2HealthConfig, error) {
+	health := &v5manifest.Schema2HealthConfig{}
+	rest := strings.TrimSpace(arguments)
+	for strings.HasPrefix(rest, "--") {
+		var flag string
+		if i := strings.IndexAny(rest, " \t"); i >= 0 {
+			flag, rest = rest[:i], strings.TrimSpace(rest[i:])
+		} else {
+			flag, rest = rest, ""
+		}
+		kv := strings.SplitN(strings.TrimPrefix(flag, "--"), "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("HEALTHCHECK option %q requires a value", flag)
+		}
+		var err error
+		switch kv[0] {
+		case "interval":
+			health.Interval, err = time.ParseDuration(kv[1])
+		case "timeout":
+			health.Timeout, err = time.ParseDuration(kv[1])
+		case "start-period":
+			health.StartPeriod, err = time.ParseDuration(kv[1])
+		case "retries":
+			health.Retries, err = strconv.Atoi(kv[1])
+		default:
+			return nil, fmt.Errorf("unknown HEALTHCHECK option %q", flag)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid HEALTHCHECK option %q: %w", flag, err)
+		}
+	}
+	tmp := strings.SplitN(rest, " ", 2)
+	switch strings.ToUpper(tmp[0]) {
+	case "NONE":
+		if len(tmp) > 1 || health.Interval != 0 || health.Timeout != 0 || health.StartPeriod != 0 || health.Retries != 0 {
+			return nil, fmt.Errorf("HEALTHCHECK NONE takes no arguments")
+		}
+		health.Test = []string{"NONE"}
+	case "CMD":
+		if len(tmp) != 2 || strings.TrimSpace(tmp[1]) == "" {
+			return nil, fmt.Errorf("HEALTHCHECK CMD requires a command")
+		}
+		if list, ok := parseJSONArray(tmp[1]); ok {
+			health.Test = append([]string{"CMD"}, list...)
+		} else {
+			health.Test = []string{"CMD-SHELL", strings.TrimSpace(tmp[1])}
+		}
+	default:
+		return nil, fmt.Errorf("unknown HEALTHCHECK type %q", tmp[0])
+	}
+	return health, nil
+}
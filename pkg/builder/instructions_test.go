@@ -0,0 +1,147 @@
+package builder
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSplitWords(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		escape   rune
+		expected []string
+		wantErr  bool
+	}{
+		{name: "plain words", input: "a b  c", expected: []string{"a", "b", "c"}},
+		{name: "double quotes", input: `a="b c" d`, expected: []string{"a=b c", "d"}},
+		{name: "single quotes keep backslash", input: `'a\b'`, expected: []string{`a\b`}},
+		{name: "escaped space", input: `a\ b`, expected: []string{"a b"}},
+		{name: "empty quotes", input: `a=""`, expected: []string{"a="}},
+		{name: "unterminated quote", input: `"a`, wantErr: true},
+		{name: "backtick escape", input: "C:\\dir a` b", escape: '`', expected: []string{`C:\dir`, "a b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			escape := tt.escape
+			if escape == 0 {
+				escape = '\\'
+			}
+			got, err := splitWords(tt.input, escape)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("splitWords() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("splitWords() = %q, want %q", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestParseKeyValues(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected [][2]string
+		wantErr  bool
+	}{
+		{name: "legacy form", input: "MY_NAME John Doe", expected: [][2]string{{"MY_NAME", "John Doe"}}},
+		{name: "key value form", input: `A=1 B="two words"`, expected: [][2]string{{"A", "1"}, {"B", "two words"}}},
+		{name: "empty value", input: `A=`, expected: [][2]string{{"A", ""}}},
+		{name: "legacy form without value", input: "A", wantErr: true},
+		{name: "blank key", input: "A=1 =2", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseKeyValues("ENV", tt.input, '\\')
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseKeyValues() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("parseKeyValues() = %q, want %q", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestNormalizePort(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+		wantErr  bool
+	}{
+		{input: "80", expected: "80/tcp"},
+		{input: "53/UDP", expected: "53/udp"},
+		{input: "8000-8080/tcp", expected: "8000-8080/tcp"},
+		{input: "http", wantErr: true},
+		{input: "80/icmp", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := normalizePort(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("normalizePort() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.expected {
+				t.Errorf("normalizePort() = %q, want %q", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestParseHealthcheck(t *testing.T) {
+	health, err := parseHealthcheck("--interval=5m --timeout=3s --retries=2 CMD curl -f http://localhost/ || exit 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if health.Interval != 5*time.Minute || health.Timeout != 3*time.Second || health.Retries != 2 {
+		t.Errorf("unexpected options: %+v", health)
+	}
+	if !reflect.DeepEqual(health.Test, []string{"CMD-SHELL", "curl -f http://localhost/ || exit 1"}) {
+		t.Errorf("unexpected test: %q", health.Test)
+	}
+
+	health, err = parseHealthcheck(`CMD ["/bin/check", "-q"]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(health.Test, []string{"CMD", "/bin/check", "-q"}) {
+		t.Errorf("unexpected test: %q", health.Test)
+	}
+
+	health, err = parseHealthcheck("NONE")
+	if err != nil || !reflect.DeepEqual(health.Test, []string{"NONE"}) {
+		t.Errorf("parseHealthcheck(NONE) = %v, %v", health, err)
+	}
+
+	for _, bad := range []string{"--interval=x CMD true", "--bogus=1 CMD true", "CMD", "NONE extra", "FOO bar"} {
+		if _, err := parseHealthcheck(bad); err == nil {
+			t.Errorf("parseHealthcheck(%q) expected an error", bad)
+		}
+	}
+}
+
+func TestShellCommand(t *testing.T) {
+	tests := []struct {
+		name      string
+		arguments string
+		shell     []string
+		expected  []string
+	}{
+		{name: "shell form", arguments: `echo "a  b" | wc -c`, expected: []string{"/bin/sh", "-c", `echo "a  b" | wc -c`}},
+		{name: "exec form", arguments: `["/usr/bin/foo", "a b"]`, expected: []string{"/usr/bin/foo", "a b"}},
+		{name: "empty exec form", arguments: `[]`, expected: []string{}},
+		{name: "custom shell", arguments: "Get-Date", shell: []string{"pwsh", "-Command"}, expected: []string{"pwsh", "-Command", "Get-Date"}},
+		{name: "exec form ignores shell", arguments: `["true"]`, shell: []string{"/bin/bash", "-c"}, expected: []string{"true"}},
+		{name: "invalid json is shell form", arguments: `[not json]`, expected: []string{"/bin/sh", "-c", "[not json]"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := shellCommand(tt.arguments, tt.shell)
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("shellCommand() = %q, want %q", got, tt.expected)
+			}
+		})
+	}
+}
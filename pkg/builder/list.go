@@ -0,0 +1,228 @@
+/*
+   Copyright (c) 2023 KylinSoft Co., Ltd.
+   Kylin trusted image builder(ktib) is licensed under Mulan PSL v2.
+   You can use this software according to the terms and conditions of the Mulan PSL v2.
+   You may obtain a copy of Mulan PSL v2 at:
+            http://license.coscl.org.cn/MulanPSL2
+   THIS SOFTWARE IS PROVIDED ON AN "AS IS" BASIS, WITHOUT WARRANTIES OF ANY KIND, EITHER EXPRESS OR IMPLIED, INCLUDING
+   BUT NOT LIMITED TO NON-INFRINGEMENT, MERCHANTABILITY OR FIT FOR A PARTICULAR PURPOSE.
+   See the Mulan PSL v2 for more details.
+*/
+
+package builder
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/containers/storage"
+	"github.com/sirupsen/logrus"
+)
+
+// BuilderContainer is a container of the store with its builder. Builder is nil for a container
+// that was not created by ktib, like one of podman.
+type BuilderContainer struct {
+	Container storage.Container
+	Builder   *Builder
+	Mounted   bool
+}
+
+// listFilters are the filters of ListBuilders, pruneFilters the filters of PruneBuilders.
+var (
+	listFilters  = []string{"name", "ancestor", "id", "mounted", "before", "since"}
+	pruneFilters = []string{"until"}
+)
+
+// ListBuilders returns the builders of the store that match filters, given in KEY=VALUE form.
+// Values of the same key match when any of them matches, different keys must all match. With
+// all the containers that are not builders are listed too.
+func ListBuilders(store storage.Store, all bool, filters []string) ([]BuilderContainer, error) {
+	match, err := parseFilters(store, filters, listFilters)
+	if err != nil {
+		return nil, err
+	}
+	containers, err := listContainers(store)
+	if err != nil {
+		return nil, err
+	}
+	var list []BuilderContainer
+	for _, c := range containers {
+		if (c.Builder != nil || all) && match(c) {
+			list = append(list, c)
+		}
+	}
+	return list, nil
+}
+
+// PruneBuilders removes the dangling builders that match filters and returns their IDs. Builders
+// are dangling when they have no name, which is the case for the builders a failed build leaves
+// behind, the builders created with from always have one. A mounted builder may belong to a build
+// that is still running, it is only removed with includeMounted.
+func PruneBuilders(store storage.Store, includeMounted bool, filters []string) ([]string, error) {
+	match, err := parseFilters(store, filters, pruneFilters)
+	if err != nil {
+		return nil, err
+	}
+	containers, err := listContainers(store)
+	if err != nil {
+		return nil, err
+	}
+	var removed []string
+	for _, c := range containers {
+		if c.Builder == nil || len(c.Container.Names) > 0 || !match(c) {
+			continue
+		}
+		if c.Mounted && !includeMounted {
+			logrus.Debugf("keeping builder %s, it is mounted", c.Container.ID)
+			continue
+		}
+		if err := c.Builder.Remove(); err != nil {
+			return removed, fmt.Errorf("failed to remove builder %s: %w", c.Container.ID, err)
+		}
+		removed = append(removed, c.Container.ID)
+	}
+	return removed, nil
+}
+
+// listContainers returns every container of the store with its builder, if it has one.
+func listContainers(store storage.Store) ([]BuilderContainer, error) {
+	containers, err := store.Containers()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]BuilderContainer, 0, len(containers))
+	for _, c := range containers {
+		b, err := readBuilder(store, c.ID)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				return nil, err
+			}
+			logrus.Debugf("container %s is not a builder", c.ID)
+			b = nil
+		}
+		mounted, err := store.Mounted(c.ID)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, BuilderContainer{Container: c, Builder: b, Mounted: mounted > 0})
+	}
+	return list, nil
+}
+
+// parseFilters turns KEY=VALUE filters with the keys in allowed into a function that matches
+// containers against them.
+func parseFilters(store storage.Store, filters []string, allowed []string) (func(BuilderContainer) bool, error) {
+	byKey := make(map[string][]func(BuilderContainer) bool)
+	for _, filter := range filters {
+		kv := strings.SplitN(filter, "=", 2)
+		if len(kv) != 2 || !contains(allowed, kv[0]) {
+			return nil, fmt.Errorf("invalid filter %q, use KEY=VALUE with one of the keys %s", filter, strings.Join(allowed, ", "))
+		}
+		key, value := kv[0], kv[1]
+		var match func(BuilderContainer) bool
+		switch key {
+		case "name":
+			re, err := regexp.Compile(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid name filter %q: %w", value, err)
+			}
+			match = func(c BuilderContainer) bool {
+				for _, name := range c.Container.Names {
+					if re.MatchString(name) {
+						return true
+					}
+				}
+				return false
+			}
+		case "id":
+			match = func(c BuilderContainer) bool {
+				return strings.HasPrefix(c.Container.ID, value)
+			}
+		case "ancestor":
+			imageID := value
+			if img, err := store.Image(value); err == nil {
+				imageID = img.ID
+			}
+			match = func(c BuilderContainer) bool {
+				if c.Container.ImageID != "" && strings.HasPrefix(c.Container.ImageID, imageID) {
+					return true
+				}
+				return c.Builder != nil && (c.Builder.FromImage == value || (c.Builder.FromImageID != "" && strings.HasPrefix(c.Builder.FromImageID, imageID)))
+			}
+		case "mounted":
+			mounted, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid mounted filter %q, use true or false", value)
+			}
+			match = func(c BuilderContainer) bool {
+				return c.Mounted == mounted
+			}
+		case "before", "until":
+			t, err := filterTime(store, value)
+			if err != nil {
+				return nil, err
+			}
+			match = func(c BuilderContainer) bool {
+				return c.Container.Created.Before(t)
+			}
+		case "since":
+			t, err := filterTime(store, value)
+			if err != nil {
+				return nil, err
+			}
+			match = func(c BuilderContainer) bool {
+				return c.Container.Created.After(t)
+			}
+		}
+		byKey[key] = append(byKey[key], match)
+	}
+	return func(c BuilderContainer) bool {
+		for _, matches := range byKey {
+			matched := false
+			for _, match := range matches {
+				if match(c) {
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// filterTime returns the time of a before, since or until filter. The value is the name or ID of
+// a container, whose creation time is used, a duration before now like 24h, a RFC3339 time, a
+// date or seconds since the epoch.
+func filterTime(store storage.Store, value string) (time.Time, error) {
+	if c, err := store.Container(value); err == nil {
+		return c.Created, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q, use a builder, a duration like 24h, a RFC3339 time or a date", value)
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
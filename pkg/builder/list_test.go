@@ -0,0 +1,153 @@
+package builder
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func containerIDs(list []BuilderContainer) []string {
+	var ids []string
+	for _, c := range list {
+		ids = append(ids, c.Container.ID)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func sorted(ids ...string) []string {
+	sort.Strings(ids)
+	return ids
+}
+
+func TestListAndPruneBuilders(t *testing.T) {
+	store := newTestStore(t)
+	named, err := NewBuilder(store, BuilderOptions{Container: "named"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a builder left behind by a build has no name
+	dangling, err := NewBuilder(store, BuilderOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a container of another tool has no builder state
+	foreign, err := store.CreateContainer("", []string{"podman-ctr"}, "", "", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := named.Mount(""); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := named.UMount(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	builders, err := FindAllBuilders(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(builders) != 2 {
+		t.Errorf("FindAllBuilders returned %d builders, want 2", len(builders))
+	}
+
+	tests := []struct {
+		name    string
+		all     bool
+		filters []string
+		want    []string
+		wantErr bool
+	}{
+		{name: "builders", want: sorted(named.ContainerID, dangling.ContainerID)},
+		{name: "all", all: true, want: sorted(named.ContainerID, dangling.ContainerID, foreign.ID)},
+		{name: "name", all: true, filters: []string{"name=^nam"}, want: sorted(named.ContainerID)},
+		{name: "names", all: true, filters: []string{"name=named", "name=podman"}, want: sorted(named.ContainerID, foreign.ID)},
+		{name: "id", filters: []string{"id=" + dangling.ContainerID[:12]}, want: sorted(dangling.ContainerID)},
+		{name: "mounted", filters: []string{"mounted=true"}, want: sorted(named.ContainerID)},
+		{name: "not mounted", filters: []string{"mounted=false"}, want: sorted(dangling.ContainerID)},
+		{name: "since", filters: []string{"since=1h"}, want: sorted(named.ContainerID, dangling.ContainerID)},
+		{name: "before", filters: []string{"before=1h"}},
+		{name: "since builder", filters: []string{"since=named"}, want: sorted(dangling.ContainerID)},
+		{name: "and", filters: []string{"since=1h", "mounted=false"}, want: sorted(dangling.ContainerID)},
+		{name: "unknown key", filters: []string{"label=a"}, wantErr: true},
+		{name: "bad value", filters: []string{"mounted=maybe"}, wantErr: true},
+		{name: "bad time", filters: []string{"since=yesterday"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			list, err := ListBuilders(store, tt.all, tt.filters)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ListBuilders error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := containerIDs(list); !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ListBuilders = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// a running build mounts its builder and a failed one leaves a checkpoint to resume from
+	running, err := NewBuilder(store, BuilderOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := running.Mount(""); err != nil {
+		t.Fatal(err)
+	}
+	resumable, err := NewBuilder(store, BuilderOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resumable.Checkpoint = &BuildCheckpoint{Dockerfile: "Dockerfile", Step: 1}
+	if err := resumable.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := PruneBuilders(store, false, []string{"until=1h"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 0 {
+		t.Errorf("prune until=1h removed %v", removed)
+	}
+	// a negative duration is a time in the future, every builder was created before it
+	removed, err = PruneBuilders(store, false, []string{"until=-1h"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := sorted(removed...), sorted(dangling.ContainerID, resumable.ContainerID); !reflect.DeepEqual(got, want) {
+		t.Errorf("prune until=-1h removed %v, want %v", got, want)
+	}
+	removed, err = PruneBuilders(store, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 0 {
+		t.Errorf("prune removed the mounted builders %v", removed)
+	}
+	removed, err = PruneBuilders(store, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{running.ContainerID}; !reflect.DeepEqual(removed, want) {
+		t.Errorf("prune --include-mounted removed %v, want %v", removed, want)
+	}
+	list, err := ListBuilders(store, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := containerIDs(list), sorted(named.ContainerID, foreign.ID); !reflect.DeepEqual(got, want) {
+		t.Errorf("after prune = %v, want %v", got, want)
+	}
+	// listing and pruning leave the containers of other tools alone
+	cdir, err := store.ContainerDirectory(foreign.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(cdir, lockFile)); !os.IsNotExist(err) {
+		t.Errorf("a lock file was created for the foreign container: %v", err)
+	}
+}
@@ -0,0 +1,176 @@
+/*
+   Copyright (c) 2023 KylinSoft Co., Ltd.
+   Kylin trusted image builder(ktib) is licensed under Mulan PSL v2.
+   You can use this software according to the terms and conditions of the Mulan PSL v2.
+   You may obtain a copy of Mulan PSL v2 at:
+            http://license.coscl.org.cn/MulanPSL2
+   THIS SOFTWARE IS PROVIDED ON AN "AS IS" BASIS, WITHOUT WARRANTIES OF ANY KIND, EITHER EXPRESS OR IMPLIED, INCLUDING
+   BUT NOT LIMITED TO NON-INFRINGEMENT, MERCHANTABILITY OR FIT FOR A PARTICULAR PURPOSE.
+   See the Mulan PSL v2 for more details.
+*/
+
+package builder
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/containers/storage"
+	"github.com/containers/storage/pkg/ioutils"
+	"github.com/containers/storage/pkg/lockfile"
+	"github.com/sirupsen/logrus"
+)
+
+// lockFile serializes the changes to the state of a builder between processes and goroutines.
+const lockFile = "ktib.lock"
+
+// ErrStaleBuilder is returned by Save when the state of the builder was saved by someone else
+// after it was read, writing it would lose their changes.
+var ErrStaleBuilder = errors.New("builder state was changed by another process")
+
+// builderLock returns the lock of the builder of the container with the state directory cdir.
+func builderLock(cdir string) (*lockfile.LockFile, error) {
+	return lockfile.GetLockFile(filepath.Join(cdir, lockFile))
+}
+
+// readBuilder reads the state of the builder of a container while holding its lock. A container
+// without a state is not a builder, it fails with os.ErrNotExist and no lock file is created in
+// its directory.
+func readBuilder(store storage.Store, containerID string) (*Builder, error) {
+	cdir, err := store.ContainerDirectory(containerID)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(filepath.Join(cdir, stateFile)); err != nil {
+		return nil, err
+	}
+	lock, err := builderLock(cdir)
+	if err != nil {
+		return nil, err
+	}
+	lock.RLock()
+	defer lock.Unlock()
+	b := &Builder{
+		Store: store,
+	}
+	if err := loadState(cdir, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// loadState decodes the state file in cdir into b.
+func loadState(cdir string, b *Builder) error {
+	buildstate, err := os.ReadFile(filepath.Join(cdir, stateFile))
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(buildstate, b); err != nil {
+		return err
+	}
+	b.state = buildstate
+	return nil
+}
+
+// changed tells whether the builder has changes that were not saved since it was read.
+func (b *Builder) changed() bool {
+	buildstate, err := json.Marshal(b)
+	return err != nil || !bytes.Equal(buildstate, b.state)
+}
+
+// Save writes the state of the builder. The write fails with ErrStaleBuilder when the state was
+// saved by someone else since the builder was read, Update changes a builder others may use.
+func (b *Builder) Save() error {
+	cdir, err := b.Store.ContainerDirectory(b.ContainerID)
+	if err != nil {
+		return err
+	}
+	lock, err := builderLock(cdir)
+	if err != nil {
+		return err
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	return b.save(cdir)
+}
+
+// Update applies fn to the builder and saves it while holding the lock of the builder. When the
+// state was saved by someone else since the builder was read, it is reloaded first, so that fn
+// changes the current state and no update is lost. Reloading would drop the changes made outside
+// of fn, a builder with unsaved changes fails with ErrStaleBuilder instead.
+func (b *Builder) Update(fn func() error) error {
+	cdir, err := b.Store.ContainerDirectory(b.ContainerID)
+	if err != nil {
+		return err
+	}
+	lock, err := builderLock(cdir)
+	if err != nil {
+		return err
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	generation, saved, err := savedGeneration(cdir)
+	if err != nil {
+		return err
+	}
+	if saved && generation != b.Generation {
+		if b.changed() {
+			return fmt.Errorf("%w: builder %s has unsaved changes from generation %d, it is at %d", ErrStaleBuilder, b.ContainerID, b.Generation, generation)
+		}
+		logrus.Debugf("reloading builder %s at generation %d, it was read at %d", b.ContainerID, generation, b.Generation)
+		current := &Builder{Store: b.Store, createdBy: b.createdBy, out: b.out, log: b.log}
+		if err := loadState(cdir, current); err != nil {
+			return err
+		}
+		*b = *current
+	}
+	if err := fn(); err != nil {
+		return err
+	}
+	return b.save(cdir)
+}
+
+// savedGeneration returns the generation of the state file in cdir and whether there is one, a
+// builder moved to a new container by rebase has none yet.
+func savedGeneration(cdir string) (uint64, bool, error) {
+	var state struct {
+		Generation uint64
+	}
+	buildstate, err := os.ReadFile(filepath.Join(cdir, stateFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, false, nil
+		}
+		return 0, false, err
+	}
+	if err := json.Unmarshal(buildstate, &state); err != nil {
+		return 0, false, err
+	}
+	return state.Generation, true, nil
+}
+
+// save writes the state of the builder to cdir, the caller holds the lock of the builder.
+func (b *Builder) save(cdir string) error {
+	generation, saved, err := savedGeneration(cdir)
+	if err != nil {
+		return err
+	}
+	if saved && generation != b.Generation {
+		return fmt.Errorf("%w: builder %s was saved at generation %d, it was read at %d", ErrStaleBuilder, b.ContainerID, generation, b.Generation)
+	}
+	b.Generation++
+	buildstate, err := json.Marshal(b)
+	if err == nil {
+		err = ioutils.AtomicWriteFile(filepath.Join(cdir, stateFile), buildstate, 0600)
+	}
+	if err != nil {
+		b.Generation--
+		return err
+	}
+	b.state = buildstate
+	return nil
+}
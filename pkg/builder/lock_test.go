@@ -0,0 +1,155 @@
+package builder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"gitee.com/openeuler/ktib/pkg/options"
+	"github.com/containers/storage"
+	"github.com/containers/storage/pkg/reexec"
+)
+
+func TestMain(m *testing.M) {
+	if reexec.Init() {
+		return
+	}
+	os.Exit(m.Run())
+}
+
+func newTestStore(t *testing.T) storage.Store {
+	t.Helper()
+	dir := t.TempDir()
+	store, err := storage.GetStore(storage.StoreOptions{
+		RunRoot:         filepath.Join(dir, "run"),
+		GraphRoot:       filepath.Join(dir, "root"),
+		GraphDriverName: "vfs",
+	})
+	if err != nil {
+		t.Skipf("unable to create a store: %v", err)
+	}
+	t.Cleanup(func() {
+		if _, err := store.Shutdown(true); err != nil {
+			t.Error(err)
+		}
+	})
+	return store
+}
+
+func TestConcurrentUpdates(t *testing.T) {
+	store := newTestStore(t)
+	b, err := NewBuilder(store, BuilderOptions{Container: "lock-test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const workers = 8
+	var wg sync.WaitGroup
+	errs := make(chan error, 3*workers)
+	for i := 0; i < workers; i++ {
+		i := i
+		callers := []func(*Builder) error{
+			func(w *Builder) error { return w.Mount("") },
+			func(w *Builder) error {
+				return w.SetLabel(w.ContainerID, map[string]string{fmt.Sprintf("label%d", i): "value"})
+			},
+			// the runtime only has to exit, the state is changed by the mount of the rootfs
+			func(w *Builder) error {
+				return w.Run(context.Background(), []string{"true"}, options.RUNOption{Runtime: "true"})
+			},
+		}
+		for _, caller := range callers {
+			wg.Add(1)
+			go func(caller func(*Builder) error) {
+				defer wg.Done()
+				w, err := FindBuilder(store, b.ContainerID)
+				if err == nil {
+					err = caller(w)
+				}
+				errs <- err
+			}(caller)
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	final, err := FindBuilder(store, b.ContainerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(final.Labels) != workers {
+		t.Errorf("labels = %v, want %d labels", final.Labels, workers)
+	}
+	if final.MountPoint == "" {
+		t.Error("mount point was lost")
+	}
+	// one save when the builder was created and one for every caller
+	if want := uint64(1 + 3*workers); final.Generation != want {
+		t.Errorf("generation = %d, want %d", final.Generation, want)
+	}
+	if err := final.UMount(); err != nil {
+		t.Error(err)
+	}
+	// every caller mounted the rootfs once
+	if _, err := store.Unmount(b.ContainerID, true); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestStaleSave(t *testing.T) {
+	store := newTestStore(t)
+	b, err := NewBuilder(store, BuilderOptions{Container: "stale-test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := FindBuilder(store, b.ContainerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := FindBuilder(store, b.ContainerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	third, err := FindBuilder(store, b.ContainerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first.AddEnv("FIRST", "1")
+	if err := first.Save(); err != nil {
+		t.Fatal(err)
+	}
+	second.AddEnv("SECOND", "2")
+	if err := second.Save(); !errors.Is(err, ErrStaleBuilder) {
+		t.Fatalf("stale save error = %v, want %v", err, ErrStaleBuilder)
+	}
+	// reloading second would drop the change made outside of the update
+	if err := second.Update(func() error {
+		second.AddEnv("SECOND", "2")
+		return nil
+	}); !errors.Is(err, ErrStaleBuilder) {
+		t.Fatalf("stale update error = %v, want %v", err, ErrStaleBuilder)
+	}
+	// third has no unsaved changes, it is reloaded and only changed by the update
+	if err := third.Update(func() error {
+		third.AddEnv("THIRD", "3")
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	final, err := FindBuilder(store, b.ContainerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"FIRST=1", "THIRD=3"}; fmt.Sprint(final.Env) != fmt.Sprint(want) {
+		t.Errorf("env = %v, want %v", final.Env, want)
+	}
+}
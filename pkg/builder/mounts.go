@@ -0,0 +1,446 @@
+/*
+   Copyright (c) 2023 KylinSoft Co., Ltd.
+   Kylin trusted image builder(ktib) is licensed under Mulan PSL v2.
+   You can use this software according to the terms and conditions of the Mulan PSL v2.
+   You may obtain a copy of Mulan PSL v2 at:
+            http://license.coscl.org.cn/MulanPSL2
+   THIS SOFTWARE IS PROVIDED ON AN "AS IS" BASIS, WITHOUT WARRANTIES OF ANY KIND, EITHER EXPRESS OR IMPLIED, INCLUDING
+   BUT NOT LIMITED TO NON-INFRINGEMENT, MERCHANTABILITY OR FIT FOR A PARTICULAR PURPOSE.
+   See the Mulan PSL v2 for more details.
+*/
+
+package builder
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/containers/storage/pkg/archive"
+	"github.com/containers/storage/pkg/idtools"
+	securejoin "github.com/cyphar/filepath-securejoin"
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/sirupsen/logrus"
+)
+
+// cacheMountDir holds the directories of RUN --mount=type=cache below the graph root of the
+// store, so that they survive between builds.
+const cacheMountDir = "ktib-cache"
+
+// runMount is one parsed RUN --mount option.
+type runMount struct {
+	Type     string
+	Target   string
+	Source   string
+	From     string
+	ID       string
+	ReadOnly bool
+	Required bool
+	Mode     *os.FileMode
+	UID      int
+	GID      int
+}
+
+// parseMount parses the comma separated key=value list of a RUN --mount option.
+func parseMount(spec string) (runMount, error) {
+	m := runMount{Type: "bind"}
+	var readWrite bool
+	for _, field := range strings.Split(spec, ",") {
+		key, value, hasValue := strings.Cut(field, "=")
+		key = strings.ToLower(strings.TrimSpace(key))
+		boolValue := func() (bool, error) {
+			if !hasValue {
+				return true, nil
+			}
+			return strconv.ParseBool(value)
+		}
+		var err error
+		switch key {
+		case "type":
+			m.Type = value
+		case "target", "dst", "destination":
+			m.Target = value
+		case "source", "src":
+			m.Source = value
+		case "from":
+			m.From = value
+		case "id":
+			m.ID = value
+		case "ro", "readonly":
+			m.ReadOnly, err = boolValue()
+		case "rw", "readwrite":
+			readWrite, err = boolValue()
+		case "required":
+			m.Required, err = boolValue()
+		case "sharing":
+			if value != "shared" && value != "private" && value != "locked" {
+				err = fmt.Errorf("unknown sharing mode %q", value)
+			}
+		case "mode":
+			var mode uint64
+			if mode, err = strconv.ParseUint(value, 8, 32); err == nil {
+				fileMode := os.FileMode(mode)
+				m.Mode = &fileMode
+			}
+		case "uid":
+			m.UID, err = strconv.Atoi(value)
+		case "gid":
+			m.GID, err = strconv.Atoi(value)
+		default:
+			err = fmt.Errorf("unknown option %q", key)
+		}
+		if err != nil {
+			return m, fmt.Errorf("invalid mount %q: %w", spec, err)
+		}
+	}
+	switch m.Type {
+	case "bind":
+		// bind mounts are read-only unless rw is given
+		m.ReadOnly = !readWrite
+	case "cache":
+		if m.ID == "" {
+			m.ID = m.Target
+		}
+	case "secret":
+		if m.ID == "" && m.Target != "" {
+			m.ID = filepath.Base(m.Target)
+		}
+		if m.ID == "" {
+			return m, fmt.Errorf("invalid mount %q: a secret requires an id or a target", spec)
+		}
+		if m.Target == "" {
+			m.Target = filepath.Join("/run/secrets", m.ID)
+		}
+		m.ReadOnly = true
+	default:
+		return m, fmt.Errorf("invalid mount %q: unsupported type %q", spec, m.Type)
+	}
+	if m.Target == "" {
+		return m, fmt.Errorf("invalid mount %q: a target is required", spec)
+	}
+	return m, nil
+}
+
+// runMounts turns the --mount options of a RUN into mounts of the runtime spec. Content that has
+// to be prepared for a mount, secrets and writable copies of bind sources, is placed in a
+// temporary directory that cleanup removes once the step is done. Nothing of it is written to
+// the rootfs, so it never ends up in a layer.
+func (b *Executor) runMounts(values []string) ([]specs.Mount, func(), error) {
+	cleanup := func() {}
+	if len(values) == 0 {
+		return nil, cleanup, nil
+	}
+	runDir, err := b.store.ContainerRunDirectory(b.builders.ContainerID)
+	if err != nil {
+		return nil, cleanup, err
+	}
+	if err := os.MkdirAll(runDir, 0700); err != nil {
+		return nil, cleanup, err
+	}
+	tmpDir, err := os.MkdirTemp(runDir, "mounts")
+	if err != nil {
+		return nil, cleanup, err
+	}
+	cleanup = func() {
+		if err := os.RemoveAll(tmpDir); err != nil {
+			b.log.Warnf("unable to remove %s: %s", tmpDir, err)
+		}
+	}
+	var mounts []specs.Mount
+	for i, value := range values {
+		m, err := parseMount(value)
+		if err != nil {
+			cleanup()
+			return nil, func() {}, err
+		}
+		if !filepath.IsAbs(m.Target) {
+			m.Target = filepath.Join("/", b.builders.Workdir, m.Target)
+		}
+		// uid and gid are ids in the container, the files are created with the ids on the host
+		ids, err := b.builders.idMappings().ToHost(idtools.IDPair{UID: m.UID, GID: m.GID})
+		if err != nil {
+			cleanup()
+			return nil, func() {}, err
+		}
+		m.UID, m.GID = ids.UID, ids.GID
+		var source string
+		switch m.Type {
+		case "cache":
+			source, err = b.cacheMountSource(m)
+		case "secret":
+			source, err = b.secretMountSource(m, filepath.Join(tmpDir, strconv.Itoa(i)))
+		case "bind":
+			source, err = b.bindMountSource(m, filepath.Join(tmpDir, strconv.Itoa(i)))
+		}
+		if err != nil {
+			cleanup()
+			return nil, func() {}, err
+		}
+		if source == "" {
+			continue
+		}
+		options := []string{"rbind"}
+		if m.ReadOnly {
+			options = append(options, "ro")
+		}
+		mounts = append(mounts, specs.Mount{
+			Destination: m.Target,
+			Type:        "bind",
+			Source:      source,
+			Options:     options,
+		})
+	}
+	return mounts, cleanup, nil
+}
+
+// hashMounts returns a digest of what the bind mounts of a RUN read, which is part of the cache
+// key of the step: the content of a source in the build context, or the image of the stage or
+// image given with from. Cache and secret mounts do not change the key.
+func (b *Executor) hashMounts(values []string) (string, error) {
+	h := sha256.New()
+	for _, value := range values {
+		m, err := parseMount(value)
+		if err != nil {
+			return "", err
+		}
+		if m.Type != "bind" {
+			continue
+		}
+		var content string
+		if m.From == "" {
+			source, err := securejoin.SecureJoin(b.contextDir, m.Source)
+			if err != nil {
+				return "", err
+			}
+			if content, err = hashSources([]string{source}, b.filter); err != nil {
+				return "", fmt.Errorf("error resolving bind mount source: %w", err)
+			}
+		} else if content, err = b.fromImageID(m.From); err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%s %s\n", value, content)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// fromImageID returns the ID of the image a stage or image given with from currently has.
+func (b *Executor) fromImageID(from string) (string, error) {
+	if stage, ok := b.stages[strings.ToLower(from)]; ok {
+		if stage == b.builders {
+			return "", fmt.Errorf("--from=%s refers to the current stage", from)
+		}
+		ctr, err := b.store.Container(stage.ContainerID)
+		if err != nil {
+			return "", err
+		}
+		return ctr.ImageID, nil
+	}
+	img, err := b.store.Image(from)
+	if err != nil {
+		return "", fmt.Errorf("no stage or local image named %q: %w", from, err)
+	}
+	return img.ID, nil
+}
+
+// cacheMountSource returns the persistent directory of a cache mount, creating it on first use.
+func (b *Executor) cacheMountSource(m runMount) (string, error) {
+	if m.From != "" || m.Source != "" {
+		return "", fmt.Errorf("cache mounts with from or source are not supported")
+	}
+	dir := filepath.Join(b.store.GraphRoot(), cacheMountDir, digest.FromString(m.ID).Encoded())
+	if _, err := os.Stat(dir); err == nil {
+		return dir, nil
+	}
+	mode := os.FileMode(0755)
+	if m.Mode != nil {
+		mode = *m.Mode
+	}
+	if err := os.MkdirAll(dir, mode); err != nil {
+		return "", err
+	}
+	if err := os.Chmod(dir, mode); err != nil {
+		return "", err
+	}
+	return dir, os.Chown(dir, m.UID, m.GID)
+}
+
+// secretMountSource copies the secret to a file with the requested owner and mode. A secret that
+// was not passed with --secret is skipped unless the mount is required.
+func (b *Executor) secretMountSource(m runMount, path string) (string, error) {
+	src, ok := b.secrets[m.ID]
+	if !ok {
+		if m.Required {
+			return "", fmt.Errorf("secret %q is required but was not provided with --secret", m.ID)
+		}
+		logrus.Debugf("skipping secret %q, it was not provided", m.ID)
+		return "", nil
+	}
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return "", fmt.Errorf("error reading secret %q: %w", m.ID, err)
+	}
+	mode := os.FileMode(0400)
+	if m.Mode != nil {
+		mode = *m.Mode
+	}
+	if err := os.WriteFile(path, data, mode); err != nil {
+		return "", err
+	}
+	return path, os.Chown(path, m.UID, m.GID)
+}
+
+// bindMountSource returns the path to bind for a bind mount. The source is read from the build
+// context, or from the stage or image given with from. A copy is made when the mount is
+// writable, so that writes are discarded, and when the ignore file hides part of the context.
+func (b *Executor) bindMountSource(m runMount, copyDir string) (string, error) {
+	root, filter := b.contextDir, b.filter
+	if m.From != "" {
+		var err error
+		if root, err = b.stageRoot(m.From); err != nil {
+			return "", err
+		}
+		filter = nil
+	}
+	source, err := securejoin.SecureJoin(root, m.Source)
+	if err != nil {
+		return "", err
+	}
+	fi, err := os.Stat(source)
+	if err != nil {
+		return "", fmt.Errorf("error resolving bind mount source: %w", err)
+	}
+	excluded, err := filter.excluded(source)
+	if err != nil {
+		return "", err
+	}
+	if excluded && (!fi.IsDir() || filter.skipDir(source)) {
+		return "", fmt.Errorf("%q is excluded by the ignore file of the build context", m.Source)
+	}
+	archiver := archive.NewDefaultArchiver()
+	if rel, ok := filter.relative(source); ok && fi.IsDir() {
+		if err := os.MkdirAll(copyDir, fi.Mode().Perm()); err != nil {
+			return "", err
+		}
+		return copyDir, copyContextDir(archiver, filter, rel, copyDir)
+	}
+	if m.ReadOnly {
+		return source, nil
+	}
+	if fi.IsDir() {
+		return copyDir, archiver.CopyWithTar(source, copyDir)
+	}
+	return copyDir, archiver.CopyFileWithTar(source, copyDir)
+}
+
+// parseVolumes turns volumes in the SOURCE:DESTINATION[:OPTIONS] form into bind mounts. SOURCE is
+// a path on the host, OPTIONS a comma separated list of ro, rw, bind, rbind and the propagation
+// modes. The SELinux relabel options z and Z are accepted and ignored.
+func parseVolumes(volumes []string) ([]specs.Mount, error) {
+	var mounts []specs.Mount
+	for _, volume := range volumes {
+		fields := strings.Split(volume, ":")
+		if len(fields) < 2 || len(fields) > 3 || fields[0] == "" {
+			return nil, fmt.Errorf("invalid volume %q, use SOURCE:DESTINATION[:OPTIONS]", volume)
+		}
+		source, err := filepath.Abs(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(source); err != nil {
+			return nil, fmt.Errorf("error resolving volume source: %w", err)
+		}
+		if !filepath.IsAbs(fields[1]) {
+			return nil, fmt.Errorf("invalid volume %q, the destination must be an absolute path", volume)
+		}
+		bind, readOnly, propagation := "rbind", false, ""
+		if len(fields) == 3 {
+			for _, option := range strings.Split(fields[2], ",") {
+				switch option {
+				case "ro":
+					readOnly = true
+				case "rw":
+					readOnly = false
+				case "bind", "rbind":
+					bind = option
+				case "private", "rprivate", "shared", "rshared", "slave", "rslave":
+					propagation = option
+				case "z", "Z":
+				default:
+					return nil, fmt.Errorf("invalid option %q of volume %q", option, volume)
+				}
+			}
+		}
+		options := []string{bind}
+		if readOnly {
+			options = append(options, "ro")
+		}
+		if propagation != "" {
+			options = append(options, propagation)
+		}
+		mounts = append(mounts, specs.Mount{
+			Destination: filepath.Clean(fields[1]),
+			Type:        "bind",
+			Source:      source,
+			Options:     options,
+		})
+	}
+	return mounts, nil
+}
+
+// createMountTargets creates the mount points of mounts that do not exist in rootfs yet. The
+// returned function removes them again, provided the command left them empty.
+func createMountTargets(rootfs string, mounts []specs.Mount) (func(), error) {
+	var created []string
+	remove := func() {
+		for i := len(created) - 1; i >= 0; i-- {
+			if err := os.Remove(created[i]); err != nil && !errors.Is(err, os.ErrNotExist) {
+				logrus.Debugf("leaving mount point %s in place: %s", created[i], err)
+			}
+		}
+	}
+	for _, m := range mounts {
+		target, err := securejoin.SecureJoin(rootfs, m.Destination)
+		if err != nil {
+			remove()
+			return func() {}, err
+		}
+		if _, err := os.Lstat(target); err == nil {
+			continue
+		}
+		// remember every directory created on the way, they are removed innermost first
+		var missing []string
+		for dir := filepath.Dir(target); dir != rootfs; dir = filepath.Dir(dir) {
+			if _, err := os.Lstat(dir); err == nil {
+				break
+			}
+			missing = append([]string{dir}, missing...)
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			remove()
+			return func() {}, err
+		}
+		created = append(created, missing...)
+		fi, err := os.Stat(m.Source)
+		if err != nil {
+			remove()
+			return func() {}, err
+		}
+		if fi.IsDir() {
+			err = os.Mkdir(target, 0755)
+		} else {
+			err = os.WriteFile(target, nil, 0644)
+		}
+		if err != nil {
+			remove()
+			return func() {}, err
+		}
+		created = append(created, target)
+	}
+	return remove, nil
+}
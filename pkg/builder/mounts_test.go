@@ -0,0 +1,145 @@
+package builder
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestParseMount(t *testing.T) {
+	mode := os.FileMode(0440)
+	tests := []struct {
+		name     string
+		spec     string
+		expected runMount
+		wantErr  bool
+	}{
+		{
+			name:     "cache",
+			spec:     "type=cache,target=/var/cache/dnf",
+			expected: runMount{Type: "cache", Target: "/var/cache/dnf", ID: "/var/cache/dnf"},
+		},
+		{
+			name:     "cache with id and owner",
+			spec:     "type=cache,id=dnf,target=/var/cache/dnf,sharing=locked,uid=1001,gid=0",
+			expected: runMount{Type: "cache", Target: "/var/cache/dnf", ID: "dnf", UID: 1001},
+		},
+		{
+			name:     "secret default target",
+			spec:     "type=secret,id=repo,required",
+			expected: runMount{Type: "secret", Target: "/run/secrets/repo", ID: "repo", ReadOnly: true, Required: true},
+		},
+		{
+			name:     "secret with mode",
+			spec:     "type=secret,id=repo,target=/etc/yum.repos.d/internal.repo,mode=0440",
+			expected: runMount{Type: "secret", Target: "/etc/yum.repos.d/internal.repo", ID: "repo", ReadOnly: true, Mode: &mode},
+		},
+		{
+			name:     "bind is read-only by default",
+			spec:     "type=bind,from=build,source=/out,target=/mnt",
+			expected: runMount{Type: "bind", Target: "/mnt", Source: "/out", From: "build", ReadOnly: true},
+		},
+		{
+			name:     "writable bind",
+			spec:     "target=/src,rw",
+			expected: runMount{Type: "bind", Target: "/src"},
+		},
+		{name: "missing target", spec: "type=cache", wantErr: true},
+		{name: "unknown type", spec: "type=ssh,target=/x", wantErr: true},
+		{name: "unknown option", spec: "type=cache,target=/x,size=1G", wantErr: true},
+		{name: "bad mode", spec: "type=secret,id=a,mode=rw", wantErr: true},
+		{name: "bad sharing", spec: "type=cache,target=/x,sharing=all", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseMount(tt.spec)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseMount() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("parseMount() = %+v, want %+v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestCreateMountTargets(t *testing.T) {
+	rootfs := t.TempDir()
+	src := t.TempDir()
+	secret := filepath.Join(src, "secret")
+	if err := os.WriteFile(secret, []byte("token"), 0400); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(rootfs, "var/cache"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	mounts := []specs.Mount{
+		{Destination: "/var/cache", Source: src},
+		{Destination: "/root/.cache/pip", Source: src},
+		{Destination: "/run/secrets/repo", Source: secret},
+	}
+	remove, err := createMountTargets(rootfs, mounts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(filepath.Join(rootfs, "root/.cache/pip")); err != nil || !fi.IsDir() {
+		t.Errorf("expected a directory mount point, got %v", err)
+	}
+	if fi, err := os.Stat(filepath.Join(rootfs, "run/secrets/repo")); err != nil || !fi.Mode().IsRegular() {
+		t.Errorf("expected a file mount point, got %v", err)
+	}
+	// content written by the command next to a mount point is kept
+	if err := os.WriteFile(filepath.Join(rootfs, "root/.profile"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	remove()
+	for _, path := range []string{"root/.cache", "run"} {
+		if _, err := os.Lstat(filepath.Join(rootfs, path)); !os.IsNotExist(err) {
+			t.Errorf("mount point %s should have been removed", path)
+		}
+	}
+	for _, path := range []string{"root/.profile", "var/cache"} {
+		if _, err := os.Lstat(filepath.Join(rootfs, path)); err != nil {
+			t.Errorf("%s should have been kept: %v", path, err)
+		}
+	}
+}
+
+func TestParseVolumes(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		volume  string
+		want    specs.Mount
+		wantErr bool
+	}{
+		{
+			volume: dir + ":/data",
+			want:   specs.Mount{Destination: "/data", Type: "bind", Source: dir, Options: []string{"rbind"}},
+		},
+		{
+			volume: dir + ":/data/:ro,Z,rshared",
+			want:   specs.Mount{Destination: "/data", Type: "bind", Source: dir, Options: []string{"rbind", "ro", "rshared"}},
+		},
+		{
+			volume: dir + ":/data:bind,ro,rw",
+			want:   specs.Mount{Destination: "/data", Type: "bind", Source: dir, Options: []string{"bind"}},
+		},
+		{volume: dir, wantErr: true},
+		{volume: dir + ":data", wantErr: true},
+		{volume: dir + ":/data:exec", wantErr: true},
+		{volume: filepath.Join(dir, "missing") + ":/data", wantErr: true},
+	}
+	for _, tt := range tests {
+		mounts, err := parseVolumes([]string{tt.volume})
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseVolumes(%q) error = %v, wantErr %v", tt.volume, err, tt.wantErr)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(mounts, []specs.Mount{tt.want}) {
+			t.Errorf("parseVolumes(%q) = %+v, want %+v", tt.volume, mounts, tt.want)
+		}
+	}
+}
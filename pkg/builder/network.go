@@ -0,0 +1,116 @@
+/*
+   Copyright (c) 2023 KylinSoft Co., Ltd.
+   Kylin trusted image builder(ktib) is licensed under Mulan PSL v2.
+   You can use this software according to the terms and conditions of the Mulan PSL v2.
+   You may obtain a copy of Mulan PSL v2 at:
+            http://license.coscl.org.cn/MulanPSL2
+   THIS SOFTWARE IS PROVIDED ON AN "AS IS" BASIS, WITHOUT WARRANTIES OF ANY KIND, EITHER EXPRESS OR IMPLIED, INCLUDING
+   BUT NOT LIMITED TO NON-INFRINGEMENT, MERCHANTABILITY OR FIT FOR A PARTICULAR PURPOSE.
+   See the Mulan PSL v2 for more details.
+*/
+
+package builder
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	securejoin "github.com/cyphar/filepath-securejoin"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/opencontainers/runtime-tools/generate"
+)
+
+const (
+	// NetworkNone runs the command in a private network namespace that only has loopback.
+	NetworkNone = "none"
+	// NetworkHost shares the network namespace of the host.
+	NetworkHost = "host"
+)
+
+// hostResolvConf is copied into the container when the host network is used.
+var hostResolvConf = "/etc/resolv.conf"
+
+// ValidateNetwork checks a --network value, an empty value selects NetworkNone.
+func ValidateNetwork(network string) error {
+	switch network {
+	case "", NetworkNone, NetworkHost:
+		return nil
+	}
+	return fmt.Errorf("unsupported network mode %q, use %q or %q", network, NetworkNone, NetworkHost)
+}
+
+// setupNetwork configures the network namespace of the spec. The default spec already creates
+// a new namespace, in which the runtime only brings up the loopback interface.
+func setupNetwork(g *generate.Generator, network string) error {
+	if err := ValidateNetwork(network); err != nil {
+		return err
+	}
+	if network == NetworkHost {
+		return g.RemoveLinuxNamespace(string(specs.NetworkNamespace))
+	}
+	return nil
+}
+
+// networkMounts writes the /etc/hosts and /etc/resolv.conf of a run to dir and returns the
+// mounts that put them in place, so the files of the rootfs are never modified.
+func networkMounts(rootfs, dir, network, hostname string) ([]specs.Mount, error) {
+	hosts, err := buildHosts(rootfs, hostname)
+	if err != nil {
+		return nil, err
+	}
+	var resolv []byte
+	if network == NetworkHost {
+		// without a network there is no name server to reach, so only the host mode gets one
+		if resolv, err = os.ReadFile(hostResolvConf); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+	var mounts []specs.Mount
+	for _, file := range []struct {
+		name    string
+		content []byte
+	}{{"hosts", hosts}, {"resolv.conf", resolv}} {
+		path := filepath.Join(dir, file.name)
+		if err := os.WriteFile(path, file.content, 0644); err != nil {
+			return nil, err
+		}
+		mounts = append(mounts, specs.Mount{
+			Destination: filepath.Join("/etc", file.name),
+			Type:        "bind",
+			Source:      path,
+			Options:     []string{"rbind", "ro"},
+		})
+	}
+	return mounts, nil
+}
+
+// buildHosts returns the /etc/hosts of the image with the localhost entries and the hostname
+// of the container added.
+func buildHosts(rootfs, hostname string) ([]byte, error) {
+	var b strings.Builder
+	b.WriteString("127.0.0.1\tlocalhost localhost.localdomain\n")
+	b.WriteString("::1\tlocalhost localhost.localdomain ip6-localhost ip6-loopback\n")
+	path, err := securejoin.SecureJoin(rootfs, "/etc/hosts")
+	if err != nil {
+		return nil, err
+	}
+	image, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(image), "\n") {
+		fields := strings.Fields(line)
+		// the localhost entries written above replace the ones of the image
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") || fields[0] == "127.0.0.1" || fields[0] == "::1" {
+			continue
+		}
+		b.WriteString(line + "\n")
+	}
+	if hostname != "" {
+		fmt.Fprintf(&b, "127.0.1.1\t%s\n", hostname)
+	}
+	return []byte(b.String()), nil
+}
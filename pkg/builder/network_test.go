@@ -0,0 +1,102 @@
+package builder
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/opencontainers/runtime-tools/generate"
+)
+
+func TestSetupNetwork(t *testing.T) {
+	hasNetNS := func(g *generate.Generator) bool {
+		for _, ns := range g.Config.Linux.Namespaces {
+			if ns.Type == specs.NetworkNamespace {
+				return true
+			}
+		}
+		return false
+	}
+	for _, tt := range []struct {
+		network string
+		private bool
+		wantErr bool
+	}{
+		{network: "", private: true},
+		{network: NetworkNone, private: true},
+		{network: NetworkHost, private: false},
+		{network: "bridge", wantErr: true},
+	} {
+		t.Run(tt.network, func(t *testing.T) {
+			g, err := generate.New("linux")
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = setupNetwork(&g, tt.network)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("setupNetwork() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && hasNetNS(&g) != tt.private {
+				t.Errorf("setupNetwork(%q) private namespace = %v, want %v", tt.network, hasNetNS(&g), tt.private)
+			}
+		})
+	}
+}
+
+func TestNetworkMounts(t *testing.T) {
+	rootfs := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(rootfs, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(rootfs, "etc/hosts"), []byte("127.0.0.1 localhost\n# mirror\n10.0.0.5 mirror.example.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	resolv := filepath.Join(t.TempDir(), "resolv.conf")
+	if err := os.WriteFile(resolv, []byte("nameserver 10.0.0.1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer func(orig string) { hostResolvConf = orig }(hostResolvConf)
+	hostResolvConf = resolv
+
+	read := func(path string) string {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	dir := t.TempDir()
+	mounts, err := networkMounts(rootfs, dir, NetworkNone, "abc123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mounts) != 2 || mounts[0].Destination != "/etc/hosts" || mounts[1].Destination != "/etc/resolv.conf" {
+		t.Fatalf("unexpected mounts %+v", mounts)
+	}
+	hosts := read(mounts[0].Source)
+	for _, want := range []string{"127.0.0.1\tlocalhost", "10.0.0.5 mirror.example.com", "127.0.1.1\tabc123"} {
+		if !strings.Contains(hosts, want) {
+			t.Errorf("hosts %q does not contain %q", hosts, want)
+		}
+	}
+	if strings.Count(hosts, "127.0.0.1") != 1 {
+		t.Errorf("hosts %q should contain a single localhost entry", hosts)
+	}
+	if got := read(mounts[1].Source); got != "" {
+		t.Errorf("resolv.conf without network = %q, want it empty", got)
+	}
+
+	mounts, err = networkMounts(rootfs, t.TempDir(), NetworkHost, "abc123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := read(mounts[1].Source); got != "nameserver 10.0.0.1\n" {
+		t.Errorf("resolv.conf with host network = %q", got)
+	}
+	if got := read(filepath.Join(rootfs, "etc/hosts")); strings.Contains(got, "abc123") {
+		t.Errorf("the hosts file of the rootfs must not be modified")
+	}
+}
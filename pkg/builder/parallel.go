@@ -0,0 +1,218 @@
+/*
+   Copyright (c) 2023 KylinSoft Co., Ltd.
+   Kylin trusted image builder(ktib) is licensed under Mulan PSL v2.
+   You can use this software according to the terms and conditions of the Mulan PSL v2.
+   You may obtain a copy of Mulan PSL v2 at:
+            http://license.coscl.org.cn/MulanPSL2
+   THIS SOFTWARE IS PROVIDED ON AN "AS IS" BASIS, WITHOUT WARRANTIES OF ANY KIND, EITHER EXPRESS OR IMPLIED, INCLUDING
+   BUT NOT LIMITED TO NON-INFRINGEMENT, MERCHANTABILITY OR FIT FOR A PARTICULAR PURPOSE.
+   See the Mulan PSL v2 for more details.
+*/
+
+package builder
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"gitee.com/openeuler/ktib/pkg/options"
+	"github.com/containers/storage"
+	"github.com/moby/buildkit/frontend/dockerfile/parser"
+	"gopkg.in/yaml.v2"
+)
+
+// BuildJob is one image of a parallel build: the Dockerfile, the tag of the image and the build
+// args added to the ones of the build.
+type BuildJob struct {
+	Dockerfile string
+	Tag        string
+	Args       map[string]string
+}
+
+// BuildResult is the outcome of a BuildJob.
+type BuildResult struct {
+	Job      BuildJob
+	ImageID  string
+	Duration time.Duration
+	Err      error
+}
+
+// matrixEntry is one build-arg set of a matrix file.
+type matrixEntry struct {
+	Tag  string                 `yaml:"tag"`
+	Args map[string]interface{} `yaml:"args"`
+}
+
+// MatrixJobs returns a job for every build-arg set of the matrix file path, all of them building
+// dockerfile. The file is a YAML list of entries, each with the args of its build in args and an
+// optional tag. Entries without a tag use tag, in which the args of the entry are expanded, so that
+// app:jdk${JDK_VERSION} gives every entry a tag of its own.
+func MatrixJobs(path, dockerfile, tag string) ([]BuildJob, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var entries []matrixEntry
+	if err := yaml.UnmarshalStrict(data, &entries); err != nil {
+		return nil, fmt.Errorf("error parsing the build matrix %s: %w", path, err)
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("the build matrix %s has no entries", path)
+	}
+	var jobs []BuildJob
+	for i, entry := range entries {
+		job := BuildJob{Dockerfile: dockerfile, Tag: entry.Tag, Args: make(map[string]string)}
+		for key, value := range entry.Args {
+			if value == nil {
+				value = ""
+			}
+			job.Args[key] = fmt.Sprint(value)
+		}
+		if job.Tag == "" {
+			if job.Tag, err = expandArgs(tag, job.Args, parser.DefaultEscapeToken); err != nil {
+				return nil, fmt.Errorf("error expanding the tag of entry %d of the build matrix: %w", i+1, err)
+			}
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+// parallelRun is the state shared by the builds of one BuildParallel call.
+type parallelRun struct {
+	// store is held by a build while it uses the store, the lock files of containers/storage can
+	// not be used by goroutines of one process at the same time. A build releases it while the
+	// command of a RUN step runs and while it waits for a step of another build.
+	store sync.Mutex
+	// mu guards steps, the locks of the steps being executed by their cache key
+	mu    sync.Mutex
+	steps map[string]*stepLock
+}
+
+// stepLock serializes the builds executing the same step, users counts the builds holding or
+// waiting for it.
+type stepLock struct {
+	sync.Mutex
+	users int
+}
+
+// BuildParallel builds the jobs with at most workers builds running at the same time. The output
+// of every build is collected and written to op.Out as a whole once the build is done, so that
+// the output of builds does not mix. The builds take turns using the store, the commands of their
+// RUN steps run at the same time. A failed build does not stop the others, the returned error
+// tells how many failed.
+func BuildParallel(ctx context.Context, store storage.Store, op *options.BuildOptions, workers int, jobs []BuildJob) ([]BuildResult, error) {
+	if err := validateJobs(op, jobs); err != nil {
+		return nil, err
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	shared := &parallelRun{steps: make(map[string]*stepLock)}
+	out := op.Out
+	if out == nil {
+		out = os.Stdout
+	}
+	var (
+		results = make([]BuildResult, len(jobs))
+		slots   = make(chan struct{}, workers)
+		outMu   sync.Mutex
+		wg      sync.WaitGroup
+	)
+	for i, job := range jobs {
+		wg.Add(1)
+		go func(i int, job BuildJob) {
+			defer wg.Done()
+			results[i] = BuildResult{Job: job}
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				results[i].Err = fmt.Errorf("build not started: %w", ctx.Err())
+				return
+			}
+			defer func() { <-slots }()
+			var buf bytes.Buffer
+			started := time.Now()
+			results[i].ImageID, results[i].Err = buildJob(ctx, store, op, shared, job, &buf)
+			results[i].Duration = time.Since(started)
+
+			outMu.Lock()
+			defer outMu.Unlock()
+			if op.Progress != ProgressJSON {
+				fmt.Fprintf(out, "--- build %d/%d: %s (%s)\n", i+1, len(jobs), job.Tag, job.Dockerfile)
+			}
+			if _, err := io.Copy(out, &buf); err != nil {
+				results[i].Err = errors.Join(results[i].Err, err)
+			}
+			if results[i].Err != nil && op.Progress != ProgressJSON {
+				fmt.Fprintf(out, "--- build %d/%d failed: %s\n", i+1, len(jobs), results[i].Err)
+			}
+		}(i, job)
+	}
+	wg.Wait()
+	failed := 0
+	for _, result := range results {
+		if result.Err != nil {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return results, fmt.Errorf("%d of %d builds failed", failed, len(jobs))
+	}
+	return results, nil
+}
+
+// buildJob builds one job of the parallel run shared with the options of the build, writing its
+// output to out.
+func buildJob(ctx context.Context, store storage.Store, op *options.BuildOptions, shared *parallelRun, job BuildJob, out io.Writer) (string, error) {
+	jobOp := *op
+	jobOp.Tags = job.Tag
+	// parallel builds can not share the input of the process, their RUN steps read nothing
+	jobOp.In = bytes.NewReader(nil)
+	jobOp.Out = out
+	jobOp.Err = out
+	jobOp.Args = copyStringMap(op.Args)
+	if jobOp.Args == nil {
+		jobOp.Args = make(map[string]string)
+	}
+	for key, value := range job.Args {
+		jobOp.Args[key] = value
+	}
+	return buildDockerfiles(ctx, store, &jobOp, shared, job.Dockerfile)
+}
+
+// validateJobs checks the options that can not be shared by parallel builds. Every job needs a
+// tag of its own, committing to the tag of another build would replace its image.
+func validateJobs(op *options.BuildOptions, jobs []BuildJob) error {
+	if len(jobs) == 0 {
+		return errors.New("no builds given")
+	}
+	if op.IIDFile != "" {
+		return errors.New("--iidfile can only be used with a single build, the image IDs of parallel builds are listed at the end")
+	}
+	if op.Resume != "" {
+		return errors.New("only a single build can be resumed")
+	}
+	byTag := make(map[string][]string)
+	for _, job := range jobs {
+		byTag[job.Tag] = append(byTag[job.Tag], job.Dockerfile)
+	}
+	var duplicates []string
+	for tag, dockerfiles := range byTag {
+		if len(dockerfiles) > 1 {
+			duplicates = append(duplicates, tag)
+		}
+	}
+	if len(duplicates) > 0 {
+		sort.Strings(duplicates)
+		return fmt.Errorf("several builds use the tag %v, every build needs a tag of its own", duplicates)
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package builder
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gitee.com/openeuler/ktib/pkg/options"
+)
+
+func TestMatrixJobs(t *testing.T) {
+	tests := []struct {
+		name    string
+		matrix  string
+		tag     string
+		want    []BuildJob
+		wantErr bool
+	}{
+		{
+			name:   "tag from args",
+			matrix: "- args:\n    JDK_VERSION: 11\n- args:\n    JDK_VERSION: 17\n    DEBUG:\n",
+			tag:    "app:jdk${JDK_VERSION}",
+			want: []BuildJob{
+				{Dockerfile: "Dockerfile", Tag: "app:jdk11", Args: map[string]string{"JDK_VERSION": "11"}},
+				{Dockerfile: "Dockerfile", Tag: "app:jdk17", Args: map[string]string{"JDK_VERSION": "17", "DEBUG": ""}},
+			},
+		},
+		{
+			name:   "own tag",
+			matrix: "- tag: app:lts\n  args:\n    JDK_VERSION: 21\n",
+			tag:    "app",
+			want: []BuildJob{
+				{Dockerfile: "Dockerfile", Tag: "app:lts", Args: map[string]string{"JDK_VERSION": "21"}},
+			},
+		},
+		{name: "empty", matrix: "[]\n", wantErr: true},
+		{name: "unknown field", matrix: "- env:\n    A: 1\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "matrix.yaml")
+			if err := os.WriteFile(path, []byte(tt.matrix), 0644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := MatrixJobs(path, "Dockerfile", tt.tag)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("MatrixJobs() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("MatrixJobs() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateJobs(t *testing.T) {
+	jobs := []BuildJob{{Dockerfile: "a", Tag: "app"}, {Dockerfile: "b", Tag: "app"}}
+	if err := validateJobs(&options.BuildOptions{}, jobs); err == nil || !strings.Contains(err.Error(), "[app]") {
+		t.Errorf("validateJobs() with a shared tag error = %v", err)
+	}
+	jobs[1].Tag = "web"
+	if err := validateJobs(&options.BuildOptions{IIDFile: "iid"}, jobs); err == nil {
+		t.Error("validateJobs() with an iidfile succeeded")
+	}
+	if err := validateJobs(&options.BuildOptions{}, jobs); err != nil {
+		t.Errorf("validateJobs() error = %v", err)
+	}
+}
+
+func TestBuildParallel(t *testing.T) {
+	store := newTestStore(t)
+	contextDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(contextDir, "hello.txt"), []byte("hello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dockerfiles := map[string]string{
+		"app.Dockerfile":    "FROM scratch\nARG NAME\nCOPY hello.txt /hello.txt\nLABEL name=$NAME\n",
+		"broken.Dockerfile": "FROM scratch\nCOPY missing /missing\n",
+	}
+	for name, content := range dockerfiles {
+		if err := os.WriteFile(filepath.Join(contextDir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	app := filepath.Join(contextDir, "app.Dockerfile")
+	jobs := []BuildJob{
+		{Dockerfile: app, Tag: "parallel-a", Args: map[string]string{"NAME": "a"}},
+		{Dockerfile: app, Tag: "parallel-b", Args: map[string]string{"NAME": "b"}},
+		{Dockerfile: filepath.Join(contextDir, "broken.Dockerfile"), Tag: "parallel-broken"},
+	}
+	var out bytes.Buffer
+	op := &options.BuildOptions{
+		ContextDirectory: contextDir,
+		Rm:               true,
+		ForceRm:          true,
+		Out:              &out,
+		Err:              &out,
+	}
+	results, err := BuildParallel(context.Background(), store, op, 2, jobs)
+	if err == nil || err.Error() != "1 of 3 builds failed" {
+		t.Fatalf("BuildParallel() error = %v", err)
+	}
+	for i, result := range results[:2] {
+		if result.Err != nil {
+			t.Fatalf("build %d: %v", i+1, result.Err)
+		}
+		img, err := store.Image("docker.io/library/" + result.Job.Tag + ":latest")
+		if err != nil || img.ID != result.ImageID {
+			t.Errorf("image of build %d = %v, %v, want %s", i+1, img, err, result.ImageID)
+		}
+	}
+	if results[0].ImageID == results[1].ImageID {
+		t.Error("builds with different args have the same image")
+	}
+	if results[2].Err == nil || results[2].ImageID != "" {
+		t.Errorf("result of the broken build = %+v", results[2])
+	}
+	for i, job := range jobs {
+		if !strings.Contains(out.String(), "--- build "+string(rune('1'+i))+"/3: "+job.Tag) {
+			t.Errorf("output has no header of build %d: %q", i+1, out.String())
+		}
+	}
+	if builders, err := ListBuilders(store, false, nil); err != nil || len(builders) != 0 {
+		t.Errorf("builders after the parallel build = %v, %v", builders, err)
+	}
+}
+
+func TestLockStep(t *testing.T) {
+	shared := &parallelRun{steps: make(map[string]*stepLock)}
+	first := &Executor{shared: shared}
+	second := &Executor{shared: shared}
+
+	shared.store.Lock()
+	unlock := first.lockStep("key")
+	locked := make(chan func())
+	go func() {
+		shared.store.Lock()
+		locked <- second.lockStep("key")
+	}()
+	// the second build waits for the step without holding the store
+	shared.store.Unlock()
+	shared.store.Lock()
+	select {
+	case <-locked:
+		t.Fatal("the step was locked twice")
+	default:
+	}
+	unlock()
+	shared.store.Unlock()
+	unlockSecond := <-locked
+	unlockSecond()
+	shared.store.Unlock()
+
+	if len(shared.steps) != 0 {
+		t.Errorf("steps = %v, want the unlocked steps removed", shared.steps)
+	}
+}
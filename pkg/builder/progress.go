@@ -0,0 +1,210 @@
+/*
+   Copyright (c) 2023 KylinSoft Co., Ltd.
+   Kylin trusted image builder(ktib) is licensed under Mulan PSL v2.
+   You can use this software according to the terms and conditions of the Mulan PSL v2.
+   You may obtain a copy of Mulan PSL v2 at:
+            http://license.coscl.org.cn/MulanPSL2
+   THIS SOFTWARE IS PROVIDED ON AN "AS IS" BASIS, WITHOUT WARRANTIES OF ANY KIND, EITHER EXPRESS OR IMPLIED, INCLUDING
+   BUT NOT LIMITED TO NON-INFRINGEMENT, MERCHANTABILITY OR FIT FOR A PARTICULAR PURPOSE.
+   See the Mulan PSL v2 for more details.
+*/
+
+package builder
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Progress modes of a build: plain prints the steps for people, json prints one ProgressEvent per
+// line for tools.
+const (
+	ProgressPlain = "plain"
+	ProgressJSON  = "json"
+)
+
+// Types of the progress events.
+const (
+	EventStepStart = "step-start"
+	EventStepEnd   = "step-end"
+	EventCache     = "cache"
+	EventLayer     = "layer"
+	EventWarning   = "warning"
+	EventImage     = "image"
+)
+
+// ValidateProgress checks the progress mode of a build, an empty mode is plain.
+func ValidateProgress(progress string) error {
+	switch progress {
+	case "", ProgressPlain, ProgressJSON:
+		return nil
+	}
+	return fmt.Errorf("unknown progress mode %q, use %s or %s", progress, ProgressPlain, ProgressJSON)
+}
+
+// ProgressEvent is one line of the json progress of a build. Only the fields that belong to the
+// type of the event are set.
+type ProgressEvent struct {
+	Type        string    `json:"type"`
+	Time        time.Time `json:"time"`
+	Step        string    `json:"step,omitempty"`
+	Instruction string    `json:"instruction,omitempty"`
+	// DurationMs is the time a step took in milliseconds
+	DurationMs float64 `json:"durationMs,omitempty"`
+	Error      string  `json:"error,omitempty"`
+	// Cached tells whether a step was found in the cache
+	Cached  *bool    `json:"cached,omitempty"`
+	ImageID string   `json:"imageID,omitempty"`
+	Names   []string `json:"names,omitempty"`
+	Digest  string   `json:"digest,omitempty"`
+	Size    int64    `json:"size,omitempty"`
+	Message string   `json:"message,omitempty"`
+}
+
+// progress reports the steps of a build to out.
+type progress struct {
+	mu     sync.Mutex
+	format string
+	out    io.Writer
+}
+
+func newProgress(format string, out io.Writer) *progress {
+	if format == "" {
+		format = ProgressPlain
+	}
+	return &progress{format: format, out: out}
+}
+
+func (p *progress) json() bool {
+	return p.format == ProgressJSON
+}
+
+func (p *progress) emit(event ProgressEvent) {
+	event.Time = time.Now()
+	line, err := json.Marshal(event)
+	if err != nil {
+		logrus.Debugf("unable to encode progress event: %s", err)
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fmt.Fprintf(p.out, "%s\n", line)
+}
+
+func (p *progress) stepStart(step, expression string) {
+	if !p.json() {
+		fmt.Fprintf(p.out, "Step %s : %s\n", step, expression)
+		return
+	}
+	p.emit(ProgressEvent{Type: EventStepStart, Step: step, Instruction: expression})
+}
+
+func (p *progress) stepEnd(step string, started time.Time, err error) {
+	if !p.json() {
+		return
+	}
+	event := ProgressEvent{Type: EventStepEnd, Step: step, DurationMs: float64(time.Since(started)) / float64(time.Millisecond)}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	p.emit(event)
+}
+
+func (p *progress) cache(step, imageID string, cached bool) {
+	if !p.json() {
+		if cached {
+			fmt.Fprintf(p.out, " ---> Using cache %s\n", shortID(imageID))
+		}
+		return
+	}
+	p.emit(ProgressEvent{Type: EventCache, Step: step, Cached: &cached, ImageID: imageID})
+}
+
+func (p *progress) layer(step, imageID, digest string, size int64) {
+	if !p.json() {
+		fmt.Fprintf(p.out, " ---> %s\n", shortID(imageID))
+		return
+	}
+	p.emit(ProgressEvent{Type: EventLayer, Step: step, ImageID: imageID, Digest: digest, Size: size})
+}
+
+func (p *progress) image(imageID string, names []string) {
+	if !p.json() {
+		return
+	}
+	p.emit(ProgressEvent{Type: EventImage, ImageID: imageID, Names: names})
+}
+
+// warningHook reports the warnings logged during json builds as events of the build that logged
+// them, logrus has one logger for the whole process. A build logs with the entry of its progress,
+// which carries the progress in its context.
+var (
+	warningHook     = &progressHook{builds: make(map[*progress]struct{})}
+	warningHookOnce sync.Once
+)
+
+// progressKey is the context key of the progress of the build that logs an entry.
+type progressKey struct{}
+
+type progressHook struct {
+	mu     sync.Mutex
+	builds map[*progress]struct{}
+}
+
+// Levels implements logrus.Hook.
+func (h *progressHook) Levels() []logrus.Level {
+	return []logrus.Level{logrus.WarnLevel}
+}
+
+// Fire implements logrus.Hook. A warning that was not logged by a build, like one of a library,
+// belongs to a build only when a single json build is running.
+func (h *progressHook) Fire(entry *logrus.Entry) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	event := ProgressEvent{Type: EventWarning, Message: strings.TrimSpace(entry.Message)}
+	if entry.Context != nil {
+		if p, ok := entry.Context.Value(progressKey{}).(*progress); ok {
+			if _, running := h.builds[p]; running {
+				p.emit(event)
+			}
+			return nil
+		}
+	}
+	if len(h.builds) == 1 {
+		for p := range h.builds {
+			p.emit(event)
+		}
+	}
+	return nil
+}
+
+// logger returns the entry the build of p logs with, its warnings become events of the build.
+func (p *progress) logger() *logrus.Entry {
+	return logrus.WithContext(context.WithValue(context.Background(), progressKey{}, p))
+}
+
+// hookWarnings reports the warnings logged with the entry of p until the returned function is
+// called as events of a json build.
+func (p *progress) hookWarnings() func() {
+	if !p.json() {
+		return func() {}
+	}
+	warningHookOnce.Do(func() {
+		logrus.AddHook(warningHook)
+	})
+	warningHook.mu.Lock()
+	warningHook.builds[p] = struct{}{}
+	warningHook.mu.Unlock()
+	return func() {
+		warningHook.mu.Lock()
+		delete(warningHook.builds, p)
+		warningHook.mu.Unlock()
+	}
+}
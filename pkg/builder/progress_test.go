@@ -0,0 +1,153 @@
+package builder
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gitee.com/openeuler/ktib/pkg/options"
+	"github.com/sirupsen/logrus"
+)
+
+func TestValidateProgress(t *testing.T) {
+	tests := []struct {
+		progress string
+		wantErr  bool
+	}{
+		{progress: ""},
+		{progress: ProgressPlain},
+		{progress: ProgressJSON},
+		{progress: "tty", wantErr: true},
+	}
+	for _, tt := range tests {
+		if err := ValidateProgress(tt.progress); (err != nil) != tt.wantErr {
+			t.Errorf("ValidateProgress(%q) error = %v, wantErr %v", tt.progress, err, tt.wantErr)
+		}
+	}
+}
+
+func decodeEvents(t *testing.T, out string) []ProgressEvent {
+	t.Helper()
+	var events []ProgressEvent
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		var event ProgressEvent
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatalf("line %q is not an event: %v", line, err)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+func TestBuildProgress(t *testing.T) {
+	store := newTestStore(t)
+	contextDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(contextDir, "hello.txt"), []byte("hello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dockerfile := filepath.Join(contextDir, "Dockerfile")
+	if err := os.WriteFile(dockerfile, []byte("FROM scratch\nENV A=1\nCOPY hello.txt /hello.txt\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	build := func(progress string) (string, string) {
+		var out, errOut bytes.Buffer
+		iidfile := filepath.Join(t.TempDir(), "iid")
+		op := &options.BuildOptions{
+			Tags:             "progress-test",
+			ContextDirectory: contextDir,
+			Progress:         progress,
+			IIDFile:          iidfile,
+			Args:             map[string]string{"UNUSED": "1"},
+			Out:              &out,
+			Err:              &errOut,
+		}
+		if err := BuildDockerfiles(context.Background(), store, op, dockerfile); err != nil {
+			t.Fatal(err)
+		}
+		iid, err := os.ReadFile(iidfile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.Image(string(iid)); err != nil {
+			t.Errorf("image %q of the iidfile: %v", iid, err)
+		}
+		return out.String(), string(iid)
+	}
+
+	out, iid := build(ProgressJSON)
+	if len(warningHook.builds) != 0 {
+		t.Errorf("%d builds still receive warnings after the build", len(warningHook.builds))
+	}
+	var types []string
+	for _, event := range decodeEvents(t, out) {
+		types = append(types, event.Type+":"+event.Step)
+		switch event.Type {
+		case EventStepEnd:
+			if event.DurationMs <= 0 || event.Error != "" {
+				t.Errorf("step end %+v", event)
+			}
+		case EventCache:
+			if event.Cached == nil || *event.Cached {
+				t.Errorf("cache event %+v of a first build", event)
+			}
+		case EventLayer:
+			if !strings.HasPrefix(event.Digest, "sha256:") || event.Size <= 0 || event.ImageID == "" {
+				t.Errorf("layer event %+v", event)
+			}
+		case EventWarning:
+			if !strings.Contains(event.Message, "UNUSED") {
+				t.Errorf("warning event %+v", event)
+			}
+		case EventImage:
+			if event.ImageID != iid || len(event.Names) != 1 {
+				t.Errorf("image event %+v, want image %s", event, iid)
+			}
+		}
+	}
+	want := "step-start:1 step-end:1 step-start:2 step-end:2 step-start:3 cache:3 layer:3 step-end:3 warning: image:"
+	if got := strings.Join(types, " "); got != want {
+		t.Errorf("events = %s, want %s", got, want)
+	}
+
+	out, _ = build(ProgressPlain)
+	if !strings.Contains(out, "Step 3 : COPY hello.txt /hello.txt\n ---> Using cache ") {
+		t.Errorf("plain output = %q", out)
+	}
+}
+
+func TestWarningHook(t *testing.T) {
+	var outA, outB bytes.Buffer
+	a := newProgress(ProgressJSON, &outA)
+	b := newProgress(ProgressJSON, &outB)
+	defer a.hookWarnings()()
+	unhookB := b.hookWarnings()
+
+	a.logger().Warn("from a")
+	b.logger().Warn("from b")
+	// with two builds running a warning of no build belongs to neither
+	logrus.Warn("from a library")
+	unhookB()
+	logrus.Warn("while only a runs")
+	b.logger().Warn("after b")
+
+	for name, tt := range map[string]struct {
+		out  *bytes.Buffer
+		want []string
+	}{
+		"a": {out: &outA, want: []string{"from a", "while only a runs"}},
+		"b": {out: &outB, want: []string{"from b"}},
+	} {
+		var got []string
+		for _, event := range decodeEvents(t, tt.out.String()) {
+			got = append(got, event.Message)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("warnings of build %s = %q, want %q", name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+/*
+   Copyright (c) 2023 KylinSoft Co., Ltd.
+   Kylin trusted image builder(ktib) is licensed under Mulan PSL v2.
+   You can use this software according to the terms and conditions of the Mulan PSL v2.
+   You may obtain a copy of Mulan PSL v2 at:
+            http://license.coscl.org.cn/MulanPSL2
+   THIS SOFTWARE IS PROVIDED ON AN "AS IS" BASIS, WITHOUT WARRANTIES OF ANY KIND, EITHER EXPRESS OR IMPLIED, INCLUDING
+   BUT NOT LIMITED TO NON-INFRINGEMENT, MERCHANTABILITY OR FIT FOR A PARTICULAR PURPOSE.
+   See the Mulan PSL v2 for more details.
+*/
+
+package builder
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SourceDateEpoch is the environment variable that sets the timestamp of reproducible builds,
+// see https://reproducible-builds.org/specs/source-date-epoch/.
+const SourceDateEpoch = "SOURCE_DATE_EPOCH"
+
+// ParseTimestamp turns a number of seconds since the epoch, as given with --timestamp or
+// SOURCE_DATE_EPOCH, into the time used for everything a commit writes.
+func ParseTimestamp(value string) (*time.Time, error) {
+	seconds, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	if err != nil || seconds < 0 {
+		return nil, fmt.Errorf("invalid timestamp %q, the number of seconds since 1970-01-01 is required", value)
+	}
+	t := time.Unix(seconds, 0).UTC()
+	return &t, nil
+}
+
+// now returns the time recorded for a step of the builder, the fixed timestamp of a
+// reproducible build if one was set.
+func (b *Builder) now() time.Time {
+	if b.Timestamp != nil {
+		return *b.Timestamp
+	}
+	return time.Now().UTC()
+}
+
+// xattrPrefix is the prefix of the PAX records that carry extended attributes.
+const xattrPrefix = "SCHILY.xattr."
+
+// tarEntry is a header of a layer tar and the position of its content in the file.
+type tarEntry struct {
+	hdr    *tar.Header
+	offset int64
+}
+
+// reproducibleLayer rewrites the layer tar in f so that it only depends on the content of the
+// files: entries are sorted by name, modification times are clamped to epoch, access and change
+// times and owner names are dropped and the SELinux label of the host is left out. Hard links
+// are written last, after the files they point to.
+func reproducibleLayer(f *os.File, epoch time.Time) (io.ReadCloser, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	counter := &countingReader{r: f}
+	tr := tar.NewReader(counter)
+	var entries []tarEntry
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading layer: %w", err)
+		}
+		entries = append(entries, tarEntry{hdr: normalizeHeader(hdr, epoch), offset: counter.n})
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		li, lj := entries[i].hdr.Typeflag == tar.TypeLink, entries[j].hdr.Typeflag == tar.TypeLink
+		if li != lj {
+			return lj
+		}
+		return entries[i].hdr.Name < entries[j].hdr.Name
+	})
+
+	r, w := io.Pipe()
+	go func() {
+		tw := tar.NewWriter(w)
+		for _, e := range entries {
+			if err := tw.WriteHeader(e.hdr); err != nil {
+				w.CloseWithError(err)
+				return
+			}
+			if e.hdr.Size > 0 {
+				if _, err := io.Copy(tw, io.NewSectionReader(f, e.offset, e.hdr.Size)); err != nil {
+					w.CloseWithError(err)
+					return
+				}
+			}
+		}
+		w.CloseWithError(tw.Close())
+	}()
+	return r, nil
+}
+
+// normalizeHeader returns a copy of hdr without the values that differ between two builds of
+// the same content.
+func normalizeHeader(hdr *tar.Header, epoch time.Time) *tar.Header {
+	n := &tar.Header{
+		Typeflag: hdr.Typeflag,
+		Name:     hdr.Name,
+		Linkname: hdr.Linkname,
+		Size:     hdr.Size,
+		Mode:     hdr.Mode,
+		Uid:      hdr.Uid,
+		Gid:      hdr.Gid,
+		ModTime:  hdr.ModTime.Truncate(time.Second),
+		Devmajor: hdr.Devmajor,
+		Devminor: hdr.Devminor,
+	}
+	if n.ModTime.After(epoch) {
+		n.ModTime = epoch
+	}
+	for key, value := range hdr.PAXRecords {
+		if strings.HasPrefix(key, xattrPrefix) && key != xattrPrefix+"security.selinux" {
+			if n.PAXRecords == nil {
+				n.PAXRecords = make(map[string]string)
+			}
+			n.PAXRecords[key] = value
+		}
+	}
+	return n
+}
+
+// countingReader counts the bytes read, which tells where the content of a tar entry starts.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,147 @@
+package builder
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseTimestamp(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    int64
+		wantErr bool
+	}{
+		{value: "0", want: 0},
+		{value: "1700000000", want: 1700000000},
+		{value: " 1700000000\n", want: 1700000000},
+		{value: "-1", wantErr: true},
+		{value: "yesterday", wantErr: true},
+		{value: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseTimestamp(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseTimestamp(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if err == nil && (got.Unix() != tt.want || got.Location() != time.UTC) {
+			t.Errorf("ParseTimestamp(%q) = %v, want %d in UTC", tt.value, got, tt.want)
+		}
+	}
+}
+
+type testEntry struct {
+	hdr     tar.Header
+	content string
+}
+
+func writeTestTar(t *testing.T, path string, entries []testEntry) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	tw := tar.NewWriter(f)
+	for _, e := range entries {
+		hdr := e.hdr
+		hdr.Size = int64(len(e.content))
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readReproducible(t *testing.T, path string, epoch time.Time) []byte {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	rc, err := reproducibleLayer(f, epoch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestReproducibleLayer(t *testing.T) {
+	epoch := time.Unix(1700000000, 0).UTC()
+	old := time.Unix(1600000000, 500).UTC()
+	dir := t.TempDir()
+	first := filepath.Join(dir, "first.tar")
+	writeTestTar(t, first, []testEntry{
+		{hdr: tar.Header{Typeflag: tar.TypeDir, Name: "usr/", Mode: 0755, ModTime: time.Now(), Uname: "root", Format: tar.FormatPAX}},
+		{hdr: tar.Header{Typeflag: tar.TypeLink, Name: "etc/link", Linkname: "usr/file", ModTime: time.Now()}},
+		{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "usr/file", Mode: 0644, ModTime: old, AccessTime: time.Now(), Uname: "builder", Gname: "builder", Uid: 1001, Gid: 1001,
+			PAXRecords: map[string]string{"SCHILY.xattr.user.test": "1", "SCHILY.xattr.security.selinux": "system_u:object_r:container_file_t:s0:c1,c2"}}, content: "hello"},
+		{hdr: tar.Header{Typeflag: tar.TypeDir, Name: "etc/", Mode: 0755, ModTime: time.Now()}},
+	})
+	second := filepath.Join(dir, "second.tar")
+	writeTestTar(t, second, []testEntry{
+		{hdr: tar.Header{Typeflag: tar.TypeDir, Name: "etc/", Mode: 0755, ModTime: time.Now().Add(time.Hour)}},
+		{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "usr/file", Mode: 0644, ModTime: old, Uid: 1001, Gid: 1001,
+			PAXRecords: map[string]string{"SCHILY.xattr.user.test": "1"}}, content: "hello"},
+		{hdr: tar.Header{Typeflag: tar.TypeLink, Name: "etc/link", Linkname: "usr/file", ModTime: time.Now().Add(time.Minute)}},
+		{hdr: tar.Header{Typeflag: tar.TypeDir, Name: "usr/", Mode: 0755, ModTime: time.Now()}},
+	})
+
+	a := readReproducible(t, first, epoch)
+	if b := readReproducible(t, second, epoch); !bytes.Equal(a, b) {
+		t.Fatal("layers with the same content differ")
+	}
+
+	tr := tar.NewReader(bytes.NewReader(a))
+	var names []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+		if hdr.ModTime.After(epoch) {
+			t.Errorf("%s: mtime %v is later than %v", hdr.Name, hdr.ModTime, epoch)
+		}
+		if hdr.Uname != "" || hdr.Gname != "" || !hdr.AccessTime.IsZero() {
+			t.Errorf("%s: header not normalized: %+v", hdr.Name, hdr)
+		}
+		if hdr.Name == "usr/file" {
+			if !hdr.ModTime.Equal(old.Truncate(time.Second)) {
+				t.Errorf("mtime = %v, want %v", hdr.ModTime, old.Truncate(time.Second))
+			}
+			want := map[string]string{"SCHILY.xattr.user.test": "1"}
+			if !reflect.DeepEqual(hdr.PAXRecords, want) {
+				t.Errorf("pax records = %v, want %v", hdr.PAXRecords, want)
+			}
+			content, _ := io.ReadAll(tr)
+			if string(content) != "hello" {
+				t.Errorf("content = %q", content)
+			}
+		}
+	}
+	want := []string{"etc/", "usr/", "usr/file", "etc/link"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("entries = %v, want %v", names, want)
+	}
+}
@@ -0,0 +1,175 @@
+/*
+   Copyright (c) 2023 KylinSoft Co., Ltd.
+   Kylin trusted image builder(ktib) is licensed under Mulan PSL v2.
+   You can use this software according to the terms and conditions of the Mulan PSL v2.
+   You may obtain a copy of Mulan PSL v2 at:
+            http://license.coscl.org.cn/MulanPSL2
+   THIS SOFTWARE IS PROVIDED ON AN "AS IS" BASIS, WITHOUT WARRANTIES OF ANY KIND, EITHER EXPRESS OR IMPLIED, INCLUDING
+   BUT NOT LIMITED TO NON-INFRINGEMENT, MERCHANTABILITY OR FIT FOR A PARTICULAR PURPOSE.
+   See the Mulan PSL v2 for more details.
+*/
+
+package builder
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"gitee.com/openeuler/ktib/pkg/options"
+	"github.com/containers/common/pkg/capabilities"
+	"github.com/containers/common/pkg/seccomp"
+	"github.com/containers/storage/pkg/unshare"
+	units "github.com/docker/go-units"
+	"github.com/opencontainers/runtime-tools/generate"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultPidsLimit is the number of processes a command may create unless --pids-limit says
+	// otherwise, so that a fork bomb in a build step can not exhaust the host.
+	DefaultPidsLimit = 2048
+	// cpuPeriod is the CFS period that --cpus is converted with, in microseconds.
+	cpuPeriod = 100000
+	// seccompUnconfined turns the seccomp filter off.
+	seccompUnconfined = "unconfined"
+)
+
+// ValidateSecurity checks the resource and privilege options before anything is run.
+func ValidateSecurity(op options.SecurityOption) error {
+	g, err := generate.New("linux")
+	if err != nil {
+		return err
+	}
+	return setupSecurity(&g, op, logrus.NewEntry(logrus.StandardLogger()))
+}
+
+// setupSecurity applies the resource limits, capabilities, seccomp profile and no-new-privileges
+// setting of op to the spec. Capabilities are applied first, the default seccomp profile allows
+// some syscalls depending on the capabilities of the process. Warnings are logged with log.
+func setupSecurity(g *generate.Generator, op options.SecurityOption, log *logrus.Entry) error {
+	if err := setupResources(g, op, log); err != nil {
+		return err
+	}
+	if err := setupCapabilities(g, op.CapAdd, op.CapDrop); err != nil {
+		return err
+	}
+	return setupSecurityOpts(g, op.SecurityOpt)
+}
+
+// setupResources sets the cgroup limits of the spec. Without privileges on the host the cgroups
+// can not be configured, the limits are then left out with a warning.
+func setupResources(g *generate.Generator, op options.SecurityOption, log *logrus.Entry) error {
+	var memory int64
+	if op.Memory != "" {
+		var err error
+		if memory, err = units.RAMInBytes(op.Memory); err != nil {
+			return fmt.Errorf("invalid --memory %q: %w", op.Memory, err)
+		}
+		if memory <= 0 {
+			return fmt.Errorf("invalid --memory %q: the limit must be positive", op.Memory)
+		}
+	}
+	if op.CPUs < 0 {
+		return fmt.Errorf("invalid --cpus %v: the value can not be negative", op.CPUs)
+	}
+	if op.PidsLimit < -1 {
+		return fmt.Errorf("invalid --pids-limit %d: use -1 for no limit", op.PidsLimit)
+	}
+	if memory == 0 && op.CPUs == 0 && op.PidsLimit == 0 {
+		return nil
+	}
+	if unshare.IsRootless() {
+		log.Warnf("resource limits are ignored when running rootless")
+		return nil
+	}
+	if memory > 0 {
+		g.SetLinuxResourcesMemoryLimit(memory)
+		// the swap limit covers memory and swap, an equal value keeps the step from swapping
+		g.SetLinuxResourcesMemorySwap(memory)
+	}
+	if op.CPUs > 0 {
+		g.SetLinuxResourcesCPUPeriod(cpuPeriod)
+		g.SetLinuxResourcesCPUQuota(int64(op.CPUs * cpuPeriod))
+	}
+	if op.PidsLimit != 0 {
+		g.SetLinuxResourcesPidsLimit(op.PidsLimit)
+	}
+	return nil
+}
+
+// setupCapabilities drops and adds capabilities to the default set of the spec. "ALL" drops or
+// adds every capability, names are accepted with or without the CAP_ prefix.
+func setupCapabilities(g *generate.Generator, add, drop []string) error {
+	if len(add) == 0 && len(drop) == 0 {
+		return nil
+	}
+	var base []string
+	if g.Config.Process.Capabilities != nil {
+		base = g.Config.Process.Capabilities.Bounding
+	}
+	caps, err := capabilities.MergeCapabilities(base, add, drop)
+	if err != nil {
+		return err
+	}
+	g.ClearProcessCapabilities()
+	for _, c := range caps {
+		if err := g.AddProcessCapability(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setupSecurityOpts applies the --security-opt values. Without a seccomp option the default
+// profile is used where the host supports seccomp.
+func setupSecurityOpts(g *generate.Generator, opts []string) error {
+	profile := ""
+	for _, opt := range opts {
+		key, value, hasValue := strings.Cut(opt, "=")
+		switch key {
+		case "seccomp":
+			if !hasValue || value == "" {
+				return fmt.Errorf("invalid --security-opt %q, expected seccomp=<profile.json> or seccomp=%s", opt, seccompUnconfined)
+			}
+			profile = value
+		case "no-new-privileges":
+			enable := true
+			if hasValue {
+				var err error
+				if enable, err = strconv.ParseBool(value); err != nil {
+					return fmt.Errorf("invalid --security-opt %q: %w", opt, err)
+				}
+			}
+			g.SetProcessNoNewPrivileges(enable)
+		default:
+			return fmt.Errorf("unsupported --security-opt %q", opt)
+		}
+	}
+	switch profile {
+	case seccompUnconfined:
+		g.Config.Linux.Seccomp = nil
+	case "":
+		if !seccomp.IsSupported() {
+			logrus.Debugf("seccomp is not supported, running without a seccomp profile")
+			return nil
+		}
+		spec, err := seccomp.GetDefaultProfile(g.Config)
+		if err != nil {
+			return fmt.Errorf("error loading the default seccomp profile: %w", err)
+		}
+		g.Config.Linux.Seccomp = spec
+	default:
+		data, err := os.ReadFile(profile)
+		if err != nil {
+			return fmt.Errorf("error reading seccomp profile: %w", err)
+		}
+		spec, err := seccomp.LoadProfileFromBytes(data, g.Config)
+		if err != nil {
+			return fmt.Errorf("error loading seccomp profile %s: %w", profile, err)
+		}
+		g.Config.Linux.Seccomp = spec
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package builder
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"gitee.com/openeuler/ktib/pkg/options"
+	"github.com/containers/storage/pkg/unshare"
+	"github.com/opencontainers/runtime-tools/generate"
+	"github.com/sirupsen/logrus"
+)
+
+func TestSetupResources(t *testing.T) {
+	if unshare.IsRootless() {
+		t.Skip("resource limits are not applied when running rootless")
+	}
+	tests := []struct {
+		name    string
+		op      options.SecurityOption
+		memory  int64
+		quota   int64
+		pids    int64
+		wantErr bool
+	}{
+		{name: "none"},
+		{name: "memory", op: options.SecurityOption{Memory: "512m"}, memory: 512 * 1024 * 1024},
+		{name: "cpus", op: options.SecurityOption{CPUs: 1.5}, quota: 150000},
+		{name: "pids", op: options.SecurityOption{PidsLimit: 100}, pids: 100},
+		{name: "unlimited pids", op: options.SecurityOption{PidsLimit: -1}, pids: -1},
+		{name: "bad memory", op: options.SecurityOption{Memory: "lots"}, wantErr: true},
+		{name: "negative cpus", op: options.SecurityOption{CPUs: -1}, wantErr: true},
+		{name: "bad pids", op: options.SecurityOption{PidsLimit: -2}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g, err := generate.New("linux")
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = setupResources(&g, tt.op, logrus.NewEntry(logrus.StandardLogger()))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("setupResources() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			r := g.Config.Linux.Resources
+			var memory, swap, quota, pids int64
+			if r.Memory != nil {
+				memory, swap = *r.Memory.Limit, *r.Memory.Swap
+			}
+			if r.CPU != nil {
+				quota = *r.CPU.Quota
+				if *r.CPU.Period != cpuPeriod {
+					t.Errorf("cpu period = %d, want %d", *r.CPU.Period, cpuPeriod)
+				}
+			}
+			if r.Pids != nil {
+				pids = r.Pids.Limit
+			}
+			if memory != tt.memory || swap != tt.memory {
+				t.Errorf("memory = %d, swap = %d, want %d", memory, swap, tt.memory)
+			}
+			if quota != tt.quota {
+				t.Errorf("cpu quota = %d, want %d", quota, tt.quota)
+			}
+			if pids != tt.pids {
+				t.Errorf("pids limit = %d, want %d", pids, tt.pids)
+			}
+		})
+	}
+}
+
+func TestSetupCapabilities(t *testing.T) {
+	tests := []struct {
+		name    string
+		add     []string
+		drop    []string
+		want    []string
+		wantErr bool
+	}{
+		{name: "drop all", drop: []string{"ALL"}, want: []string{}},
+		{name: "drop all add one", add: []string{"net_bind_service"}, drop: []string{"all"}, want: []string{"CAP_NET_BIND_SERVICE"}},
+		{name: "add all drop all", add: []string{"ALL"}, drop: []string{"ALL"}, wantErr: true},
+		{name: "unknown", add: []string{"CAP_NOPE"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g, err := generate.New("linux")
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = setupCapabilities(&g, tt.add, tt.drop)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("setupCapabilities() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			caps := g.Config.Process.Capabilities
+			for _, set := range [][]string{caps.Bounding, caps.Effective, caps.Permitted} {
+				if !reflect.DeepEqual(set, tt.want) {
+					t.Errorf("capabilities = %v, want %v", set, tt.want)
+				}
+			}
+		})
+	}
+
+	g, err := generate.New("linux")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := setupCapabilities(&g, []string{"SYS_PTRACE"}, []string{"CAP_NET_RAW"}); err != nil {
+		t.Fatal(err)
+	}
+	var ptrace, netRaw bool
+	for _, c := range g.Config.Process.Capabilities.Bounding {
+		ptrace = ptrace || c == "CAP_SYS_PTRACE"
+		netRaw = netRaw || c == "CAP_NET_RAW"
+	}
+	if !ptrace || netRaw {
+		t.Errorf("capabilities = %v, want CAP_SYS_PTRACE without CAP_NET_RAW", g.Config.Process.Capabilities.Bounding)
+	}
+}
+
+func TestSetupSecurityOpts(t *testing.T) {
+	profile := filepath.Join(t.TempDir(), "profile.json")
+	if err := os.WriteFile(profile, []byte(`{"defaultAction": "SCMP_ACT_ALLOW"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		opts      []string
+		noNewPriv bool
+		wantErr   bool
+	}{
+		{name: "unconfined", opts: []string{"seccomp=unconfined"}},
+		{name: "no-new-privileges", opts: []string{"seccomp=unconfined", "no-new-privileges"}, noNewPriv: true},
+		{name: "no-new-privileges false", opts: []string{"seccomp=unconfined", "no-new-privileges=false"}},
+		{name: "bad no-new-privileges", opts: []string{"no-new-privileges=maybe"}, wantErr: true},
+		{name: "empty seccomp", opts: []string{"seccomp="}, wantErr: true},
+		{name: "missing profile", opts: []string{"seccomp=" + profile + ".missing"}, wantErr: true},
+		{name: "unknown", opts: []string{"label=disable"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g, err := generate.New("linux")
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = setupSecurityOpts(&g, tt.opts)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("setupSecurityOpts() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if g.Config.Linux.Seccomp != nil {
+				t.Errorf("seccomp = %v, want none", g.Config.Linux.Seccomp)
+			}
+			if g.Config.Process.NoNewPrivileges != tt.noNewPriv {
+				t.Errorf("no-new-privileges = %v, want %v", g.Config.Process.NoNewPrivileges, tt.noNewPriv)
+			}
+		})
+	}
+}
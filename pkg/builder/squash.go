@@ -0,0 +1,127 @@
+/*
+   Copyright (c) 2023 KylinSoft Co., Ltd.
+   Kylin trusted image builder(ktib) is licensed under Mulan PSL v2.
+   You can use this software according to the terms and conditions of the Mulan PSL v2.
+   You may obtain a copy of Mulan PSL v2 at:
+            http://license.coscl.org.cn/MulanPSL2
+   THIS SOFTWARE IS PROVIDED ON AN "AS IS" BASIS, WITHOUT WARRANTIES OF ANY KIND, EITHER EXPRESS OR IMPLIED, INCLUDING
+   BUT NOT LIMITED TO NON-INFRINGEMENT, MERCHANTABILITY OR FIT FOR A PARTICULAR PURPOSE.
+   See the Mulan PSL v2 for more details.
+*/
+
+package builder
+
+import (
+	"fmt"
+
+	"github.com/containers/storage"
+	"github.com/containers/storage/pkg/archive"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// SquashAll commits the whole filesystem of the builder as a single layer.
+	SquashAll = "all"
+	// SquashNew commits everything added since the base image as a single layer on top of the
+	// layers of the base image.
+	SquashNew = "new"
+)
+
+// ValidateSquash checks a squash mode, an empty mode keeps one layer per commit.
+func ValidateSquash(squash string) error {
+	switch squash {
+	case "", SquashAll, SquashNew:
+		return nil
+	}
+	return fmt.Errorf("unsupported squash mode %q, use %q or %q", squash, SquashAll, SquashNew)
+}
+
+// baseLayer returns the top layer of the image the builder was created from.
+func (b *Builder) baseLayer() (string, error) {
+	if b.FromImageID == "" {
+		return "", nil
+	}
+	img, err := b.Store.Image(b.FromImageID)
+	if err != nil {
+		return "", fmt.Errorf("error reading base image %s: %w", b.FromImageID, err)
+	}
+	return img.TopLayer, nil
+}
+
+// squashLayer writes the filesystem of the container as one new layer and returns its ID. With
+// SquashNew the layer holds the changes on top of the base image, otherwise it holds the whole
+// rootfs and has no parent.
+func (b *Builder) squashLayer(containerLayer string) (string, error) {
+	parent := ""
+	if b.Squash == SquashNew {
+		var err error
+		if parent, err = b.baseLayer(); err != nil {
+			return "", err
+		}
+	}
+	if parent != "" {
+		diff, err := b.Store.Diff(parent, containerLayer, &storage.DiffOptions{})
+		if err != nil {
+			return "", fmt.Errorf("failed to get layer diff: %w", err)
+		}
+		return b.putLayer(parent, diff)
+	}
+	if err := b.Mount(""); err != nil {
+		return "", err
+	}
+	// the files on disk are owned by host ids, the layer records the ids of the container
+	mappings := b.idMappings()
+	rootfs, err := archive.TarWithOptions(b.MountPoint, &archive.TarOptions{
+		UIDMaps: mappings.UIDs(),
+		GIDMaps: mappings.GIDs(),
+	})
+	if err != nil {
+		return "", fmt.Errorf("error archiving %s: %w", b.MountPoint, err)
+	}
+	return b.putLayer("", rootfs)
+}
+
+// squashHistory marks the history entries whose layers were merged into the squashed layer as
+// empty, the entries of the base image keep their layers with SquashNew.
+func (b *Builder) squashHistory() {
+	keep := 0
+	if b.Squash == SquashNew {
+		base, err := b.baseLayer()
+		if err != nil {
+			b.logger().Warnf("unable to read the layers of the base image: %s", err)
+		}
+		var layers []imageLayer
+		if base != "" {
+			if layers, err = layerChain(b.Store, base); err != nil {
+				b.logger().Warnf("unable to read the layers of the base image: %s", err)
+			}
+		}
+		// the entries up to the last layer of the base image belong to the base image
+		for found := 0; keep < len(b.OCIv1.History) && found < len(layers); keep++ {
+			if !b.OCIv1.History[keep].EmptyLayer {
+				found++
+			}
+		}
+	}
+	for i := keep; i < len(b.OCIv1.History); i++ {
+		b.OCIv1.History[i].EmptyLayer = true
+	}
+}
+
+// SquashImage flattens an image of the store into a new image with a single layer and the same
+// configuration, named name. When name is the name of the image, the image is replaced.
+func SquashImage(store storage.Store, image, name string) error {
+	b, err := NewBuilder(store, BuilderOptions{FromImage: image})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := b.Remove(); err != nil {
+			logrus.Warnf("unable to remove builder %s: %s", b.ContainerID, err)
+		}
+	}()
+	b.Squash = SquashAll
+	b.Message = "squashed " + image
+	_, err = b.Commit(name)
+	return err
+}
@@ -0,0 +1,81 @@
+package builder
+
+import (
+	"reflect"
+	"testing"
+
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestValidateSquash(t *testing.T) {
+	for squash, ok := range map[string]bool{"": true, SquashAll: true, SquashNew: true, "layers": false} {
+		if err := ValidateSquash(squash); (err == nil) != ok {
+			t.Errorf("ValidateSquash(%q) = %v", squash, err)
+		}
+	}
+}
+
+func TestSquashHistoryAll(t *testing.T) {
+	b := &Builder{Squash: SquashAll}
+	b.OCIv1.History = []v1.History{
+		{CreatedBy: "/bin/sh -c #(nop) ADD file:base in /"},
+		{CreatedBy: "/bin/sh -c #(nop) CMD [\"/bin/sh\"]", EmptyLayer: true},
+		{CreatedBy: "/bin/sh -c make"},
+	}
+	b.squashHistory()
+	for i, h := range b.OCIv1.History {
+		if !h.EmptyLayer {
+			t.Errorf("history entry %d still has a layer", i)
+		}
+	}
+}
+
+func TestSquashImageReplacesTag(t *testing.T) {
+	store := newTestStore(t)
+	commit := func(name string) string {
+		t.Helper()
+		b, err := NewBuilder(store, BuilderOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer b.Remove()
+		id, err := b.Commit(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	named := commit("docker.io/library/named:1")
+	if err := store.AddNames(named, []string{"docker.io/library/named:2"}); err != nil {
+		t.Fatal(err)
+	}
+	used := commit("docker.io/library/used:1")
+	user, err := store.CreateContainer("", nil, used, "", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unused := commit("docker.io/library/unused:1")
+
+	for _, name := range []string{"docker.io/library/named:1", "docker.io/library/used:1", "docker.io/library/unused:1"} {
+		if err := SquashImage(store, name, name); err != nil {
+			t.Fatalf("SquashImage(%s) error = %v", name, err)
+		}
+	}
+	// an image with other names or users only loses the name that moved to the squashed image
+	img, err := store.Image(named)
+	if err != nil {
+		t.Fatalf("the image with another name was removed: %v", err)
+	}
+	if want := []string{"docker.io/library/named:2"}; !reflect.DeepEqual(img.Names, want) {
+		t.Errorf("names = %v, want %v", img.Names, want)
+	}
+	if img, err := store.Image(used); err != nil || len(img.Names) != 0 {
+		t.Errorf("the image used by a container = %v, %v, want it kept without names", img, err)
+	}
+	if _, err := store.Container(user.ID); err != nil {
+		t.Errorf("the container of the image was removed: %v", err)
+	}
+	if _, err := store.Image(unused); err == nil {
+		t.Error("the image nothing uses any more was kept")
+	}
+}
@@ -0,0 +1,189 @@
+/*
+   Copyright (c) 2023 KylinSoft Co., Ltd.
+   Kylin trusted image builder(ktib) is licensed under Mulan PSL v2.
+   You can use this software according to the terms and conditions of the Mulan PSL v2.
+   You may obtain a copy of Mulan PSL v2 at:
+            http://license.coscl.org.cn/MulanPSL2
+   THIS SOFTWARE IS PROVIDED ON AN "AS IS" BASIS, WITHOUT WARRANTIES OF ANY KIND, EITHER EXPRESS OR IMPLIED, INCLUDING
+   BUT NOT LIMITED TO NON-INFRINGEMENT, MERCHANTABILITY OR FIT FOR A PARTICULAR PURPOSE.
+   See the Mulan PSL v2 for more details.
+*/
+
+package builder
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// errTargetReached stops the build once the stage selected with --target is complete.
+var errTargetReached = errors.New("target stage reached")
+
+// parseFrom splits the arguments of FROM into the base image and the optional stage name.
+func parseFrom(arguments string, log *logrus.Entry) (string, string, error) {
+	flags, rest := extractFlags(arguments)
+	if _, ok := flags["platform"]; ok {
+		log.Warnf("FROM --platform is not supported, the image in the local store is used")
+	}
+	fields := strings.Fields(rest)
+	switch {
+	case len(fields) == 1:
+		return fields[0], "", nil
+	case len(fields) == 3 && strings.EqualFold(fields[1], "AS"):
+		return fields[0], strings.ToLower(fields[2]), nil
+	}
+	return "", "", fmt.Errorf("FROM requires either one or three arguments: %q", arguments)
+}
+
+// extractFlags removes the leading "--name=value" options of an instruction and returns them
+// together with the remaining arguments. Options given more than once keep every value, an
+// option without a value is recorded with an empty one.
+func extractFlags(arguments string) (map[string][]string, string) {
+	flags := make(map[string][]string)
+	rest := strings.TrimSpace(arguments)
+	for strings.HasPrefix(rest, "--") {
+		var flag string
+		if i := strings.IndexAny(rest, " \t"); i >= 0 {
+			flag, rest = rest[:i], strings.TrimSpace(rest[i:])
+		} else {
+			flag, rest = rest, ""
+		}
+		kv := strings.SplitN(strings.TrimPrefix(flag, "--"), "=", 2)
+		value := ""
+		if len(kv) == 2 {
+			value = kv[1]
+		}
+		flags[kv[0]] = append(flags[kv[0]], value)
+	}
+	return flags, rest
+}
+
+// startStage records the builder of a new FROM. Stages can later be referenced by their name
+// or by their index in the Dockerfile.
+func (b *Executor) startStage(name string, builder *Builder) error {
+	index := strconv.Itoa(len(b.stageList))
+	if name != "" {
+		if _, err := strconv.Atoi(name); err == nil {
+			return fmt.Errorf("invalid stage name %q, a name can not be a number", name)
+		}
+		if _, ok := b.stages[name]; ok {
+			return fmt.Errorf("duplicate stage name %q", name)
+		}
+		b.stages[name] = builder
+	}
+	b.stages[index] = builder
+	b.stageList = append(b.stageList, builder)
+	b.stageName = name
+	b.cmdSet = false
+	b.builders = builder
+	// ARG values do not outlive the stage that declared them
+	b.args = make(map[string]string)
+	return nil
+}
+
+// stageRoot returns the root filesystem a COPY --from reads from: a previous stage if one with
+// that name or index exists, otherwise an image in the local store.
+func (b *Executor) stageRoot(from string) (string, error) {
+	if stage, ok := b.stages[strings.ToLower(from)]; ok {
+		if stage == b.builders {
+			return "", fmt.Errorf("COPY --from=%s refers to the current stage", from)
+		}
+		if err := stage.Mount(""); err != nil {
+			return "", err
+		}
+		return stage.MountPoint, nil
+	}
+	img, err := b.store.Image(from)
+	if err != nil {
+		return "", fmt.Errorf("no stage or local image named %q: %w", from, err)
+	}
+	mountPoint, err := b.store.MountImage(img.ID, nil, "")
+	if err != nil {
+		return "", err
+	}
+	b.mountedImages = append(b.mountedImages, img.ID)
+	return mountPoint, nil
+}
+
+// cleanupStages unmounts the images mounted for COPY --from and the builders of every stage. With
+// remove the builders and the images committed for FROM <stage> and for the steps of a build
+// without the cache are removed, otherwise they are kept, the images are still used by the builders.
+func (b *Executor) cleanupStages(remove bool) {
+	for _, stage := range b.stageList {
+		if remove {
+			if err := stage.Remove(); err != nil {
+				b.log.Warnf("unable to remove stage builder %s: %s", stage.ContainerID, err)
+			}
+			continue
+		}
+		if err := stage.unmountAll(); err != nil {
+			b.log.Warnf("unable to unmount stage builder %s: %s", stage.ContainerID, err)
+		}
+	}
+	b.unmountImages()
+	if remove {
+		for _, id := range b.stageImages {
+			if _, err := b.store.DeleteImage(id, true); err != nil {
+				b.log.Warnf("unable to remove intermediate image %s: %s", id, err)
+			}
+		}
+		// the last step first, so that the layers no other image uses are removed with the images
+		for i := len(b.stepImages) - 1; i >= 0; i-- {
+			if _, err := b.store.DeleteImage(b.stepImages[i], true); err != nil {
+				b.log.Warnf("unable to remove intermediate image %s: %s", b.stepImages[i], err)
+			}
+		}
+	}
+	b.stages = make(map[string]*Builder)
+	b.stageList = nil
+	b.stageName = ""
+	b.mountedImages = nil
+	b.stageImages = nil
+	b.stepImages = nil
+}
+
+// unmountImages unmounts the images mounted for COPY --from.
+func (b *Executor) unmountImages() {
+	for _, id := range b.mountedImages {
+		if _, err := b.store.UnmountImage(id, false); err != nil {
+			b.log.Warnf("unable to unmount image %s: %s", id, err)
+		}
+	}
+	b.mountedImages = nil
+}
+
+// unmountAll unmounts the rootfs of the builder, however often it was mounted by its RUN steps.
+func (b *Builder) unmountAll() error {
+	if !b.Store.Exists(b.ContainerID) {
+		return nil
+	}
+	if _, err := b.Store.Unmount(b.ContainerID, true); err != nil {
+		return err
+	}
+	return b.Update(func() error {
+		b.MountPoint = ""
+		return nil
+	})
+}
+
+// inheritConfig copies the settings of a finished stage to a builder started FROM that stage.
+func (b *Builder) inheritConfig(from *Builder) {
+	b.OCIv1 = from.OCIv1
+	b.DockerV2 = from.DockerV2
+	b.Maintainer = from.Maintainer
+	b.EntryPoint = copyStrings(from.EntryPoint)
+	b.Cmd = copyStrings(from.Cmd)
+	b.Env = append([]string{}, from.Env...)
+	b.Workdir = from.Workdir
+	b.User = from.User
+	b.Shell = append([]string{}, from.Shell...)
+	b.Labels = copyStringMap(from.Labels)
+	b.ExposedPorts = copySet(from.ExposedPorts)
+	b.Volumes = copySet(from.Volumes)
+	b.StopSignal = from.StopSignal
+	b.Healthcheck = from.Healthcheck
+}
@@ -0,0 +1,74 @@
+package builder
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestParseFrom(t *testing.T) {
+	tests := []struct {
+		input   string
+		image   string
+		stage   string
+		wantErr bool
+	}{
+		{input: "centos:7", image: "centos:7"},
+		{input: "golang:1.20 AS Build", image: "golang:1.20", stage: "build"},
+		{input: "golang:1.20 as build", image: "golang:1.20", stage: "build"},
+		{input: "--platform=linux/amd64 golang:1.20 AS build", image: "golang:1.20", stage: "build"},
+		{input: "golang:1.20 build", wantErr: true},
+		{input: "golang:1.20 AS", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			image, stage, err := parseFrom(tt.input, logrus.NewEntry(logrus.StandardLogger()))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseFrom() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if image != tt.image || stage != tt.stage {
+				t.Errorf("parseFrom() = %q, %q, want %q, %q", image, stage, tt.image, tt.stage)
+			}
+		})
+	}
+}
+
+func TestExtractFlags(t *testing.T) {
+	flags, rest := extractFlags("--from=build --chown=1001 --link /out/app /usr/bin/app")
+	expected := map[string][]string{"from": {"build"}, "chown": {"1001"}, "link": {""}}
+	if !reflect.DeepEqual(flags, expected) {
+		t.Errorf("extractFlags() flags = %v, want %v", flags, expected)
+	}
+	if rest != "/out/app /usr/bin/app" {
+		t.Errorf("extractFlags() rest = %q", rest)
+	}
+
+	flags, rest = extractFlags("--mount=type=cache,target=/a --mount=type=secret,id=b make")
+	if !reflect.DeepEqual(flags["mount"], []string{"type=cache,target=/a", "type=secret,id=b"}) || rest != "make" {
+		t.Errorf("extractFlags() = %v, %q", flags, rest)
+	}
+}
+
+func TestStartStage(t *testing.T) {
+	e := &Executor{stages: make(map[string]*Builder)}
+	first, second := &Builder{}, &Builder{}
+	if err := e.startStage("build", first); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.startStage("", second); err != nil {
+		t.Fatal(err)
+	}
+	if e.stages["build"] != first || e.stages["0"] != first || e.stages["1"] != second {
+		t.Errorf("stages are not recorded by name and index: %v", e.stages)
+	}
+	if e.builders != second || e.stageName != "" {
+		t.Errorf("current stage was not updated")
+	}
+	if err := e.startStage("build", &Builder{}); err == nil {
+		t.Errorf("expected an error for a duplicate stage name")
+	}
+	if err := e.startStage("2", &Builder{}); err == nil {
+		t.Errorf("expected an error for a numeric stage name")
+	}
+}
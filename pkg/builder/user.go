@@ -0,0 +1,89 @@
+/*
+   Copyright (c) 2023 KylinSoft Co., Ltd.
+   Kylin trusted image builder(ktib) is licensed under Mulan PSL v2.
+   You can use this software according to the terms and conditions of the Mulan PSL v2.
+   You may obtain a copy of Mulan PSL v2 at:
+            http://license.coscl.org.cn/MulanPSL2
+   THIS SOFTWARE IS PROVIDED ON AN "AS IS" BASIS, WITHOUT WARRANTIES OF ANY KIND, EITHER EXPRESS OR IMPLIED, INCLUDING
+   BUT NOT LIMITED TO NON-INFRINGEMENT, MERCHANTABILITY OR FIT FOR A PARTICULAR PURPOSE.
+   See the Mulan PSL v2 for more details.
+*/
+
+package builder
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	securejoin "github.com/cyphar/filepath-securejoin"
+)
+
+// lookupUser resolves a "user[:group]" specification against /etc/passwd and /etc/group inside
+// rootfs. Numeric ids are accepted as they are, a user without a group gets its primary group.
+func lookupUser(rootfs, spec string) (uint32, uint32, error) {
+	if spec == "" {
+		return 0, 0, nil
+	}
+	userPart, groupPart, hasGroup := strings.Cut(spec, ":")
+	uid, gid, err := lookupID(rootfs, "/etc/passwd", userPart)
+	if err != nil {
+		return 0, 0, fmt.Errorf("error resolving user %q: %w", userPart, err)
+	}
+	if hasGroup {
+		gid, _, err = lookupID(rootfs, "/etc/group", groupPart)
+		if err != nil {
+			return 0, 0, fmt.Errorf("error resolving group %q: %w", groupPart, err)
+		}
+	}
+	return uid, gid, nil
+}
+
+// lookupID finds name in a passwd or group formatted file, returning the id in the third field
+// and, for passwd, the primary group in the fourth.
+func lookupID(rootfs, file, name string) (uint32, uint32, error) {
+	if id, err := strconv.ParseUint(name, 10, 32); err == nil {
+		// a bare uid still picks up the primary group of a matching passwd entry
+		if file == "/etc/passwd" {
+			if _, gid, err := scanIDFile(rootfs, file, func(fields []string) bool { return fields[2] == name }); err == nil {
+				return uint32(id), gid, nil
+			}
+		}
+		return uint32(id), 0, nil
+	}
+	return scanIDFile(rootfs, file, func(fields []string) bool { return fields[0] == name })
+}
+
+func scanIDFile(rootfs, file string, match func([]string) bool) (uint32, uint32, error) {
+	path, err := securejoin.SecureJoin(rootfs, file)
+	if err != nil {
+		return 0, 0, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) < 3 || !match(fields) {
+			continue
+		}
+		id, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			return 0, 0, err
+		}
+		var gid uint64
+		if len(fields) > 3 {
+			gid, _ = strconv.ParseUint(fields[3], 10, 32)
+		}
+		return uint32(id), uint32(gid), nil
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, 0, err
+	}
+	return 0, 0, fmt.Errorf("no matching entry in %s", file)
+}
@@ -0,0 +1,46 @@
+package builder
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLookupUser(t *testing.T) {
+	rootfs := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(rootfs, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	passwd := "root:x:0:0:root:/root:/bin/bash\napp:x:1001:1002::/home/app:/sbin/nologin\n"
+	group := "root:x:0:\nstaff:x:50:app\napp:x:1002:\n"
+	if err := os.WriteFile(filepath.Join(rootfs, "etc/passwd"), []byte(passwd), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(rootfs, "etc/group"), []byte(group), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		spec     string
+		uid, gid uint32
+		wantErr  bool
+	}{
+		{spec: "", uid: 0, gid: 0},
+		{spec: "app", uid: 1001, gid: 1002},
+		{spec: "app:staff", uid: 1001, gid: 50},
+		{spec: "1001", uid: 1001, gid: 1002},
+		{spec: "2000:2000", uid: 2000, gid: 2000},
+		{spec: "nobody", wantErr: true},
+		{spec: "app:nogroup", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			uid, gid, err := lookupUser(rootfs, tt.spec)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("lookupUser() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if uid != tt.uid || gid != tt.gid {
+				t.Errorf("lookupUser() = %d:%d, want %d:%d", uid, gid, tt.uid, tt.gid)
+			}
+		})
+	}
+}
@@ -0,0 +1,58 @@
+/*
+   Copyright (c) 2023 KylinSoft Co., Ltd.
+   Kylin trusted image builder(ktib) is licensed under Mulan PSL v2.
+   You can use this software according to the terms and conditions of the Mulan PSL v2.
+   You may obtain a copy of Mulan PSL v2 at:
+            http://license.coscl.org.cn/MulanPSL2
+   THIS SOFTWARE IS PROVIDED ON AN "AS IS" BASIS, WITHOUT WARRANTIES OF ANY KIND, EITHER EXPRESS OR IMPLIED, INCLUDING
+   BUT NOT LIMITED TO NON-INFRINGEMENT, MERCHANTABILITY OR FIT FOR A PARTICULAR PURPOSE.
+   See the Mulan PSL v2 for more details.
+*/
+
+package imagemanager
+
+import (
+	"fmt"
+
+	"gitee.com/openeuler/ktib/pkg/options"
+	"github.com/containers/common/libimage"
+	"github.com/containers/image/v5/pkg/compression"
+)
+
+// compressionLevels are the levels accepted by each compression format.
+var compressionLevels = map[string][2]int{
+	compression.Gzip.Name():        {0, 9},
+	compression.Zstd.Name():        {1, 20},
+	compression.ZstdChunked.Name(): {1, 20},
+}
+
+// CompressionCopyOptions checks op and returns the copy options that write the layers with its
+// format and level. Without a format the destination keeps its default, gzip for registries.
+func CompressionCopyOptions(op options.CompressionOption) (libimage.CopyOptions, error) {
+	var copyOptions libimage.CopyOptions
+	if op.CompressionFormat == "" && op.CompressionLevel == nil {
+		return copyOptions, nil
+	}
+	format := op.CompressionFormat
+	if format == "" {
+		format = compression.Gzip.Name()
+	}
+	levels, ok := compressionLevels[format]
+	if !ok {
+		return copyOptions, fmt.Errorf("unsupported compression format %q, use gzip, zstd or zstd:chunked", format)
+	}
+	if level := op.CompressionLevel; level != nil && (*level < levels[0] || *level > levels[1]) {
+		return copyOptions, fmt.Errorf("compression level %d of %s is out of range %d-%d", *level, format, levels[0], levels[1])
+	}
+	algorithm, err := compression.AlgorithmByName(format)
+	if err != nil {
+		return copyOptions, err
+	}
+	copyOptions.CompressionFormat = &algorithm
+	copyOptions.CompressionLevel = op.CompressionLevel
+	// blobs already present at the destination with another compression are not reused, and
+	// dir: destinations compress too
+	copyOptions.ForceCompressionFormat = op.CompressionFormat != ""
+	copyOptions.DirForceCompress = true
+	return copyOptions, nil
+}
@@ -0,0 +1,47 @@
+package imagemanager
+
+import (
+	"testing"
+
+	"gitee.com/openeuler/ktib/pkg/options"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompressionCopyOptions(t *testing.T) {
+	level := func(l int) *int { return &l }
+	tests := []struct {
+		name      string
+		op        options.CompressionOption
+		algorithm string
+		force     bool
+		wantErr   bool
+	}{
+		{name: "default", op: options.CompressionOption{}},
+		{name: "gzip", op: options.CompressionOption{CompressionFormat: "gzip", CompressionLevel: level(9)}, algorithm: "gzip", force: true},
+		{name: "zstd", op: options.CompressionOption{CompressionFormat: "zstd", CompressionLevel: level(19)}, algorithm: "zstd", force: true},
+		{name: "zstd:chunked", op: options.CompressionOption{CompressionFormat: "zstd:chunked"}, algorithm: "zstd:chunked", force: true},
+		{name: "level only", op: options.CompressionOption{CompressionLevel: level(1)}, algorithm: "gzip"},
+		{name: "gzip level out of range", op: options.CompressionOption{CompressionFormat: "gzip", CompressionLevel: level(19)}, wantErr: true},
+		{name: "zstd level out of range", op: options.CompressionOption{CompressionFormat: "zstd", CompressionLevel: level(0)}, wantErr: true},
+		{name: "unknown format", op: options.CompressionOption{CompressionFormat: "xz"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			copyOptions, err := CompressionCopyOptions(tt.op)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			if tt.algorithm == "" {
+				assert.Nil(t, copyOptions.CompressionFormat)
+				return
+			}
+			require.NotNil(t, copyOptions.CompressionFormat)
+			assert.Equal(t, tt.algorithm, copyOptions.CompressionFormat.Name())
+			assert.Equal(t, tt.op.CompressionLevel, copyOptions.CompressionLevel)
+			assert.Equal(t, tt.force, copyOptions.ForceCompressionFormat)
+		})
+	}
+}
@@ -1,11 +1,15 @@
 package imagemanager
 
 import (
+	"archive/tar"
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
 	"strings"
+	"time"
 
 	"gitee.com/openeuler/ktib/pkg/options"
 	"github.com/containers/common/libimage"
@@ -110,12 +114,16 @@ func (im *ImageManager) Pull(imageName string) error {
 	return nil
 }
 
-func (im *ImageManager) Push(args []string) error {
+func (im *ImageManager) Push(args []string, op options.PushOption) error {
 	runtime := im.Manager
-	pushOptions := &libimage.PushOptions{}
+	copyOptions, err := CompressionCopyOptions(op.CompressionOption)
+	if err != nil {
+		return err
+	}
+	pushOptions := &libimage.PushOptions{CopyOptions: copyOptions}
 	image := args[0]
 	destination := args[len(args)-1]
-	_, err := runtime.Push(context.Background(), image, destination, pushOptions)
+	_, err = runtime.Push(context.Background(), image, destination, pushOptions)
 	if err != nil {
 		return err
 	}
@@ -199,7 +207,7 @@ func (im *ImageManager) SaveImage(args []string, store storage.Store, tarFileNam
 		return fmt.Errorf("save failed, image name or ID cannot be empty")
 	}
 	if !store.Exists(args[0]) {
-		fmt.Errorf("image not exist: %s", args[0]) 
+		return fmt.Errorf("image not exist: %s", args[0])
 	}
 	var output io.Writer
 	if tarFileName == "" {
@@ -13,6 +13,10 @@ package options
 
 import (
 	"io"
+	"sync"
+	"time"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
 )
 
 type Option struct {
@@ -45,6 +49,7 @@ type PullOption struct {
 
 type PushOption struct {
 	SignBy string
+	CompressionOption
 }
 
 type RemoveOption struct {
@@ -63,22 +68,47 @@ type SaveOption struct {
 }
 
 type BuildersOption struct {
-	Json bool
+	Json    bool
+	All     bool
+	Filters []string
+}
+
+type PruneOption struct {
+	Force          bool
+	IncludeMounted bool
+	Filters        []string
 }
 
 type BuildOptions struct {
 	File             []string
 	Tags             string
+	Target           string
 	NoCache          bool
 	Rm               bool
 	ForceRm          bool
 	ContextDirectory string
 	Args             map[string]string
-	Log func(format string, args ...interface{})
+	Secrets          map[string]string
+	Network          string
+	Log              func(format string, args ...interface{})
 	In               io.Reader
 	Out              io.Writer
 	Err              io.Writer
 	OutputFormat     string
+	Timestamp        *time.Time
+	Squash           string
+	// Progress is the progress output of the build, plain or json
+	Progress string
+	// IIDFile is written with the ID of the built image
+	IIDFile string
+	// Timeout limits the time of the whole build and StepTimeout the time of every step
+	Timeout     time.Duration
+	StepTimeout time.Duration
+	// Resume is the builder of a failed build to continue, KeepOnFailure keeps the builder of a
+	// failed build mounted with the changes of the failed step
+	Resume        string
+	KeepOnFailure bool
+	SecurityOption
 }
 
 type FromOption struct {
@@ -98,8 +128,73 @@ type FromOption struct {
 }
 
 type RUNOption struct {
-	Workdir string
-	Runtime string
+	Workdir  string
+	Runtime  string
+	User     string
+	Env      []string
+	Network  string
+	Mounts   []specs.Mount
+	Hostname string
+	// In is the input of the command, Out and Err receive its output, os.Stdin, os.Stdout and
+	// os.Stderr when nil
+	In  io.Reader
+	Out io.Writer
+	Err io.Writer
+	// Volumes are bind mounts in the SOURCE:DESTINATION[:OPTIONS] form of the -v flag.
+	Volumes  []string
+	Terminal bool
+	// StoreLock is held by the caller while it uses the store, it is released while the command
+	// runs so that the builds running at the same time can use the store
+	StoreLock sync.Locker
+	SecurityOption
+}
+
+// SecurityOption limits the resources and privileges of the commands run in a builder.
+type SecurityOption struct {
+	Memory      string
+	CPUs        float64
+	PidsLimit   int64
+	CapAdd      []string
+	CapDrop     []string
+	SecurityOpt []string
+}
+
+// CompressionOption selects the compression of the layers of an image written out of the store,
+// a nil CompressionLevel keeps the default level of the format.
+type CompressionOption struct {
+	CompressionFormat string
+	CompressionLevel  *int
+}
+
+type AddOption struct {
+	Extract    bool
+	Chown      string
+	Chmod      string
+	Link       bool
+	ContextDir string
+	Excludes   []string
+}
+
+// ConfigOption changes the image configuration of a builder. Nil fields are left unchanged, the
+// list fields add KEY=VALUE entries and remove the entry of a KEY given with a trailing "-".
+type ConfigOption struct {
+	Env         []string
+	Entrypoint  *string
+	Cmd         *string
+	User        *string
+	Workdir     *string
+	Ports       []string
+	Volumes     []string
+	Labels      []string
+	Annotations []string
+	Author      *string
+	Comment     *string
+	StopSignal  *string
+	Healthcheck *string
+}
+
+type InspectOption struct {
+	Format string
 }
 
 type MountOption struct {
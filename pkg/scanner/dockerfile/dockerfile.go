@@ -12,9 +12,7 @@
 package dockerfile
 
 import (
-	"bytes"
 	"gitee.com/openeuler/ktib/pkg/scanner/parsingutils"
-	"github.com/moby/buildkit/frontend/dockerfile/parser"
 	"io/ioutil"
 	"log"
 	"path/filepath"
@@ -65,9 +63,8 @@ func NewDockerfile(path string) (*Dockerfile, error) {
 	if len(dockerfileContent) == 0 {
 		return nil, &EmptyFileError{}
 	}
-	dockerfileReader := bytes.NewReader([]byte(dockerfileContent))
 	vistor := NewDockerfileVisitor(dockerfile)
-	parsedLines, err := parser.Parse(dockerfileReader)
+	parsedLines, err := parsingutils.ParseDockerfile([]byte(dockerfileContent))
 	if err != nil {
 		return nil, &EmptyFileError{}
 	}
@@ -0,0 +1,25 @@
+/*
+   Copyright (c) 2023 KylinSoft Co., Ltd.
+   Kylin trusted image builder(ktib) is licensed under Mulan PSL v2.
+   You can use this software according to the terms and conditions of the Mulan PSL v2.
+   You may obtain a copy of Mulan PSL v2 at:
+            http://license.coscl.org.cn/MulanPSL2
+   THIS SOFTWARE IS PROVIDED ON AN "AS IS" BASIS, WITHOUT WARRANTIES OF ANY KIND, EITHER EXPRESS OR IMPLIED, INCLUDING
+   BUT NOT LIMITED TO NON-INFRINGEMENT, MERCHANTABILITY OR FIT FOR A PARTICULAR PURPOSE.
+   See the Mulan PSL v2 for more details.
+*/
+
+package parsingutils
+
+import (
+	"bytes"
+
+	"github.com/moby/buildkit/frontend/dockerfile/parser"
+)
+
+// ParseDockerfile parses the content of a Dockerfile with the buildkit parser, which the scanner
+// and the builder share. It handles the escape parser directive, line continuations, comments and
+// heredocs, every instruction of the AST records the lines it was read from.
+func ParseDockerfile(content []byte) (*parser.Result, error) {
+	return parser.Parse(bytes.NewReader(content))
+}
@@ -20,7 +20,7 @@ RUN yum install -y rubygems && yum clean all -y
 RUN gem install asdf
 
 # TODO (optional): Copy the builder files into /opt/app-root
-# COPY ./<builder_folder>/ /opt/app-root/
+# COPY --chown=1001:0 ./<builder_folder>/ /opt/app-root/
 COPY ./init/bin/xxx /usr/bin/xxx
 
 # This default user is created in the base image
@@ -39,4 +39,6 @@ type JsonBuilder struct {
 	ImageID string    `json:"imageID"`
 	Created time.Time `json:"created,omitempty"`
 	Mount   string    `json:"mount,omitempty"`
+	// External marks a container that was not created by ktib
+	External bool `json:"external,omitempty"`
 }
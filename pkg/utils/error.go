@@ -32,6 +32,12 @@ var (
 	ErrExit                 = errors.New("exit")
 )
 
+// exitCoder is implemented by errors that carry the exit status of a command, like the one of a
+// command run in a builder. ktib exits with that status.
+type exitCoder interface {
+	ExitCode() int
+}
+
 func fatal(msg string, code int) {
 	if len(msg) > 0 {
 		// add newline if needed
@@ -52,7 +58,10 @@ func checkErr(err error, handleErr func(string, int)) {
 	if err == nil {
 		return
 	}
+	var exitErr exitCoder
 	switch {
+	case errors.As(err, &exitErr):
+		handleErr(err.Error(), exitErr.ExitCode())
 	case err == ErrExit:
 		handleErr("", DefaultErrorExitCode)
 	case strings.Contains(err.Error(), ErrInvalidSubCommandMsg):
@@ -0,0 +1,50 @@
+/*
+   Copyright (c) 2023 KylinSoft Co., Ltd.
+   Kylin trusted image builder(ktib) is licensed under Mulan PSL v2.
+   You can use this software according to the terms and conditions of the Mulan PSL v2.
+   You may obtain a copy of Mulan PSL v2 at:
+            http://license.coscl.org.cn/MulanPSL2
+   THIS SOFTWARE IS PROVIDED ON AN "AS IS" BASIS, WITHOUT WARRANTIES OF ANY KIND, EITHER EXPRESS OR IMPLIED, INCLUDING
+   BUT NOT LIMITED TO NON-INFRINGEMENT, MERCHANTABILITY OR FIT FOR A PARTICULAR PURPOSE.
+   See the Mulan PSL v2 for more details.
+*/
+
+package utils
+
+import (
+	"strconv"
+
+	"gitee.com/openeuler/ktib/pkg/options"
+	"github.com/spf13/pflag"
+)
+
+// CompressionFlags adds --compression-format and --compression-level for op to flags.
+func CompressionFlags(flags *pflag.FlagSet, op *options.CompressionOption) {
+	flags.StringVar(&op.CompressionFormat, "compression-format", "", "compression format of the layers: 'gzip', 'zstd' or 'zstd:chunked'")
+	flags.Var(&optionalInt{p: &op.CompressionLevel}, "compression-level", "compression level of the layers, 0-9 for gzip and 1-20 for zstd")
+}
+
+// optionalInt is an int flag that is left nil unless it is given.
+type optionalInt struct {
+	p **int
+}
+
+func (o *optionalInt) String() string {
+	if *o.p == nil {
+		return ""
+	}
+	return strconv.Itoa(**o.p)
+}
+
+func (o *optionalInt) Set(value string) error {
+	v, err := strconv.Atoi(value)
+	if err != nil {
+		return err
+	}
+	*o.p = &v
+	return nil
+}
+
+func (o *optionalInt) Type() string {
+	return "int"
+}
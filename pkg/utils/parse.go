@@ -21,11 +21,9 @@ import (
 
 	"gitee.com/openeuler/ktib/pkg/options"
 
-	"gitee.com/openeuler/ktib/pkg/builder"
 	ktype "gitee.com/openeuler/ktib/pkg/types"
 	"github.com/containers/common/pkg/report"
 	"github.com/containers/image/v5/types"
-	container "github.com/containers/storage"
 	"github.com/docker/go-units"
 	"github.com/opencontainers/go-digest"
 	"github.com/sirupsen/logrus"
@@ -43,14 +41,6 @@ type imageReport struct {
 	TopLayer string
 }
 
-type containerReport struct {
-	ID      string
-	Names   string
-	LayerID string
-	ImageID string
-	Created string
-}
-
 func humanSize(s int64) string {
 	if s < 1024 {
 		return fmt.Sprintf("%.2fB", float64(s)/float64(1))
@@ -98,26 +88,6 @@ func sortImages(imgs []imagemanager.Image) ([]imageReport, error) {
 	return imgReport, nil
 }
 
-func sortContainers(containers []container.Container) ([]containerReport, error) {
-	var containerReports []containerReport
-	for _, c := range containers {
-		var containerName string
-		if len(c.Names) > 0 {
-			containerName = c.Names[0]
-		} else {
-			containerName = ""
-		}
-		containerReports = append(containerReports, containerReport{
-			ID:      c.ID[:10],
-			Names:   containerName,
-			LayerID: c.LayerID,
-			ImageID: c.ImageID,
-			Created: units.HumanDuration(time.Since(c.Created)) + " ago",
-		})
-	}
-	return containerReports, nil
-}
-
 func FormatImages(images []imagemanager.Image, ops options.ImagesOption) error {
 	//TODO 参考docker以image table format 输出
 	defaultImageTableFormat := "table {{.Name}} {{.ID}}  {{.Size}} {{.TopLayer}}   {{.Created}}"
@@ -187,77 +157,3 @@ func JsonFormatImages(images []imagemanager.Image, ops options.ImagesOption) err
 	fmt.Printf("%s\n", data)
 	return nil
 }
-
-func FormatBuilders(containers []container.Container, ops options.BuildersOption) error {
-	// TODO 参考docker输出
-	defaultBuilderTableFormat := "table {{.ID}}  {{.Names}} {{.LayerID}} {{.ImageID}}   {{.Created}}"
-	containerReports, err := sortContainers(containers)
-	if err != nil {
-		return err
-	}
-	headers := report.Headers(containerReport{}, map[string]string{
-		"Name": "Name",
-	})
-	formater, err := report.New(os.Stdout, "format").Parse(report.OriginPodman, defaultBuilderTableFormat)
-	if err != nil {
-		return err
-	}
-	defer func() {
-		err = formater.Flush()
-		if err != nil {
-			logrus.Error(err)
-		}
-	}()
-	err = formater.Execute(headers)
-	if err != nil {
-		return err
-	}
-	err = formater.Execute(containerReports)
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
-func JsonFormatBuilders(containers []container.Container, ops options.BuildersOption) error {
-	var jsonBuilders []ktype.JsonBuilder
-	for _, b := range containers {
-		jsonBuilders = append(jsonBuilders,
-			ktype.JsonBuilder{
-				ID:      b.ID,
-				Names:   b.Names,
-				ImageID: b.ImageID,
-				Created: b.Created,
-			})
-	}
-	data, err := json.MarshalIndent(jsonBuilders, "", "    ")
-	if err != nil {
-		return err
-	}
-	fmt.Printf("%s\n", data)
-	return nil
-}
-
-func JsonFormatMountInfo(builders []*builder.Builder) error {
-	var jsonBuilders []ktype.JsonBuilder
-	for _, b := range builders {
-		if b.MountPoint != "" {
-			jsonBuilders = append(jsonBuilders,
-				ktype.JsonBuilder{
-					ID:      b.ID,
-					Mount:   b.MountPoint,
-					ImageID: b.FromImageID,
-				})
-		}
-	}
-	data, err := json.MarshalIndent(jsonBuilders, "", "    ")
-	if err != nil {
-		return err
-	}
-	fmt.Printf("%s\n", data)
-	return nil
-}
-
-func FormatMountInfo(builders []*builder.Builder) error {
-	return nil
-}